@@ -16,10 +16,15 @@ func Default(program string) *goconfig.Config {
 			Required: true,
 			Short:    true,
 			Data: &iconfig.NfqueueCfg{
-				QIDs:        []int{0},
-				Policy:      "accept",
-				OnError:     "drop",
-				TickSeconds: 5,
+				QIDs:           []int{0},
+				Policy:         "accept",
+				OnError:        "drop",
+				TickSeconds:    5,
+				QueueLen:       1024,
+				CopyMode:       "packet",
+				BackoffSecs:    1,
+				MaxBackoffSecs: 60,
+				FlowsTimeout:   120,
 			},
 		},
 		goconfig.Section{
@@ -46,6 +51,16 @@ func Default(program string) *goconfig.Config {
 			Required: false,
 			Data:     &cconfig.HealthCfg{},
 		},
+		goconfig.Section{
+			Name:     "metrics",
+			Required: false,
+			Data:     &iconfig.MetricsCfg{},
+		},
+		goconfig.Section{
+			Name:     "admin",
+			Required: false,
+			Data:     &iconfig.AdminCfg{},
+		},
 	)
 	if err != nil {
 		panic(err)
@@ -14,7 +14,7 @@ import (
 	iconfig "github.com/luids-io/netfilter/internal/config"
 	ifactory "github.com/luids-io/netfilter/internal/factory"
 	"github.com/luids-io/netfilter/pkg/nfqueue"
-	"github.com/luids-io/netfilter/pkg/nfqueue/builder"
+	"github.com/luids-io/netfilter/pkg/nfqueue/metrics"
 )
 
 func createLogger(debug bool) (yalogi.Logger, error) {
@@ -38,6 +38,46 @@ func createHealthSrv(msrv *serverd.Manager, logger yalogi.Logger) error {
 	return nil
 }
 
+func createMetricsCollector() *metrics.Collector {
+	cfgMetrics := cfg.Data("metrics").(*iconfig.MetricsCfg)
+	if cfgMetrics.Empty() {
+		return nil
+	}
+	return metrics.New()
+}
+
+func createMetricsSrv(collector *metrics.Collector, msrv *serverd.Manager, logger yalogi.Logger) error {
+	cfgMetrics := cfg.Data("metrics").(*iconfig.MetricsCfg)
+	if !cfgMetrics.Empty() {
+		mlis, msrvhttp, err := ifactory.Metrics(cfgMetrics, collector, logger)
+		if err != nil {
+			return err
+		}
+		msrv.Register(serverd.Service{
+			Name:     fmt.Sprintf("metrics.[%s]", cfgMetrics.ListenURI),
+			Start:    func() error { go msrvhttp.Serve(mlis); return nil },
+			Shutdown: func() { msrvhttp.Close() },
+		})
+	}
+	return nil
+}
+
+func createAdminSrv(nfsvc *nfqueue.PacketService, plugins *pluginManager, switches *nfqueue.Switches, tracer *nfqueue.Tracer, msrv *serverd.Manager, logger yalogi.Logger) error {
+	cfgAdmin := cfg.Data("admin").(*iconfig.AdminCfg)
+	if !cfgAdmin.Empty() {
+		alis, asrvhttp, err := ifactory.Admin(cfgAdmin, nfsvc, plugins, switches, tracer, logger)
+		if err != nil {
+			return err
+		}
+		msrv.Register(serverd.Service{
+			Name:     fmt.Sprintf("admin.[%s]", cfgAdmin.ListenURI),
+			Start:    func() error { go asrvhttp.Serve(alis); return nil },
+			Shutdown: func() { asrvhttp.Close() },
+		})
+	}
+	return nil
+}
+
 func createAPIServices(msrv *serverd.Manager, logger yalogi.Logger) (apiservice.Discover, error) {
 	cfgServices := cfg.Data("ids.api").(*cconfig.APIServicesCfg)
 	registry, err := cfactory.APIAutoloader(cfgServices, logger)
@@ -68,38 +108,57 @@ func setupEventNotify(registry apiservice.Discover, msrv *serverd.Manager, logge
 	return nil
 }
 
-func createPacketPlugins(registry apiservice.Discover, msrv *serverd.Manager, logger yalogi.Logger) (*builder.Builder, error) {
+func createPacketPlugins(registry apiservice.Discover, switches *nfqueue.Switches, msrv *serverd.Manager, logger yalogi.Logger) (*pluginManager, error) {
 	cfgPacketProc := cfg.Data("nfqueue").(*iconfig.NfqueueCfg)
-	b, err := ifactory.PacketProcBuilder(cfgPacketProc, registry, logger)
-	if err != nil {
-		return nil, err
-	}
-	err = ifactory.PacketPlugins(cfgPacketProc, b, logger)
+	plugins, err := newPluginManager(cfgPacketProc, registry, switches, logger)
 	if err != nil {
 		return nil, err
 	}
 	// register packet processor service
 	msrv.Register(serverd.Service{
-		Name:  "nfqueue.processor",
-		Start: b.Start,
-		Shutdown: func() {
-			b.CleanUp()
-			b.Shutdown()
-		},
+		Name:     "nfqueue.processor",
+		Start:    plugins.Start,
+		Shutdown: plugins.Shutdown,
+		Reload:   plugins.Reload,
 	})
-	return b, nil
+	return plugins, nil
+}
+
+func createNfqueueTracer(msrv *serverd.Manager, logger yalogi.Logger) (*nfqueue.Tracer, error) {
+	cfgNfqueue := cfg.Data("nfqueue").(*iconfig.NfqueueCfg)
+	tracer, closer, err := ifactory.NfqueueTracer(cfgNfqueue, logger)
+	if err != nil {
+		return nil, err
+	}
+	if closer != nil {
+		msrv.Register(serverd.Service{
+			Name:     fmt.Sprintf("nfqueue.trace.[%s]", cfgNfqueue.TraceOutput),
+			Shutdown: func() { closer.Close() },
+		})
+	}
+	return tracer, nil
 }
 
-func createNfqueueProc(logger yalogi.Logger) (nfqueue.PacketProcessor, error) {
+func createNfqueueProc(collector *metrics.Collector, switches *nfqueue.Switches, tracer *nfqueue.Tracer, logger yalogi.Logger) (nfqueue.PacketProcessor, error) {
 	cfgNfqueue := cfg.Data("nfqueue").(*iconfig.NfqueueCfg)
-	return ifactory.NfqueueProc(cfgNfqueue, logger)
+	return ifactory.NfqueueProc(cfgNfqueue, nfqueueCollector(collector), switches, tracer, logger)
+}
+
+// nfqueueCollector avoids passing a nil pointer as collector
+func nfqueueCollector(collector *metrics.Collector) nfqueue.Collector {
+	if collector == nil {
+		return nil
+	}
+	return collector
 }
 
-func createNfqueueSvc(proc nfqueue.PacketProcessor, b *builder.Builder, msrv *serverd.Manager, logger yalogi.Logger) (*nfqueue.PacketService, error) {
-	nfqueuesvc, err := ifactory.NfqueueSvc(proc, b, logger)
+func createNfqueueSvc(proc nfqueue.PacketProcessor, plugins *pluginManager, collector *metrics.Collector, msrv *serverd.Manager, logger yalogi.Logger) (*nfqueue.PacketService, error) {
+	cfgNfqueue := cfg.Data("nfqueue").(*iconfig.NfqueueCfg)
+	nfqueuesvc, err := ifactory.NfqueueSvc(cfgNfqueue, proc, plugins.Builder(), nfqueueCollector(collector), logger)
 	if err != nil {
 		return nil, err
 	}
+	plugins.SetService(nfqueuesvc)
 	// register packet processor service
 	msrv.Register(serverd.Service{
 		Name:     "nfqueue.service",
@@ -110,10 +169,17 @@ func createNfqueueSvc(proc nfqueue.PacketProcessor, b *builder.Builder, msrv *se
 	return nfqueuesvc, nil
 }
 
-func setupNfqueues(nfsvc *nfqueue.PacketService, logger yalogi.Logger) error {
+func createNfqueueGroups(plugins *pluginManager) ([]ifactory.NfqueueGroup, error) {
 	cfgNfqueue := cfg.Data("nfqueue").(*iconfig.NfqueueCfg)
-	for _, qid := range cfgNfqueue.QIDs {
-		nfsvc.Register(qid)
+	return ifactory.NfqueueGroups(cfgNfqueue, plugins.Builder())
+}
+
+func setupNfqueues(nfsvc *nfqueue.PacketService, groups []ifactory.NfqueueGroup, logger yalogi.Logger) error {
+	for _, g := range groups {
+		err := nfsvc.RegisterGroupWith(g.Name, g.QIDs, g.Config)
+		if err != nil {
+			return fmt.Errorf("queue %s: %v", g.Name, err)
+		}
 	}
 	return nil
 }
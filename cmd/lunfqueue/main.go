@@ -10,6 +10,7 @@ import (
 
 	"github.com/luids-io/core/serverd"
 	"github.com/luids-io/netfilter/cmd/lunfqueue/config"
+	"github.com/luids-io/netfilter/pkg/nfqueue"
 )
 
 //Variables for version output
@@ -27,6 +28,10 @@ var (
 	help       = false
 	debug      = false
 	dryRun     = false
+	// replay command
+	replayFlags  = pflag.NewFlagSet("replay", pflag.ContinueOnError)
+	replayOutput = ""
+	replayQID    = -1
 )
 
 func init() {
@@ -38,6 +43,17 @@ func init() {
 	pflag.BoolVarP(&help, "help", "h", help, "Show this help.")
 	pflag.BoolVar(&debug, "debug", debug, "Enable debug.")
 	pflag.BoolVar(&dryRun, "dry-run", dryRun, "Checks and construct list but not start service.")
+	//replay command params
+	replayFlags.StringVar(&replayOutput, "output", replayOutput, "Write replay records as JSONL to file ('-' for stdout).")
+	replayFlags.IntVar(&replayQID, "qid", replayQID, "Replay through the plugins of the queue (first configured if negative).")
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [replay [replay flags] <capture file>]\n", Program)
+		pflag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "Replay flags:")
+		replayFlags.PrintDefaults()
+	}
+	// flags after the command are parsed by the command
+	pflag.CommandLine.SetInterspersed(false)
 	pflag.Parse()
 }
 
@@ -71,6 +87,15 @@ func main() {
 		logger.Debugf("configuration dump:\n%v", cfg.Dump())
 	}
 
+	// run command if requested
+	if pflag.NArg() > 0 {
+		err = runCommand(pflag.Args(), logger)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		os.Exit(0)
+	}
+
 	// creates main server manager
 	msrv := serverd.New(Program, serverd.SetLogger(logger))
 
@@ -86,31 +111,49 @@ func main() {
 		logger.Fatalf("couldn't create event notify: %v", err)
 	}
 
+	//create runtime switches of plugins and actions
+	switches := nfqueue.NewSwitches()
+
 	//create packet plugins
-	plugins, err := createPacketPlugins(apisvc, msrv, logger)
+	plugins, err := createPacketPlugins(apisvc, switches, msrv, logger)
 	if err != nil {
 		logger.Fatalf("create builder: %v", err)
 	}
 
+	//create metrics collector
+	collector := createMetricsCollector()
+
+	//create packet tracer
+	tracer, err := createNfqueueTracer(msrv, logger)
+	if err != nil {
+		logger.Fatalf("create nfqueue tracer: %v", err)
+	}
+
 	//create nfqueue processor
-	pcktproc, err := createNfqueueProc(logger)
+	pcktproc, err := createNfqueueProc(collector, switches, tracer, logger)
 	if err != nil {
 		logger.Fatalf("create nfqueue processor: %v", err)
 	}
 
+	//create nfqueue groups with their plugin chains
+	groups, err := createNfqueueGroups(plugins)
+	if err != nil {
+		logger.Fatalf("create nfqueue groups: %v", err)
+	}
+
 	if dryRun {
 		fmt.Println("configuration seems ok")
 		os.Exit(0)
 	}
 
 	//create nfqueue service processor
-	pcktsvc, err := createNfqueueSvc(pcktproc, plugins, msrv, logger)
+	pcktsvc, err := createNfqueueSvc(pcktproc, plugins, collector, msrv, logger)
 	if err != nil {
 		logger.Fatalf("create nfqueue service: %v", err)
 	}
 
 	// setup local capture interfaces and register in packet service processor
-	err = setupNfqueues(pcktsvc, logger)
+	err = setupNfqueues(pcktsvc, groups, logger)
 	if err != nil {
 		logger.Fatalf("registering queues: %v", err)
 	}
@@ -121,6 +164,18 @@ func main() {
 		logger.Fatalf("creating health server: %v", err)
 	}
 
+	// creates metrics server
+	err = createMetricsSrv(collector, msrv, logger)
+	if err != nil {
+		logger.Fatalf("creating metrics server: %v", err)
+	}
+
+	// creates admin server
+	err = createAdminSrv(pcktsvc, plugins, switches, tracer, msrv, logger)
+	if err != nil {
+		logger.Fatalf("creating admin server: %v", err)
+	}
+
 	//run server
 	err = msrv.Run()
 	if err != nil {
@@ -0,0 +1,186 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/luids-io/core/apiservice"
+	"github.com/luids-io/core/yalogi"
+	iconfig "github.com/luids-io/netfilter/internal/config"
+	ifactory "github.com/luids-io/netfilter/internal/factory"
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+	"github.com/luids-io/netfilter/pkg/nfqueue/builder"
+)
+
+// pluginManager owns the builder of the running plugins, it rebuilds them
+// from definitions on reload
+type pluginManager struct {
+	cfg      *iconfig.NfqueueCfg
+	registry apiservice.Discover
+	switches *nfqueue.Switches
+	logger   yalogi.Logger
+
+	mu  sync.Mutex
+	b   *builder.Builder
+	svc *nfqueue.PacketService
+}
+
+func newPluginManager(cfg *iconfig.NfqueueCfg, registry apiservice.Discover, switches *nfqueue.Switches, logger yalogi.Logger) (*pluginManager, error) {
+	b, err := buildPlugins(cfg, registry, logger)
+	if err != nil {
+		return nil, err
+	}
+	setMonitor(b, switches)
+	return &pluginManager{cfg: cfg, registry: registry, switches: switches, logger: logger, b: b}, nil
+}
+
+func buildPlugins(cfg *iconfig.NfqueueCfg, registry apiservice.Discover, logger yalogi.Logger) (*builder.Builder, error) {
+	b, err := ifactory.PacketProcBuilder(cfg, registry, logger)
+	if err != nil {
+		return nil, err
+	}
+	err = ifactory.PacketPlugins(cfg, b, logger)
+	if err != nil {
+		b.CleanUp()
+		return nil, err
+	}
+	return b, nil
+}
+
+// setMonitor sets the monitor mode of the plugins and actions of the
+// builder from their definitions
+func setMonitor(b *builder.Builder, switches *nfqueue.Switches) {
+	for name, on := range monitorDefs(b) {
+		switches.SetMonitor(name, on)
+	}
+}
+
+// monitorDefs returns the monitor mode of the definitions of the plugins
+// and actions of the builder
+func monitorDefs(b *builder.Builder) map[string]bool {
+	defs := make(map[string]bool)
+	for _, p := range b.Plugins() {
+		defs[p.Name()] = false
+	}
+	for _, name := range b.Actions() {
+		defs[name] = false
+	}
+	for _, name := range b.Monitored() {
+		defs[name] = true
+	}
+	return defs
+}
+
+// monitorChanges returns the monitor mode that must be applied when the
+// builder b replaces old: the definitions of plugins and actions that are
+// new or whose monitor mode changed. Removed ones are returned with the
+// monitor mode off, the rest keep the mode set at runtime.
+func monitorChanges(old, b *builder.Builder) map[string]bool {
+	prev, next := monitorDefs(old), monitorDefs(b)
+	changes := make(map[string]bool)
+	for name, on := range next {
+		if was, ok := prev[name]; !ok || was != on {
+			changes[name] = on
+		}
+	}
+	for name := range prev {
+		if _, ok := next[name]; !ok {
+			changes[name] = false
+		}
+	}
+	return changes
+}
+
+// addMonitor sets the monitor mode of the changes with it on and returns
+// the names that weren't in monitor mode
+func addMonitor(changes map[string]bool, switches *nfqueue.Switches) []string {
+	added := make([]string, 0)
+	for name, on := range changes {
+		if on && !switches.Monitor(name) {
+			switches.SetMonitor(name, true)
+			added = append(added, name)
+		}
+	}
+	return added
+}
+
+// Builder returns the current builder
+func (m *pluginManager) Builder() *builder.Builder {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.b
+}
+
+// SetService sets the packet service whose plugins are reloaded
+func (m *pluginManager) SetService(svc *nfqueue.PacketService) {
+	m.mu.Lock()
+	m.svc = svc
+	m.mu.Unlock()
+}
+
+// Start the current builder
+func (m *pluginManager) Start() error {
+	return m.Builder().Start()
+}
+
+// Shutdown cleans up the plugins and shutdowns the current builder
+func (m *pluginManager) Shutdown() {
+	b := m.Builder()
+	b.CleanUp()
+	b.Shutdown()
+}
+
+// Reload rebuilds plugins from definitions and swaps them in the packet
+// service, if something fails the running plugins are kept
+func (m *pluginManager) Reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.svc == nil {
+		return errors.New("packet service not available")
+	}
+	m.logger.Infof("reloading plugin definitions")
+	b, err := buildPlugins(m.cfg, m.registry, m.logger)
+	if err != nil {
+		return fmt.Errorf("building plugins: %v", err)
+	}
+	err = b.Start()
+	if err != nil {
+		b.CleanUp()
+		b.Shutdown()
+		return fmt.Errorf("starting plugins: %v", err)
+	}
+	// only the monitor mode of new or changed definitions is applied, so
+	// the mode set at runtime is kept. Plugins and actions defined in
+	// monitor mode must not apply verdicts once they're swapped, the rest
+	// of the changes are applied after
+	changes := monitorChanges(m.b, b)
+	added := addMonitor(changes, m.switches)
+	err = m.svc.Reload(b.Plugins())
+	if err != nil {
+		for _, name := range added {
+			m.switches.SetMonitor(name, false)
+		}
+		b.CleanUp()
+		b.Shutdown()
+		return err
+	}
+	names := make([]string, 0, len(changes))
+	for name, on := range changes {
+		m.switches.SetMonitor(name, on)
+		names = append(names, fmt.Sprintf("%s=%v", name, on))
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		m.logger.Infof("monitor mode set from definitions: %s", strings.Join(names, ", "))
+	}
+	old := m.b
+	m.b = b
+	old.CleanUp()
+	old.Shutdown()
+	return nil
+}
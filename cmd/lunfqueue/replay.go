@@ -0,0 +1,292 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	cconfig "github.com/luids-io/common/config"
+	cfactory "github.com/luids-io/common/factory"
+	"github.com/luids-io/core/yalogi"
+	iconfig "github.com/luids-io/netfilter/internal/config"
+	ifactory "github.com/luids-io/netfilter/internal/factory"
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+)
+
+// replayRecord is the output of a replayed packet
+type replayRecord struct {
+	N         int       `json:"n"`
+	Timestamp time.Time `json:"timestamp"`
+	QID       int       `json:"qid"`
+	Proto     string    `json:"proto,omitempty"`
+	SrcIP     string    `json:"srcip,omitempty"`
+	SrcPort   int       `json:"srcport,omitempty"`
+	DstIP     string    `json:"dstip,omitempty"`
+	DstPort   int       `json:"dstport,omitempty"`
+	Plugin    string    `json:"plugin,omitempty"`
+	Action    string    `json:"action,omitempty"`
+	Verdict   string    `json:"verdict"`
+	WouldBe   string    `json:"wouldbe,omitempty"`
+	Mangled   bool      `json:"mangled,omitempty"`
+	TimedOut  bool      `json:"timeout,omitempty"`
+}
+
+// replaySummary stores counters of the replay
+type replaySummary struct {
+	packets  int
+	timeouts int
+	errors   int
+	verdicts map[string]int
+	deciders map[string]int
+}
+
+func runCommand(args []string, logger yalogi.Logger) error {
+	switch args[0] {
+	case "replay":
+		err := replayFlags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if replayFlags.NArg() != 1 {
+			return errors.New("usage: replay [replay flags] <capture file>")
+		}
+		return runReplay(replayFlags.Arg(0), logger)
+	default:
+		return fmt.Errorf("unknown command '%s'", args[0])
+	}
+}
+
+// runReplay replays the capture through the plugins of a configured queue,
+// with the same chain, verdicts and strategy used by the service. As in the
+// service, the priority of the plugins overrides the order of the chain.
+func runReplay(fname string, logger yalogi.Logger) error {
+	cfgNfqueue := cfg.Data("nfqueue").(*iconfig.NfqueueCfg)
+	// create api services required by plugins, events are not notified
+	cfgServices := cfg.Data("ids.api").(*cconfig.APIServicesCfg)
+	registry, err := cfactory.APIAutoloader(cfgServices, logger)
+	if err != nil {
+		return fmt.Errorf("couldn't create api registry: %v", err)
+	}
+	defer registry.CloseAll()
+	// create plugins
+	b, err := ifactory.PacketProcBuilder(cfgNfqueue, registry, logger)
+	if err != nil {
+		return fmt.Errorf("create builder: %v", err)
+	}
+	err = ifactory.PacketPlugins(cfgNfqueue, b, logger)
+	if err != nil {
+		return fmt.Errorf("create builder: %v", err)
+	}
+	groups, err := ifactory.NfqueueGroups(cfgNfqueue, b)
+	if err != nil {
+		return fmt.Errorf("create nfqueue groups: %v", err)
+	}
+	group, err := replayGroup(groups, replayQID)
+	if err != nil {
+		return err
+	}
+	hooks, err := nfqueue.NewGroupHooks(group.Config, b.Plugins())
+	if err != nil {
+		return fmt.Errorf("nfqueue group %s: %v", group.Name, err)
+	}
+	err = b.Start()
+	if err != nil {
+		return fmt.Errorf("starting plugins: %v", err)
+	}
+	defer func() {
+		b.CleanUp()
+		b.Shutdown()
+	}()
+	// create replay processor with the monitor mode of definitions
+	switches := nfqueue.NewSwitches()
+	setMonitor(b, switches)
+	tracer, closer, err := ifactory.NfqueueTracer(cfgNfqueue, logger)
+	if err != nil {
+		return fmt.Errorf("create tracer: %v", err)
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+	replay, err := ifactory.NfqueueReplay(cfgNfqueue, fname, switches, tracer, logger)
+	if err != nil {
+		return fmt.Errorf("create replay processor: %v", err)
+	}
+	// setup output
+	out, summaryOut := io.Writer(os.Stdout), io.Writer(os.Stdout)
+	jsonl := replayOutput != ""
+	if replayOutput == "-" {
+		summaryOut = os.Stderr
+	} else if jsonl {
+		f, err := os.Create(replayOutput)
+		if err != nil {
+			return fmt.Errorf("creating output: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	summary := &replaySummary{verdicts: make(map[string]int), deciders: make(map[string]int)}
+	// records after a write error are only counted
+	var werr error
+	replay.OnRecord(func(r nfqueue.ReplayRecord) {
+		rec := toReplayRecord(r)
+		summary.add(rec)
+		if werr != nil {
+			return
+		}
+		if jsonl {
+			werr = enc.Encode(rec)
+			return
+		}
+		_, werr = fmt.Fprintln(w, rec)
+	})
+	// replay capture through the plugins
+	_, errs, err := replay.Process(group.QIDs, hooks)
+	if err != nil {
+		return err
+	}
+	for err := range errs {
+		summary.errors++
+		logger.Warnf("%v", err)
+	}
+	// errors channel is closed after the last record
+	if err := w.Flush(); err != nil && werr == nil {
+		werr = err
+	}
+	if werr != nil {
+		return fmt.Errorf("writing replay output: %v", werr)
+	}
+	summary.print(summaryOut)
+	return nil
+}
+
+// replayGroup returns the group of the queue, the first configured if qid
+// is negative
+func replayGroup(groups []ifactory.NfqueueGroup, qid int) (ifactory.NfqueueGroup, error) {
+	if len(groups) == 0 {
+		return ifactory.NfqueueGroup{}, errors.New("qids field required")
+	}
+	if qid < 0 {
+		return groups[0], nil
+	}
+	for _, g := range groups {
+		for _, q := range g.QIDs {
+			if q == qid {
+				return g, nil
+			}
+		}
+	}
+	return ifactory.NfqueueGroup{}, fmt.Errorf("nfqueue %v is not configured", qid)
+}
+
+func toReplayRecord(r nfqueue.ReplayRecord) replayRecord {
+	rec := replayRecord{
+		N:         r.N,
+		Timestamp: r.Timestamp,
+		QID:       r.QID,
+		Plugin:    r.Plugin,
+		Action:    r.Action,
+		Verdict:   r.Verdict.String(),
+		Mangled:   r.Mangled,
+		TimedOut:  r.TimedOut,
+	}
+	if r.WouldBe != nfqueue.Default {
+		rec.WouldBe = r.WouldBe.String()
+	}
+	if r.Packet == nil {
+		return rec
+	}
+	switch ip := r.Packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		rec.Proto = strings.ToLower(ip.Protocol.String())
+		rec.SrcIP, rec.DstIP = ip.SrcIP.String(), ip.DstIP.String()
+	case *layers.IPv6:
+		rec.Proto = strings.ToLower(ip.NextHeader.String())
+		rec.SrcIP, rec.DstIP = ip.SrcIP.String(), ip.DstIP.String()
+	}
+	if tl := r.Packet.TransportLayer(); tl != nil {
+		rec.Proto = strings.ToLower(tl.LayerType().String())
+		src, dst := tl.TransportFlow().Endpoints()
+		rec.SrcPort, rec.DstPort = endpointPort(src), endpointPort(dst)
+	}
+	return rec
+}
+
+func endpointPort(e gopacket.Endpoint) int {
+	port, _ := strconv.Atoi(e.String())
+	return port
+}
+
+func (r replayRecord) String() string {
+	src, dst := r.SrcIP, r.DstIP
+	if r.SrcPort > 0 || r.DstPort > 0 {
+		src = fmt.Sprintf("%s:%v", r.SrcIP, r.SrcPort)
+		dst = fmt.Sprintf("%s:%v", r.DstIP, r.DstPort)
+	}
+	s := fmt.Sprintf("#%v %s qid=%v %s %s -> %s %s", r.N, r.Timestamp.Format(time.RFC3339Nano),
+		r.QID, r.Proto, src, dst, r.Verdict)
+	if r.TimedOut {
+		s = s + " (timeout)"
+	} else if decider := r.decider(); decider != "" {
+		s = fmt.Sprintf("%s (%s)", s, decider)
+	}
+	if r.WouldBe != "" {
+		s = fmt.Sprintf("%s [monitor: %s]", s, r.WouldBe)
+	}
+	return s
+}
+
+func (r replayRecord) decider() string {
+	if r.Action != "" {
+		return r.Action
+	}
+	return r.Plugin
+}
+
+func (s *replaySummary) add(r replayRecord) {
+	s.packets++
+	if r.TimedOut {
+		s.timeouts++
+	}
+	s.verdicts[r.Verdict]++
+	decider := r.decider()
+	if decider == "" {
+		decider = "policy"
+	}
+	s.deciders[decider]++
+}
+
+func (s *replaySummary) print(w io.Writer) {
+	fmt.Fprintf(w, "packets: %v\ntimeouts: %v\nerrors: %v\n", s.packets, s.timeouts, s.errors)
+	fmt.Fprintln(w, "verdicts:")
+	for _, k := range sortedKeys(s.verdicts) {
+		fmt.Fprintf(w, "  %s: %v\n", k, s.verdicts[k])
+	}
+	fmt.Fprintln(w, "decided by:")
+	for _, k := range sortedKeys(s.deciders) {
+		fmt.Fprintf(w, "  %s: %v\n", k, s.deciders[k])
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
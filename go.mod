@@ -4,18 +4,17 @@ go 1.13
 
 require (
 	github.com/florianl/go-nfqueue v0.0.0-20190611182652-327225dbfdfc
-	github.com/gofrs/uuid v3.3.0+incompatible
-	github.com/golang/protobuf v1.4.2
+	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/google/gopacket v1.1.18
 	github.com/gorilla/mux v1.8.0
-	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0
 	github.com/luids-io/api v0.0.0-20201202044103-84b873ae1d6a
 	github.com/luids-io/common v0.0.0-20201020041845-ed2a021e5faa
 	github.com/luids-io/core v0.0.0-20201201052906-a54a33a9bc9d
-	github.com/luisguillenc/tlslayer v0.0.0-20200514135550-a8d356c888c6
-	github.com/patrickmn/go-cache v2.1.0+incompatible
-	github.com/sirupsen/logrus v1.6.0
+	github.com/mdlayher/netlink v0.0.0-20190313131330-258ea9dff42c
+	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
+	github.com/prometheus/client_golang v0.9.3
+	github.com/sirupsen/logrus v1.6.0 // indirect
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
-	google.golang.org/grpc v1.29.1
+	google.golang.org/grpc v1.29.1 // indirect
 )
@@ -0,0 +1,87 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/luids-io/common/util"
+)
+
+// AdminCfg stores http admin server preferences
+type AdminCfg struct {
+	ListenURI string
+	Allowed   []string
+}
+
+// SetPFlags setups posix flags for commandline configuration
+func (cfg *AdminCfg) SetPFlags(short bool, prefix string) {
+	aprefix := ""
+	if prefix != "" {
+		aprefix = prefix + "."
+	}
+	pflag.StringVar(&cfg.ListenURI, aprefix+"listenuri", cfg.ListenURI, "Admin api socket.")
+	pflag.StringSliceVar(&cfg.Allowed, aprefix+"allowed", cfg.Allowed, "List of allowed IPs or CIDRs.")
+}
+
+// BindViper setups posix flags for commandline configuration and bind to viper
+func (cfg *AdminCfg) BindViper(v *viper.Viper, prefix string) {
+	aprefix := ""
+	if prefix != "" {
+		aprefix = prefix + "."
+	}
+	util.BindViper(v, aprefix+"listenuri")
+	util.BindViper(v, aprefix+"allowed")
+}
+
+// FromViper fill values from viper
+func (cfg *AdminCfg) FromViper(v *viper.Viper, prefix string) {
+	aprefix := ""
+	if prefix != "" {
+		aprefix = prefix + "."
+	}
+	cfg.ListenURI = v.GetString(aprefix + "listenuri")
+	cfg.Allowed = v.GetStringSlice(aprefix + "allowed")
+}
+
+// Empty returns true if configuration is empty
+func (cfg AdminCfg) Empty() bool {
+	if cfg.ListenURI != "" {
+		return false
+	}
+	if len(cfg.Allowed) > 0 {
+		return false
+	}
+	return true
+}
+
+// Validate checks that configuration is ok
+func (cfg AdminCfg) Validate() error {
+	if cfg.ListenURI == "" {
+		return errors.New("listenuri is required")
+	}
+	_, _, err := util.ParseListenURI(cfg.ListenURI)
+	if err != nil {
+		return err
+	}
+	for _, item := range cfg.Allowed {
+		_, _, err = net.ParseCIDR(item)
+		if err != nil {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return fmt.Errorf("value '%v' is not a valid ip or cidr", item)
+			}
+		}
+	}
+	return nil
+}
+
+// Dump configuration
+func (cfg AdminCfg) Dump() string {
+	return fmt.Sprintf("%+v", cfg)
+}
@@ -6,22 +6,75 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"github.com/luids-io/common/util"
+	"github.com/luids-io/netfilter/pkg/nfqueue"
 )
 
 // NfqueueCfg defines the configuration of nfqueue manager
 type NfqueueCfg struct {
-	LocalNets   []string
-	PluginDirs  []string
-	PluginFiles []string
-	QIDs        []int
-	Policy      string
-	OnError     string
-	TickSeconds int
+	LocalNets      []string
+	PluginDirs     []string
+	PluginFiles    []string
+	QIDs           []int
+	Groups         []string
+	Policy         string
+	OnError        string
+	Strategy       string
+	TickSeconds    int
+	QueueLen       int
+	CopyRange      int
+	CopyMode       string
+	FailOpen       bool
+	GSO            bool
+	Conntrack      bool
+	Workers        int
+	TimeoutMSecs   int
+	OnTimeout      string
+	BackoffSecs    int
+	MaxBackoffSecs int
+	OnFailure      string
+	TraceEnable    bool
+	TraceOutput    string
+	TraceNets      []string
+	TracePorts     []int
+	FlowsEnable    bool
+	FlowsTimeout   int
+	FlowsMax       int
+	// Queues defines the plugins and verdicts of queues, it's only
+	// available in configuration files
+	Queues []QueueCfg
+	// queuesErr stores the error decoding queues
+	queuesErr error
+}
+
+// QueueCfg defines the chain of plugins of a queue or a group of queues
+type QueueCfg struct {
+	// QIDs is a queue id or a group of queues "first:last"
+	QIDs string `mapstructure:"qids"`
+	// Plugins are the names of the plugins in order, all if empty
+	Plugins []string `mapstructure:"plugins"`
+	// Policy, OnError and Strategy override the global values if not empty
+	Policy   string `mapstructure:"policy"`
+	OnError  string `mapstructure:"onerror"`
+	Strategy string `mapstructure:"strategy"`
+}
+
+// ToQIDs returns the queue ids of the queue configuration
+func (q QueueCfg) ToQIDs() ([]int, error) {
+	if strings.IndexAny(q.QIDs, ":-") >= 0 {
+		return ToQIDGroup(q.QIDs)
+	}
+	qid, err := strconv.Atoi(q.QIDs)
+	if err != nil || qid < 0 || qid > 0xFFFF {
+		return nil, fmt.Errorf("invalid qid '%s'", q.QIDs)
+	}
+	return []int{qid}, nil
 }
 
 // SetPFlags setups posix flags for commandline configuration
@@ -34,9 +87,30 @@ func (cfg *NfqueueCfg) SetPFlags(short bool, prefix string) {
 	pflag.StringSliceVar(&cfg.PluginDirs, aprefix+"plugin.dirs", cfg.PluginDirs, "Plugin dirs.")
 	pflag.StringSliceVar(&cfg.PluginFiles, aprefix+"plugin.files", cfg.PluginFiles, "Plugin files.")
 	pflag.IntSliceVar(&cfg.QIDs, aprefix+"qids", cfg.QIDs, "Queue ids to manage.")
-	pflag.StringVar(&cfg.Policy, aprefix+"policy", cfg.Policy, "Default policy.")
-	pflag.StringVar(&cfg.Policy, aprefix+"onerror", cfg.Policy, "On decoding error verdict.")
+	pflag.StringSliceVar(&cfg.Groups, aprefix+"groups", cfg.Groups, "Queue groups sharing plugins (first:last).")
+	pflag.StringVar(&cfg.Policy, aprefix+"policy", cfg.Policy, "Default policy verdict.")
+	pflag.StringVar(&cfg.OnError, aprefix+"onerror", cfg.OnError, "On decoding error verdict.")
+	pflag.StringVar(&cfg.Strategy, aprefix+"strategy", cfg.Strategy, "Verdicts combination strategy ('first-match', 'most-restrictive' or 'accept-nonterminal').")
 	pflag.IntVar(&cfg.TickSeconds, aprefix+"tick", cfg.TickSeconds, "Seconds per tick in packet processors.")
+	pflag.IntVar(&cfg.QueueLen, aprefix+"queuelen", cfg.QueueLen, "Max packets in kernel queue.")
+	pflag.IntVar(&cfg.CopyRange, aprefix+"copyrange", cfg.CopyRange, "Max bytes copied from packets (0 computes it from plugins).")
+	pflag.StringVar(&cfg.CopyMode, aprefix+"copymode", cfg.CopyMode, "Copy mode ('packet' or 'meta').")
+	pflag.BoolVar(&cfg.FailOpen, aprefix+"failopen", cfg.FailOpen, "Accept packets when kernel queue is full.")
+	pflag.BoolVar(&cfg.GSO, aprefix+"gso", cfg.GSO, "Receive GSO packets without segmentation.")
+	pflag.BoolVar(&cfg.Conntrack, aprefix+"conntrack", cfg.Conntrack, "Request conntrack information.")
+	pflag.IntVar(&cfg.Workers, aprefix+"workers", cfg.Workers, "Packet processing workers per queue.")
+	pflag.IntVar(&cfg.TimeoutMSecs, aprefix+"timeout", cfg.TimeoutMSecs, "Milliseconds deadline for processing a packet (0 disables it).")
+	pflag.StringVar(&cfg.OnTimeout, aprefix+"ontimeout", cfg.OnTimeout, "On deadline exceeded verdict (onerror verdict if empty).")
+	pflag.IntVar(&cfg.BackoffSecs, aprefix+"backoff", cfg.BackoffSecs, "Seconds before restarting a failed queue (0 disables restarts).")
+	pflag.IntVar(&cfg.MaxBackoffSecs, aprefix+"maxbackoff", cfg.MaxBackoffSecs, "Max seconds before restarting a failed queue.")
+	pflag.StringVar(&cfg.OnFailure, aprefix+"onfailure", cfg.OnFailure, "Verdict while a failed queue is restarting (kernel decides if empty).")
+	pflag.BoolVar(&cfg.TraceEnable, aprefix+"trace.enable", cfg.TraceEnable, "Trace the hooks executed in packets.")
+	pflag.StringVar(&cfg.TraceOutput, aprefix+"trace.output", cfg.TraceOutput, "Write traces as JSONL to file (log if empty).")
+	pflag.StringSliceVar(&cfg.TraceNets, aprefix+"trace.nets", cfg.TraceNets, "Trace only packets from or to nets.")
+	pflag.IntSliceVar(&cfg.TracePorts, aprefix+"trace.ports", cfg.TracePorts, "Trace only packets from or to ports.")
+	pflag.BoolVar(&cfg.FlowsEnable, aprefix+"flows.enable", cfg.FlowsEnable, "Track flows of packets.")
+	pflag.IntVar(&cfg.FlowsTimeout, aprefix+"flows.timeout", cfg.FlowsTimeout, "Seconds before expiring idle flows.")
+	pflag.IntVar(&cfg.FlowsMax, aprefix+"flows.max", cfg.FlowsMax, "Max flows tracked (0 unlimited).")
 }
 
 // BindViper setups posix flags for commandline configuration and bind to viper
@@ -49,9 +123,30 @@ func (cfg *NfqueueCfg) BindViper(v *viper.Viper, prefix string) {
 	util.BindViper(v, aprefix+"plugin.dirs")
 	util.BindViper(v, aprefix+"plugin.files")
 	util.BindViper(v, aprefix+"qids")
+	util.BindViper(v, aprefix+"groups")
 	util.BindViper(v, aprefix+"policy")
 	util.BindViper(v, aprefix+"onerror")
+	util.BindViper(v, aprefix+"strategy")
 	util.BindViper(v, aprefix+"tick")
+	util.BindViper(v, aprefix+"queuelen")
+	util.BindViper(v, aprefix+"copyrange")
+	util.BindViper(v, aprefix+"copymode")
+	util.BindViper(v, aprefix+"failopen")
+	util.BindViper(v, aprefix+"gso")
+	util.BindViper(v, aprefix+"conntrack")
+	util.BindViper(v, aprefix+"workers")
+	util.BindViper(v, aprefix+"timeout")
+	util.BindViper(v, aprefix+"ontimeout")
+	util.BindViper(v, aprefix+"backoff")
+	util.BindViper(v, aprefix+"maxbackoff")
+	util.BindViper(v, aprefix+"onfailure")
+	util.BindViper(v, aprefix+"trace.enable")
+	util.BindViper(v, aprefix+"trace.output")
+	util.BindViper(v, aprefix+"trace.nets")
+	util.BindViper(v, aprefix+"trace.ports")
+	util.BindViper(v, aprefix+"flows.enable")
+	util.BindViper(v, aprefix+"flows.timeout")
+	util.BindViper(v, aprefix+"flows.max")
 }
 
 // FromViper fill values from viper
@@ -64,9 +159,34 @@ func (cfg *NfqueueCfg) FromViper(v *viper.Viper, prefix string) {
 	cfg.PluginDirs = v.GetStringSlice(aprefix + "plugin.dirs")
 	cfg.PluginFiles = v.GetStringSlice(aprefix + "plugin.files")
 	cfg.QIDs = v.GetIntSlice(aprefix + "qids")
+	cfg.Groups = v.GetStringSlice(aprefix + "groups")
 	cfg.Policy = v.GetString(aprefix + "policy")
 	cfg.OnError = v.GetString(aprefix + "onerror")
+	cfg.Strategy = v.GetString(aprefix + "strategy")
 	cfg.TickSeconds = v.GetInt(aprefix + "tick")
+	cfg.QueueLen = v.GetInt(aprefix + "queuelen")
+	cfg.CopyRange = v.GetInt(aprefix + "copyrange")
+	cfg.CopyMode = v.GetString(aprefix + "copymode")
+	cfg.FailOpen = v.GetBool(aprefix + "failopen")
+	cfg.GSO = v.GetBool(aprefix + "gso")
+	cfg.Conntrack = v.GetBool(aprefix + "conntrack")
+	cfg.Workers = v.GetInt(aprefix + "workers")
+	cfg.TimeoutMSecs = v.GetInt(aprefix + "timeout")
+	cfg.OnTimeout = v.GetString(aprefix + "ontimeout")
+	cfg.BackoffSecs = v.GetInt(aprefix + "backoff")
+	cfg.MaxBackoffSecs = v.GetInt(aprefix + "maxbackoff")
+	cfg.OnFailure = v.GetString(aprefix + "onfailure")
+	cfg.TraceEnable = v.GetBool(aprefix + "trace.enable")
+	cfg.TraceOutput = v.GetString(aprefix + "trace.output")
+	cfg.TraceNets = v.GetStringSlice(aprefix + "trace.nets")
+	cfg.TracePorts = v.GetIntSlice(aprefix + "trace.ports")
+	cfg.FlowsEnable = v.GetBool(aprefix + "flows.enable")
+	cfg.FlowsTimeout = v.GetInt(aprefix + "flows.timeout")
+	cfg.FlowsMax = v.GetInt(aprefix + "flows.max")
+	cfg.Queues, cfg.queuesErr = nil, nil
+	if v.IsSet(aprefix + "queues") {
+		cfg.queuesErr = v.UnmarshalKey(aprefix+"queues", &cfg.Queues)
+	}
 }
 
 // Empty returns true if configuration is empty
@@ -80,6 +200,12 @@ func (cfg NfqueueCfg) Empty() bool {
 	if len(cfg.QIDs) > 0 {
 		return false
 	}
+	if len(cfg.Groups) > 0 {
+		return false
+	}
+	if len(cfg.Queues) > 0 {
+		return false
+	}
 	if cfg.Policy != "" {
 		return false
 	}
@@ -107,7 +233,10 @@ func (cfg NfqueueCfg) Validate() error {
 			return fmt.Errorf("plugin dir '%s' doesn't exists", dir)
 		}
 	}
-	if len(cfg.QIDs) == 0 {
+	if cfg.queuesErr != nil {
+		return fmt.Errorf("invalid queues: %v", cfg.queuesErr)
+	}
+	if len(cfg.QIDs) == 0 && len(cfg.Groups) == 0 && len(cfg.Queues) == 0 {
 		return fmt.Errorf("qids field required")
 	}
 	qids := make(map[int]bool, len(cfg.QIDs))
@@ -121,18 +250,131 @@ func (cfg NfqueueCfg) Validate() error {
 		}
 		qids[qid] = true
 	}
-	if !util.IsValid(cfg.Policy, []string{"accept", "drop"}) {
+	for _, s := range cfg.Groups {
+		group, err := ToQIDGroup(s)
+		if err != nil {
+			return err
+		}
+		for _, qid := range group {
+			_, repeated := qids[qid]
+			if repeated {
+				return fmt.Errorf("qid %v in group '%s' is repeated", qid, s)
+			}
+			qids[qid] = true
+		}
+	}
+	for _, q := range cfg.Queues {
+		group, err := q.ToQIDs()
+		if err != nil {
+			return err
+		}
+		for _, qid := range group {
+			_, repeated := qids[qid]
+			if repeated {
+				return fmt.Errorf("qid %v in queue '%s' is repeated", qid, q.QIDs)
+			}
+			qids[qid] = true
+		}
+		plugins := make(map[string]bool, len(q.Plugins))
+		for _, name := range q.Plugins {
+			if name == "" {
+				return fmt.Errorf("empty plugin name in queue '%s'", q.QIDs)
+			}
+			if plugins[name] {
+				return fmt.Errorf("plugin '%s' in queue '%s' is repeated", name, q.QIDs)
+			}
+			plugins[name] = true
+		}
+		if q.Policy != "" && !isValidVerdict(q.Policy) {
+			return fmt.Errorf("invalid policy value in queue '%s'", q.QIDs)
+		}
+		if q.OnError != "" && !isValidVerdict(q.OnError) {
+			return fmt.Errorf("invalid onerror value in queue '%s'", q.QIDs)
+		}
+		if _, err := nfqueue.ToStrategy(q.Strategy); err != nil {
+			return fmt.Errorf("invalid strategy value in queue '%s'", q.QIDs)
+		}
+	}
+	if !isValidVerdict(cfg.Policy) {
 		return errors.New("invalid policy value")
 	}
-	if !util.IsValid(cfg.OnError, []string{"accept", "drop"}) {
+	if !isValidVerdict(cfg.OnError) {
 		return errors.New("invalid onerror value")
 	}
+	if _, err := nfqueue.ToStrategy(cfg.Strategy); err != nil {
+		return errors.New("invalid strategy value")
+	}
 	if cfg.TickSeconds < 0 {
 		return errors.New("invalid tick")
 	}
+	if cfg.QueueLen < 0 {
+		return errors.New("invalid queuelen")
+	}
+	if cfg.CopyRange < 0 || cfg.CopyRange > 0xFFFF {
+		return errors.New("invalid copyrange")
+	}
+	if !util.IsValid(cfg.CopyMode, []string{"", "packet", "meta"}) {
+		return errors.New("invalid copymode value")
+	}
+	if cfg.Workers < 0 {
+		return errors.New("invalid workers")
+	}
+	if cfg.TimeoutMSecs < 0 {
+		return errors.New("invalid timeout")
+	}
+	if cfg.OnTimeout != "" && !isValidVerdict(cfg.OnTimeout) {
+		return errors.New("invalid ontimeout value")
+	}
+	if cfg.BackoffSecs < 0 {
+		return errors.New("invalid backoff")
+	}
+	if cfg.MaxBackoffSecs < 0 {
+		return errors.New("invalid maxbackoff")
+	}
+	if cfg.OnFailure != "" && !isValidVerdict(cfg.OnFailure) {
+		return errors.New("invalid onfailure value")
+	}
+	if _, err := nfqueue.ToTraceFilter(cfg.TraceNets, cfg.TracePorts); err != nil {
+		return fmt.Errorf("invalid trace filter: %v", err)
+	}
+	if cfg.FlowsEnable {
+		if cfg.FlowsTimeout <= 0 {
+			return errors.New("invalid flows.timeout")
+		}
+		if cfg.FlowsMax < 0 {
+			return errors.New("invalid flows.max")
+		}
+		if cfg.TickSeconds <= 0 {
+			return errors.New("flows require tick")
+		}
+	}
 	return nil
 }
 
+// ToQIDGroup returns the qids of a group defined as a range of queues
+// "first:last", like in iptables queue balance option.
+func ToQIDGroup(s string) ([]int, error) {
+	i := strings.IndexAny(s, ":-")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid group '%s'", s)
+	}
+	first, err1 := strconv.Atoi(s[:i])
+	last, err2 := strconv.Atoi(s[i+1:])
+	if err1 != nil || err2 != nil || first < 0 || last < first || last > 0xFFFF {
+		return nil, fmt.Errorf("invalid group '%s'", s)
+	}
+	qids := make([]int, 0, last-first+1)
+	for qid := first; qid <= last; qid++ {
+		qids = append(qids, qid)
+	}
+	return qids, nil
+}
+
+func isValidVerdict(s string) bool {
+	v, err := nfqueue.ToVerdict(s)
+	return err == nil && v != nfqueue.Default
+}
+
 // Dump configuration
 func (cfg NfqueueCfg) Dump() string {
 	return fmt.Sprintf("%+v", cfg)
@@ -0,0 +1,132 @@
+// Copyright 2019 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestToQIDGroup(t *testing.T) {
+	var tests = []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{"0:3", []int{0, 1, 2, 3}, false},
+		{"10-12", []int{10, 11, 12}, false},
+		{"5:5", []int{5}, false},
+		{"65534:65535", []int{65534, 65535}, false},
+		{"5", nil, true},
+		{"3:1", nil, true},
+		{"-1:2", nil, true},
+		{"a:b", nil, true},
+		{"1:", nil, true},
+		{"65535:65536", nil, true},
+	}
+	for _, test := range tests {
+		got, err := ToQIDGroup(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ToQIDGroup(%q) err = %v, wantErr %v", test.in, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ToQIDGroup(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestQueueCfgToQIDs(t *testing.T) {
+	var tests = []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{"7", []int{7}, false},
+		{"1:2", []int{1, 2}, false},
+		{"65536", nil, true},
+		{"", nil, true},
+	}
+	for _, test := range tests {
+		got, err := QueueCfg{QIDs: test.in}.ToQIDs()
+		if (err != nil) != test.wantErr {
+			t.Errorf("ToQIDs(%q) err = %v, wantErr %v", test.in, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ToQIDs(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestNfqueueCfgValidate(t *testing.T) {
+	valid := func() NfqueueCfg {
+		return NfqueueCfg{QIDs: []int{0}, Policy: "accept", OnError: "accept"}
+	}
+	var tests = []struct {
+		name    string
+		modify  func(*NfqueueCfg)
+		wantErr bool
+	}{
+		{"valid", func(c *NfqueueCfg) {}, false},
+		{"all fields", func(c *NfqueueCfg) {
+			c.LocalNets = []string{"10.0.0.0/8"}
+			c.Groups = []string{"1:3"}
+			c.Queues = []QueueCfg{{QIDs: "4", Plugins: []string{"a", "b"}, Policy: "drop", Strategy: "most-restrictive"}}
+			c.Strategy = "first-match"
+			c.CopyMode = "meta"
+			c.OnTimeout = "drop"
+			c.OnFailure = "accept"
+			c.TraceNets = []string{"192.168.0.0/16"}
+			c.TracePorts = []int{53}
+			c.FlowsEnable, c.FlowsTimeout, c.TickSeconds = true, 60, 1
+		}, false},
+		{"only groups", func(c *NfqueueCfg) { c.QIDs, c.Groups = nil, []string{"0:1"} }, false},
+		{"only queues", func(c *NfqueueCfg) { c.QIDs, c.Queues = nil, []QueueCfg{{QIDs: "0"}} }, false},
+		{"no qids", func(c *NfqueueCfg) { c.QIDs = nil }, true},
+		{"bad localnet", func(c *NfqueueCfg) { c.LocalNets = []string{"10.0.0.1"} }, true},
+		{"missing plugin file", func(c *NfqueueCfg) { c.PluginFiles = []string{"/nonexistent/plugins.json"} }, true},
+		{"missing plugin dir", func(c *NfqueueCfg) { c.PluginDirs = []string{"/nonexistent"} }, true},
+		{"queues error", func(c *NfqueueCfg) { c.queuesErr = errors.New("decoding") }, true},
+		{"negative qid", func(c *NfqueueCfg) { c.QIDs = []int{-1} }, true},
+		{"repeated qid", func(c *NfqueueCfg) { c.QIDs = []int{1, 1} }, true},
+		{"bad group", func(c *NfqueueCfg) { c.Groups = []string{"3:1"} }, true},
+		{"qid repeated in group", func(c *NfqueueCfg) { c.Groups = []string{"0:2"} }, true},
+		{"qid repeated in queue", func(c *NfqueueCfg) { c.Queues = []QueueCfg{{QIDs: "0"}} }, true},
+		{"bad queue qids", func(c *NfqueueCfg) { c.Queues = []QueueCfg{{QIDs: "x"}} }, true},
+		{"empty plugin in queue", func(c *NfqueueCfg) { c.Queues = []QueueCfg{{QIDs: "1", Plugins: []string{""}}} }, true},
+		{"repeated plugin in queue", func(c *NfqueueCfg) { c.Queues = []QueueCfg{{QIDs: "1", Plugins: []string{"a", "a"}}} }, true},
+		{"bad queue policy", func(c *NfqueueCfg) { c.Queues = []QueueCfg{{QIDs: "1", Policy: "maybe"}} }, true},
+		{"bad queue onerror", func(c *NfqueueCfg) { c.Queues = []QueueCfg{{QIDs: "1", OnError: "maybe"}} }, true},
+		{"bad queue strategy", func(c *NfqueueCfg) { c.Queues = []QueueCfg{{QIDs: "1", Strategy: "random"}} }, true},
+		{"empty policy", func(c *NfqueueCfg) { c.Policy = "" }, true},
+		{"bad onerror", func(c *NfqueueCfg) { c.OnError = "maybe" }, true},
+		{"bad strategy", func(c *NfqueueCfg) { c.Strategy = "random" }, true},
+		{"negative tick", func(c *NfqueueCfg) { c.TickSeconds = -1 }, true},
+		{"negative queuelen", func(c *NfqueueCfg) { c.QueueLen = -1 }, true},
+		{"big copyrange", func(c *NfqueueCfg) { c.CopyRange = 0x10000 }, true},
+		{"bad copymode", func(c *NfqueueCfg) { c.CopyMode = "all" }, true},
+		{"negative workers", func(c *NfqueueCfg) { c.Workers = -1 }, true},
+		{"negative timeout", func(c *NfqueueCfg) { c.TimeoutMSecs = -1 }, true},
+		{"bad ontimeout", func(c *NfqueueCfg) { c.OnTimeout = "maybe" }, true},
+		{"negative backoff", func(c *NfqueueCfg) { c.BackoffSecs = -1 }, true},
+		{"negative maxbackoff", func(c *NfqueueCfg) { c.MaxBackoffSecs = -1 }, true},
+		{"bad onfailure", func(c *NfqueueCfg) { c.OnFailure = "maybe" }, true},
+		{"bad trace net", func(c *NfqueueCfg) { c.TraceNets = []string{"bad"} }, true},
+		{"bad trace port", func(c *NfqueueCfg) { c.TracePorts = []int{70000} }, true},
+		{"flows without timeout", func(c *NfqueueCfg) { c.FlowsEnable, c.TickSeconds = true, 1 }, true},
+		{"flows negative max", func(c *NfqueueCfg) { c.FlowsEnable, c.FlowsTimeout, c.FlowsMax, c.TickSeconds = true, 60, -1, 1 }, true},
+		{"flows without tick", func(c *NfqueueCfg) { c.FlowsEnable, c.FlowsTimeout = true, 60 }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := valid()
+			test.modify(&cfg)
+			err := cfg.Validate()
+			if (err != nil) != test.wantErr {
+				t.Errorf("Validate() err = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
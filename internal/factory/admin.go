@@ -0,0 +1,61 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package factory
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/luids-io/common/util"
+	"github.com/luids-io/core/ipfilter"
+	"github.com/luids-io/core/yalogi"
+	iconfig "github.com/luids-io/netfilter/internal/config"
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+	"github.com/luids-io/netfilter/pkg/nfqueue/admin"
+)
+
+// Admin creates the http server of the admin api
+func Admin(cfg *iconfig.AdminCfg, svc *nfqueue.PacketService, plugins admin.Plugins, switches *nfqueue.Switches, tracer *nfqueue.Tracer, logger yalogi.Logger) (net.Listener, *http.Server, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid admin config: %v", err)
+	}
+	if len(cfg.Allowed) == 0 && !isLocal(cfg.ListenURI) {
+		return nil, nil, errors.New("admin api requires allowed ips if it doesn't listen on loopback")
+	}
+	alis, err := util.Listener(cfg.ListenURI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listening admin: %v", err)
+	}
+	api := admin.New(svc, plugins, switches, tracer, logger)
+	var handler http.Handler = api
+	filter := ipfilter.Whitelist(cfg.Allowed)
+	if !filter.Empty() {
+		filter.Wrapped = api
+		handler = filter
+	}
+	return alis, &http.Server{Handler: handler}, nil
+}
+
+// isLocal returns true if the listen uri is an unix socket or a loopback
+// address
+func isLocal(uri string) bool {
+	proto, addr, err := util.ParseListenURI(uri)
+	if err != nil {
+		return false
+	}
+	if proto == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package factory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/luids-io/core/yalogi"
+	iconfig "github.com/luids-io/netfilter/internal/config"
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+	"github.com/luids-io/netfilter/pkg/nfqueue/nfqueuetest"
+)
+
+func TestIsLocal(t *testing.T) {
+	var tests = []struct {
+		uri  string
+		want bool
+	}{
+		{"unix:///var/run/lunfqueue-admin.sock", true},
+		{"tcp://127.0.0.1:8080", true},
+		{"tcp://127.0.0.2:8080", true},
+		{"tcp://localhost:8080", true},
+		{"tcp://[::1]:8080", true},
+		{"tcp://0.0.0.0:8080", false},
+		{"tcp://:8080", false},
+		{"tcp://192.168.1.1:8080", false},
+		{"tcp://[2001:db8::1]:8080", false},
+		{"tcp://127.0.0.1", false},
+		{"127.0.0.1:8080", false},
+	}
+	for _, test := range tests {
+		if got := isLocal(test.uri); got != test.want {
+			t.Errorf("isLocal(%q) = %v, want %v", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	svc := nfqueue.NewService(nfqueue.NewProcessor(nfqueue.Config{Netlink: nfqueuetest.New().Open}, yalogi.LogNull), nil)
+	var tests = []struct {
+		name    string
+		cfg     iconfig.AdminCfg
+		wantErr bool
+	}{
+		{"loopback", iconfig.AdminCfg{ListenURI: "tcp://127.0.0.1:0"}, false},
+		{"allowed", iconfig.AdminCfg{ListenURI: "tcp://0.0.0.0:0", Allowed: []string{"10.0.0.0/8"}}, false},
+		{"not allowed", iconfig.AdminCfg{ListenURI: "tcp://0.0.0.0:0"}, true},
+		{"invalid", iconfig.AdminCfg{ListenURI: "127.0.0.1:0"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lis, srv, err := Admin(&test.cfg, svc, nil, nil, nil, yalogi.LogNull)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Admin() err = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			lis.Close()
+			if srv.Handler == nil {
+				t.Error("Admin() handler is nil")
+			}
+		})
+	}
+}
+
+func TestAdminAllowed(t *testing.T) {
+	svc := nfqueue.NewService(nfqueue.NewProcessor(nfqueue.Config{Netlink: nfqueuetest.New().Open}, yalogi.LogNull), nil)
+	cfg := iconfig.AdminCfg{ListenURI: "tcp://0.0.0.0:0", Allowed: []string{"10.0.0.0/8", "192.168.1.1"}}
+	lis, srv, err := Admin(&cfg, svc, nil, nil, nil, yalogi.LogNull)
+	if err != nil {
+		t.Fatalf("Admin() err = %v", err)
+	}
+	lis.Close()
+	var tests = []struct {
+		remote string
+		code   int
+	}{
+		{"10.1.2.3:1234", http.StatusOK},
+		{"192.168.1.1:1234", http.StatusOK},
+		{"192.168.1.2:1234", http.StatusForbidden},
+		{"127.0.0.1:1234", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/queues", nil)
+		req.RemoteAddr = test.remote
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("GET /queues from %s = %v, want %v", test.remote, rec.Code, test.code)
+		}
+	}
+}
@@ -20,7 +20,7 @@ func PacketProcBuilder(cfg *iconfig.NfqueueCfg, regsvc apiservice.Discover, logg
 		return nil, err
 	}
 	//create the builder
-	b := builder.New(regsvc, builder.SetLogger(logger))
+	b := builder.New(regsvc, builder.SetLogger(logger), builder.Conntrack(cfg.Conntrack))
 	//set localnets
 	for _, lnet := range cfg.LocalNets {
 		b.AddLocalNet(lnet)
@@ -0,0 +1,48 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package factory
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/luids-io/common/util"
+	"github.com/luids-io/core/ipfilter"
+	"github.com/luids-io/core/yalogi"
+	iconfig "github.com/luids-io/netfilter/internal/config"
+	"github.com/luids-io/netfilter/pkg/nfqueue/metrics"
+)
+
+// Metrics creates the http server exposing the metrics of the collector
+func Metrics(cfg *iconfig.MetricsCfg, collector *metrics.Collector, logger yalogi.Logger) (net.Listener, *http.Server, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid metrics config: %v", err)
+	}
+	registry := prometheus.NewRegistry()
+	err = registry.Register(collector)
+	if err != nil {
+		return nil, nil, fmt.Errorf("registering metrics: %v", err)
+	}
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	mlis, err := util.Listener(cfg.ListenURI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listening metrics: %v", err)
+	}
+	router := mux.NewRouter()
+	router.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	var handler http.Handler = router
+	filter := ipfilter.Whitelist(cfg.Allowed)
+	if !filter.Empty() {
+		filter.Wrapped = router
+		handler = filter
+	}
+	return mlis, &http.Server{Handler: handler}, nil
+}
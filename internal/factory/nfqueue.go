@@ -4,6 +4,10 @@ package factory
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/luids-io/core/yalogi"
@@ -12,30 +16,210 @@ import (
 	"github.com/luids-io/netfilter/pkg/nfqueue/builder"
 )
 
-// NfqueueProc creates a new nfqueue processor
-func NfqueueProc(cfg *iconfig.NfqueueCfg, logger yalogi.Logger) (nfqueue.PacketProcessor, error) {
-	err := cfg.Validate()
+// NfqueueProc creates a new nfqueue processor, collector, switches and
+// tracer can be nil
+func NfqueueProc(cfg *iconfig.NfqueueCfg, collector nfqueue.Collector, switches *nfqueue.Switches, tracer *nfqueue.Tracer, logger yalogi.Logger) (nfqueue.PacketProcessor, error) {
+	nfqcfg, err := NfqueueConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	nfqcfg.Collector = collector
+	nfqcfg.Switches = switches
+	nfqcfg.Tracer = tracer
+	return nfqueue.NewProcessor(nfqcfg, logger), nil
+}
+
+// NfqueueReplay creates a new processor replaying the capture file,
+// switches and tracer can be nil
+func NfqueueReplay(cfg *iconfig.NfqueueCfg, fname string, switches *nfqueue.Switches, tracer *nfqueue.Tracer, logger yalogi.Logger) (*nfqueue.Replay, error) {
+	nfqcfg, err := NfqueueConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
+	nfqcfg.Switches = switches
+	nfqcfg.Tracer = tracer
+	return nfqueue.NewReplay(fname, nfqcfg, logger), nil
+}
+
+// NfqueueTracer creates the tracer of packets, it's enabled if configured.
+// Returned closer is not nil if traces are written to a file.
+func NfqueueTracer(cfg *iconfig.NfqueueCfg, logger yalogi.Logger) (*nfqueue.Tracer, io.Closer, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	filter, err := nfqueue.ToTraceFilter(cfg.TraceNets, cfg.TracePorts)
+	if err != nil {
+		return nil, nil, err
+	}
+	var closer io.Closer
+	emit := nfqueue.LogTraces(logger)
+	if cfg.TraceOutput != "" {
+		f, err := os.OpenFile(cfg.TraceOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening trace output: %v", err)
+		}
+		closer, emit = f, nfqueue.JSONTraces(f)
+	}
+	tracer := nfqueue.NewTracer(emit)
+	if cfg.TraceEnable {
+		tracer.Enable(filter)
+	}
+	return tracer, closer, nil
+}
+
+// NfqueueConfig returns the configuration for nfqueue processors
+func NfqueueConfig(cfg *iconfig.NfqueueCfg) (nfqueue.Config, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nfqueue.Config{}, err
+	}
 	oerror, err := nfqueue.ToVerdict(cfg.OnError)
 	if err != nil || oerror == nfqueue.Default {
-		return nil, errors.New("invalid verdict value")
+		return nfqueue.Config{}, errors.New("invalid verdict value")
 	}
 	policy, err := nfqueue.ToVerdict(cfg.Policy)
 	if err != nil || policy == nfqueue.Default {
-		return nil, errors.New("invalid verdict value")
+		return nfqueue.Config{}, errors.New("invalid verdict value")
+	}
+	otimeout, err := nfqueue.ToVerdict(cfg.OnTimeout)
+	if err != nil {
+		return nfqueue.Config{}, errors.New("invalid verdict value")
 	}
 	tick := time.Duration(cfg.TickSeconds) * time.Second
-	nfqcfg := nfqueue.Config{
-		Tick:    tick,
-		OnError: oerror,
-		Policy:  policy,
+	var flows *nfqueue.FlowTable
+	if cfg.FlowsEnable {
+		flows = nfqueue.NewFlowTable(time.Duration(cfg.FlowsTimeout)*time.Second, cfg.FlowsMax)
 	}
+	return nfqueue.Config{
+		Tick:      tick,
+		OnError:   oerror,
+		Policy:    policy,
+		QueueLen:  uint32(cfg.QueueLen),
+		CopyRange: uint32(cfg.CopyRange),
+		CopyMeta:  cfg.CopyMode == "meta",
+		FailOpen:  cfg.FailOpen,
+		GSO:       cfg.GSO,
+		Conntrack: cfg.Conntrack,
+		Workers:   cfg.Workers,
+		Timeout:   time.Duration(cfg.TimeoutMSecs) * time.Millisecond,
+		OnTimeout: otimeout,
+		Flows:     flows,
+	}, nil
+}
+
+// NfqueueSvc creates a new packet sniffer service, collector can be nil
+func NfqueueSvc(cfg *iconfig.NfqueueCfg, proc nfqueue.PacketProcessor, b *builder.Builder, collector nfqueue.Collector, logger yalogi.Logger) (*nfqueue.PacketService, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	backoff := time.Duration(cfg.BackoffSecs) * time.Second
+	maxBackoff := time.Duration(cfg.MaxBackoffSecs) * time.Second
+	opts := []nfqueue.Option{nfqueue.SetLogger(logger), nfqueue.SetRestart(backoff, maxBackoff)}
+	if cfg.OnFailure != "" {
+		bypass, err := NfqueueBypass(cfg, collector, logger)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nfqueue.SetBypass(bypass))
+	}
+	return nfqueue.NewService(proc, b.Plugins(), opts...), nil
+}
+
+// NfqueueBypass creates a processor that applies the onfailure verdict to
+// all packets copying only metadata
+func NfqueueBypass(cfg *iconfig.NfqueueCfg, collector nfqueue.Collector, logger yalogi.Logger) (nfqueue.PacketProcessor, error) {
+	nfqcfg, err := NfqueueConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	onfailure, err := nfqueue.ToVerdict(cfg.OnFailure)
+	if err != nil || onfailure == nfqueue.Default {
+		return nil, errors.New("invalid verdict value")
+	}
+	nfqcfg.Policy = onfailure
+	nfqcfg.CopyMeta = true
+	nfqcfg.Tick = 0
+	nfqcfg.Workers = 0
+	nfqcfg.Timeout = 0
+	nfqcfg.Flows = nil
+	nfqcfg.Collector = collector
 	return nfqueue.NewProcessor(nfqcfg, logger), nil
 }
 
-// NfqueueSvc creates a new packet sniffer service
-func NfqueueSvc(proc nfqueue.PacketProcessor, b *builder.Builder, logger yalogi.Logger) (*nfqueue.PacketService, error) {
-	return nfqueue.NewService(proc, b.Plugins(), nfqueue.SetLogger(logger)), nil
+// NfqueueGroup defines a group of queues registered in the service
+type NfqueueGroup struct {
+	Name   string
+	QIDs   []int
+	Config nfqueue.GroupConfig
+}
+
+// NfqueueGroups returns the groups of queues defined in the configuration,
+// the chains of plugins are checked against the plugins of the builder
+func NfqueueGroups(cfg *iconfig.NfqueueCfg, b *builder.Builder) ([]NfqueueGroup, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := nfqueue.ToStrategy(cfg.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]NfqueueGroup, 0, len(cfg.QIDs)+len(cfg.Groups)+len(cfg.Queues))
+	for _, qid := range cfg.QIDs {
+		groups = append(groups, NfqueueGroup{
+			Name:   strconv.Itoa(qid),
+			QIDs:   []int{qid},
+			Config: nfqueue.GroupConfig{Strategy: strategy},
+		})
+	}
+	for _, s := range cfg.Groups {
+		qids, err := iconfig.ToQIDGroup(s)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, NfqueueGroup{
+			Name:   s,
+			QIDs:   qids,
+			Config: nfqueue.GroupConfig{Strategy: strategy},
+		})
+	}
+	for _, q := range cfg.Queues {
+		qids, err := q.ToQIDs()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range q.Plugins {
+			if _, ok := b.Plugin(name); !ok {
+				return nil, fmt.Errorf("plugin '%s' in queue '%s' not found", name, q.QIDs)
+			}
+		}
+		policy, err := nfqueue.ToVerdict(q.Policy)
+		if err != nil {
+			return nil, errors.New("invalid verdict value")
+		}
+		onerror, err := nfqueue.ToVerdict(q.OnError)
+		if err != nil {
+			return nil, errors.New("invalid verdict value")
+		}
+		qstrategy := strategy
+		if q.Strategy != "" {
+			qstrategy, err = nfqueue.ToStrategy(q.Strategy)
+			if err != nil {
+				return nil, err
+			}
+		}
+		groups = append(groups, NfqueueGroup{
+			Name: q.QIDs,
+			QIDs: qids,
+			Config: nfqueue.GroupConfig{
+				Plugins:  q.Plugins,
+				Policy:   policy,
+				OnError:  onerror,
+				Strategy: qstrategy,
+			},
+		})
+	}
+	return groups, nil
 }
@@ -0,0 +1,545 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+// Package admin implements an http api for managing the packet processing
+// at runtime.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/luids-io/core/yalogi"
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+	"github.com/luids-io/netfilter/pkg/nfqueue/builder"
+)
+
+// Plugins provides the running plugins and reloads them from definitions
+type Plugins interface {
+	Builder() *builder.Builder
+	Reload() error
+}
+
+// API implements http.Handler
+type API struct {
+	svc      *nfqueue.PacketService
+	plugins  Plugins
+	switches *nfqueue.Switches
+	tracer   *nfqueue.Tracer
+	logger   yalogi.Logger
+	router   *mux.Router
+}
+
+// New returns a new admin api, switches and tracer must be the same used by
+// the packet processor
+func New(svc *nfqueue.PacketService, plugins Plugins, switches *nfqueue.Switches, tracer *nfqueue.Tracer, logger yalogi.Logger) *API {
+	a := &API{
+		svc:      svc,
+		plugins:  plugins,
+		switches: switches,
+		tracer:   tracer,
+		logger:   logger,
+		router:   mux.NewRouter(),
+	}
+	a.router.HandleFunc("/queues", a.listQueues).Methods(http.MethodGet)
+	a.router.HandleFunc("/queues", a.registerQueue).Methods(http.MethodPost)
+	a.router.HandleFunc("/queues/{qid:[0-9]+}", a.unregisterQueue).Methods(http.MethodDelete)
+	a.router.HandleFunc("/groups", a.listGroups).Methods(http.MethodGet)
+	a.router.HandleFunc("/groups", a.registerGroup).Methods(http.MethodPost)
+	a.router.HandleFunc("/groups/{name}", a.unregisterGroup).Methods(http.MethodDelete)
+	a.router.HandleFunc("/plugins", a.listPlugins).Methods(http.MethodGet)
+	a.router.HandleFunc("/plugins/{plugin}/{state:enable|disable}", a.switchPlugin).Methods(http.MethodPut)
+	a.router.HandleFunc("/plugins/{plugin}/actions/{action}/{state:enable|disable}", a.switchAction).Methods(http.MethodPut)
+	a.router.HandleFunc("/plugins/{plugin}/monitor/{state:on|off}", a.monitorPlugin).Methods(http.MethodPut)
+	a.router.HandleFunc("/plugins/{plugin}/actions/{action}/monitor/{state:on|off}", a.monitorAction).Methods(http.MethodPut)
+	a.router.HandleFunc("/monitor", a.getMonitor).Methods(http.MethodGet)
+	a.router.HandleFunc("/monitor/{state:on|off}", a.monitorAll).Methods(http.MethodPut)
+	a.router.HandleFunc("/trace", a.getTrace).Methods(http.MethodGet)
+	a.router.HandleFunc("/trace", a.enableTrace).Methods(http.MethodPut)
+	a.router.HandleFunc("/trace", a.disableTrace).Methods(http.MethodDelete)
+	a.router.HandleFunc("/stats", a.stats).Methods(http.MethodGet)
+	a.router.HandleFunc("/reload", a.reload).Methods(http.MethodPost)
+	return a
+}
+
+// ServeHTTP implements http.Handler
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.router.ServeHTTP(w, r)
+}
+
+type statsResponse struct {
+	Packets    uint64     `json:"packets"`
+	Timeouts   uint64     `json:"timeouts"`
+	LastPacket *time.Time `json:"lastPacket,omitempty"`
+	State      string     `json:"state"`
+}
+
+func toStatsResponse(st nfqueue.Stats) statsResponse {
+	r := statsResponse{Packets: st.Packets, Timeouts: st.Timeouts, State: st.State.String()}
+	if !st.LastPacket.IsZero() {
+		last := st.LastPacket
+		r.LastPacket = &last
+	}
+	return r
+}
+
+type queueResponse struct {
+	QID         int           `json:"qid"`
+	Group       string        `json:"group"`
+	Running     bool          `json:"running"`
+	Started     *time.Time    `json:"started,omitempty"`
+	Stats       statsResponse `json:"stats"`
+	LastError   string        `json:"lastError,omitempty"`
+	LastErrorAt *time.Time    `json:"lastErrorAt,omitempty"`
+	Restarts    int           `json:"restarts"`
+	Bypass      bool          `json:"bypass"`
+	Plugins     []string      `json:"plugins"`
+}
+
+func toQueueResponse(q nfqueue.QueueStatus) queueResponse {
+	qr := queueResponse{
+		QID:       q.QID,
+		Group:     q.Group,
+		Running:   q.Running,
+		Stats:     toStatsResponse(q.Stats),
+		LastError: q.LastError,
+		Restarts:  q.Restarts,
+		Bypass:    q.Bypass,
+		Plugins:   q.Plugins,
+	}
+	if !q.Started.IsZero() {
+		started := q.Started
+		qr.Started = &started
+	}
+	if !q.LastErrorAt.IsZero() {
+		lastErrAt := q.LastErrorAt
+		qr.LastErrorAt = &lastErrAt
+	}
+	return qr
+}
+
+func (a *API) listQueues(w http.ResponseWriter, r *http.Request) {
+	queues := a.svc.Queues()
+	resp := make([]queueResponse, 0, len(queues))
+	for _, q := range queues {
+		resp = append(resp, toQueueResponse(q))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type queueRequest struct {
+	QID      *int     `json:"qid"`
+	Plugins  []string `json:"plugins"`
+	Policy   string   `json:"policy"`
+	OnError  string   `json:"onerror"`
+	Strategy string   `json:"strategy"`
+}
+
+// registerQueue registers a group with only one queue named by the qid
+func (a *API) registerQueue(w http.ResponseWriter, r *http.Request) {
+	var req queueRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %v", err))
+		return
+	}
+	if req.QID == nil {
+		writeError(w, http.StatusBadRequest, errors.New("qid is required"))
+		return
+	}
+	qid := *req.QID
+	if qid < 0 || qid > 0xFFFF {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid qid %v value", qid))
+		return
+	}
+	cfg, err := toGroupConfig(req.Plugins, req.Policy, req.OnError, req.Strategy)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.logger.Infof("admin: registering nfqueue %v", qid)
+	err = a.svc.RegisterGroupWith(strconv.Itoa(qid), []int{qid}, cfg)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	q, _ := a.svc.Queue(qid)
+	writeJSON(w, http.StatusCreated, toQueueResponse(q))
+}
+
+func (a *API) unregisterQueue(w http.ResponseWriter, r *http.Request) {
+	qid, err := strconv.Atoi(mux.Vars(r)["qid"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid qid: %v", err))
+		return
+	}
+	if _, ok := a.svc.Queue(qid); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("nfqueue %v not found", qid))
+		return
+	}
+	a.logger.Infof("admin: unregistering nfqueue %v", qid)
+	err = a.svc.Unregister(qid)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type groupResponse struct {
+	Name    string        `json:"name"`
+	QIDs    []int         `json:"qids"`
+	Running bool          `json:"running"`
+	Stats   statsResponse `json:"stats"`
+}
+
+func (a *API) listGroups(w http.ResponseWriter, r *http.Request) {
+	groups := a.svc.Groups()
+	resp := make([]groupResponse, 0, len(groups))
+	for _, g := range groups {
+		resp = append(resp, groupResponse{
+			Name:    g.Name,
+			QIDs:    g.QIDs,
+			Running: g.Running,
+			Stats:   toStatsResponse(g.Stats),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type groupRequest struct {
+	// Name of the group, it's the qid if empty and there is only one
+	Name     string   `json:"name"`
+	QIDs     []int    `json:"qids"`
+	Plugins  []string `json:"plugins"`
+	Policy   string   `json:"policy"`
+	OnError  string   `json:"onerror"`
+	Strategy string   `json:"strategy"`
+}
+
+func (a *API) registerGroup(w http.ResponseWriter, r *http.Request) {
+	var req groupRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %v", err))
+		return
+	}
+	if req.Name == "" {
+		if len(req.QIDs) != 1 {
+			writeError(w, http.StatusBadRequest, errors.New("name is required"))
+			return
+		}
+		req.Name = strconv.Itoa(req.QIDs[0])
+	}
+	for _, qid := range req.QIDs {
+		if qid < 0 || qid > 0xFFFF {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid qid %v value", qid))
+			return
+		}
+	}
+	cfg, err := toGroupConfig(req.Plugins, req.Policy, req.OnError, req.Strategy)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.logger.Infof("admin: registering nfqueue group %s %v", req.Name, req.QIDs)
+	err = a.svc.RegisterGroupWith(req.Name, req.QIDs, cfg)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	g, _ := a.svc.Group(req.Name)
+	writeJSON(w, http.StatusCreated, groupResponse{
+		Name:    g.Name,
+		QIDs:    g.QIDs,
+		Running: g.Running,
+		Stats:   toStatsResponse(g.Stats),
+	})
+}
+
+// toGroupConfig returns the configuration of a group from the request
+func toGroupConfig(plugins []string, policy, onError, strategy string) (nfqueue.GroupConfig, error) {
+	var err error
+	cfg := nfqueue.GroupConfig{Plugins: plugins}
+	cfg.Policy, err = nfqueue.ToVerdict(policy)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid policy: %v", err)
+	}
+	cfg.OnError, err = nfqueue.ToVerdict(onError)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid onerror: %v", err)
+	}
+	cfg.Strategy, err = nfqueue.ToStrategy(strategy)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func (a *API) unregisterGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, ok := a.svc.Group(name); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("group %s not found", name))
+		return
+	}
+	a.logger.Infof("admin: unregistering nfqueue group %s", name)
+	err := a.svc.UnregisterGroup(name)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type pluginResponse struct {
+	Name     string           `json:"name"`
+	Class    string           `json:"class"`
+	Priority int              `json:"priority"`
+	Enabled  bool             `json:"enabled"`
+	Monitor  bool             `json:"monitor"`
+	Actions  []actionResponse `json:"actions"`
+}
+
+type actionResponse struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Monitor bool   `json:"monitor"`
+}
+
+func (a *API) listPlugins(w http.ResponseWriter, r *http.Request) {
+	b := a.plugins.Builder()
+	actions := b.Actions()
+	plugins := b.Plugins()
+	resp := make([]pluginResponse, 0, len(plugins))
+	for _, p := range plugins {
+		pr := pluginResponse{
+			Name:    p.Name(),
+			Class:   p.Class(),
+			Enabled: a.switches.Enabled(p.Name()),
+			Monitor: a.switches.Monitor(p.Name()),
+			Actions: make([]actionResponse, 0),
+		}
+		if pp, ok := p.(nfqueue.Prioritized); ok {
+			pr.Priority = pp.Priority()
+		}
+		prefix := nfqueue.ActionName(p.Name(), "")
+		for _, name := range actions {
+			if strings.HasPrefix(name, prefix) {
+				pr.Actions = append(pr.Actions, actionResponse{
+					Name:    strings.TrimPrefix(name, prefix),
+					Enabled: a.switches.Enabled(name),
+					Monitor: a.switches.Monitor(name),
+				})
+			}
+		}
+		resp = append(resp, pr)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *API) switchPlugin(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.pluginName(w, r)
+	if ok {
+		a.doSwitch(w, name, mux.Vars(r)["state"])
+	}
+}
+
+func (a *API) switchAction(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.actionName(w, r)
+	if ok {
+		a.doSwitch(w, name, mux.Vars(r)["state"])
+	}
+}
+
+func (a *API) monitorPlugin(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.pluginName(w, r)
+	if ok {
+		a.doMonitor(w, name, mux.Vars(r)["state"])
+	}
+}
+
+func (a *API) monitorAction(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.actionName(w, r)
+	if ok {
+		a.doMonitor(w, name, mux.Vars(r)["state"])
+	}
+}
+
+// pluginName returns the name of the plugin in the request if it exists
+func (a *API) pluginName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := mux.Vars(r)["plugin"]
+	if _, ok := a.plugins.Builder().Plugin(name); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("plugin '%s' not found", name))
+		return "", false
+	}
+	return name, true
+}
+
+// actionName returns the name of the action in the request if it exists
+func (a *API) actionName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	vars := mux.Vars(r)
+	name := nfqueue.ActionName(vars["plugin"], vars["action"])
+	for _, action := range a.plugins.Builder().Actions() {
+		if action == name {
+			return name, true
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("action '%s' not found", name))
+	return "", false
+}
+
+func (a *API) doSwitch(w http.ResponseWriter, name, state string) {
+	if a.switches == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("switches not available"))
+		return
+	}
+	a.logger.Infof("admin: %s '%s'", state, name)
+	if state == "enable" {
+		a.switches.Enable(name)
+	} else {
+		a.switches.Disable(name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) doMonitor(w http.ResponseWriter, name, state string) {
+	if a.switches == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("switches not available"))
+		return
+	}
+	a.logger.Infof("admin: monitor %s '%s'", state, name)
+	a.switches.SetMonitor(name, state == "on")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type monitorResponse struct {
+	All       bool     `json:"all"`
+	Monitored []string `json:"monitored"`
+}
+
+func (a *API) getMonitor(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, monitorResponse{
+		All:       a.switches.MonitorAll(),
+		Monitored: a.switches.Monitored(),
+	})
+}
+
+func (a *API) monitorAll(w http.ResponseWriter, r *http.Request) {
+	if a.switches == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("switches not available"))
+		return
+	}
+	state := mux.Vars(r)["state"]
+	a.logger.Infof("admin: global monitor %s", state)
+	a.switches.SetMonitorAll(state == "on")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type traceFilter struct {
+	Nets  []string `json:"nets"`
+	Ports []int    `json:"ports"`
+}
+
+type traceResponse struct {
+	Enabled bool `json:"enabled"`
+	traceFilter
+}
+
+func (a *API) getTrace(w http.ResponseWriter, r *http.Request) {
+	enabled, filter := a.tracer.Status()
+	resp := traceResponse{
+		Enabled: enabled,
+		traceFilter: traceFilter{
+			Nets:  make([]string, 0, len(filter.Nets)),
+			Ports: make([]int, 0, len(filter.Ports)),
+		},
+	}
+	for _, n := range filter.Nets {
+		resp.Nets = append(resp.Nets, n.String())
+	}
+	for _, p := range filter.Ports {
+		resp.Ports = append(resp.Ports, int(p))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *API) enableTrace(w http.ResponseWriter, r *http.Request) {
+	if a.tracer == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("tracer not available"))
+		return
+	}
+	var req traceFilter
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %v", err))
+			return
+		}
+	}
+	filter, err := nfqueue.ToTraceFilter(req.Nets, req.Ports)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.logger.Infof("admin: enabling trace nets=%v ports=%v", req.Nets, req.Ports)
+	a.tracer.Enable(filter)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) disableTrace(w http.ResponseWriter, r *http.Request) {
+	if a.tracer == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("tracer not available"))
+		return
+	}
+	a.logger.Infof("admin: disabling trace")
+	a.tracer.Disable()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type serviceStatsResponse struct {
+	Total  statsResponse            `json:"total"`
+	Queues map[string]statsResponse `json:"queues"`
+}
+
+func (a *API) stats(w http.ResponseWriter, r *http.Request) {
+	queues := a.svc.Queues()
+	resp := serviceStatsResponse{Queues: make(map[string]statsResponse, len(queues))}
+	var total nfqueue.Stats
+	for _, q := range queues {
+		total = total.Add(q.Stats)
+		resp.Queues[strconv.Itoa(q.QID)] = toStatsResponse(q.Stats)
+	}
+	resp.Total = toStatsResponse(total)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (a *API) reload(w http.ResponseWriter, r *http.Request) {
+	a.logger.Infof("admin: reloading plugin definitions")
+	err := a.plugins.Reload()
+	if err != nil {
+		a.logger.Warnf("admin: reloading plugin definitions: %v", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
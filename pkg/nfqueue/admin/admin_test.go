@@ -0,0 +1,271 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/luids-io/core/yalogi"
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+	"github.com/luids-io/netfilter/pkg/nfqueue/admin"
+	"github.com/luids-io/netfilter/pkg/nfqueue/builder"
+	"github.com/luids-io/netfilter/pkg/nfqueue/nfqueuetest"
+)
+
+const testClass = "admintest"
+
+type testPlugin struct {
+	name string
+}
+
+func (p testPlugin) Name() string                 { return p.name }
+func (p testPlugin) Class() string                { return testClass }
+func (p testPlugin) Register(h *nfqueue.Hooks)    {}
+func (p testPlugin) Layers() []gopacket.LayerType { return []gopacket.LayerType{layers.LayerTypeIPv4} }
+func (p testPlugin) CleanUp()                     {}
+
+func init() {
+	builder.RegisterPluginBuilder(testClass, func(b *builder.Builder, def builder.PluginDef) (nfqueue.Plugin, error) {
+		for _, adef := range def.Actions {
+			if _, err := b.BuildAction(def.Name, def.Class, adef); err != nil {
+				return nil, err
+			}
+		}
+		return testPlugin{name: def.Name}, nil
+	})
+	builder.RegisterActionBuilder(testClass, "test", func(b *builder.Builder, pname string, def builder.ActionDef) (nfqueue.Action, error) {
+		return nil, nil
+	})
+}
+
+// testPlugins implements admin.Plugins
+type testPlugins struct {
+	b         *builder.Builder
+	reloadErr error
+	reloads   int
+}
+
+func (p *testPlugins) Builder() *builder.Builder { return p.b }
+
+func (p *testPlugins) Reload() error {
+	p.reloads++
+	return p.reloadErr
+}
+
+type testAPI struct {
+	api      *admin.API
+	svc      *nfqueue.PacketService
+	plugins  *testPlugins
+	switches *nfqueue.Switches
+	tracer   *nfqueue.Tracer
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	b := builder.New(nil)
+	_, err := b.BuildPlugin(builder.PluginDef{
+		Name:    "p1",
+		Class:   testClass,
+		Actions: []builder.ActionDef{{Name: "a1", Class: "test"}},
+	})
+	if err != nil {
+		t.Fatalf("building plugin: %v", err)
+	}
+	nl := nfqueuetest.New()
+	cfg := nfqueue.Config{Policy: nfqueue.Accept, OnError: nfqueue.Accept, Netlink: nl.Open}
+	svc := nfqueue.NewService(nfqueue.NewProcessor(cfg, yalogi.LogNull), b.Plugins())
+	if err := svc.Register(1); err != nil {
+		t.Fatalf("registering queue: %v", err)
+	}
+	if err := svc.Start(); err != nil {
+		t.Fatalf("starting service: %v", err)
+	}
+	ta := &testAPI{
+		svc:      svc,
+		plugins:  &testPlugins{b: b},
+		switches: nfqueue.NewSwitches(),
+		tracer:   nfqueue.NewTracer(func(*nfqueue.Trace) {}),
+	}
+	ta.api = admin.New(svc, ta.plugins, ta.switches, ta.tracer, yalogi.LogNull)
+	return ta
+}
+
+func (ta *testAPI) do(method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body == "" {
+		req.ContentLength = 0
+	}
+	rec := httptest.NewRecorder()
+	ta.api.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIStatus(t *testing.T) {
+	var tests = []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodGet, "/queues", "", http.StatusOK},
+		{http.MethodPost, "/queues", `{"qid": 2}`, http.StatusCreated},
+		{http.MethodPost, "/queues", `{"qid": 3, "plugins": ["p1"], "policy": "drop", "strategy": "most-restrictive"}`, http.StatusCreated},
+		{http.MethodPost, "/queues", `{"qid": 1}`, http.StatusBadRequest},
+		{http.MethodPost, "/queues", `{}`, http.StatusBadRequest},
+		{http.MethodPost, "/queues", `{"qid": 70000}`, http.StatusBadRequest},
+		{http.MethodPost, "/queues", `{"qid": 4, "plugins": ["unknown"]}`, http.StatusBadRequest},
+		{http.MethodPost, "/queues", `{"qid": 4, "policy": "maybe"}`, http.StatusBadRequest},
+		{http.MethodPost, "/queues", `not json`, http.StatusBadRequest},
+		{http.MethodDelete, "/queues/1", "", http.StatusNoContent},
+		{http.MethodDelete, "/queues/9", "", http.StatusNotFound},
+		{http.MethodGet, "/groups", "", http.StatusOK},
+		{http.MethodPost, "/groups", `{"name": "g1", "qids": [10, 11]}`, http.StatusCreated},
+		{http.MethodPost, "/groups", `{"qids": [12]}`, http.StatusCreated},
+		{http.MethodPost, "/groups", `{"qids": [13, 14]}`, http.StatusBadRequest},
+		{http.MethodPost, "/groups", `{"name": "g2", "qids": [10]}`, http.StatusBadRequest},
+		{http.MethodPost, "/groups", `{"name": "g3", "qids": [15], "strategy": "random"}`, http.StatusBadRequest},
+		{http.MethodDelete, "/groups/g1", "", http.StatusNoContent},
+		{http.MethodDelete, "/groups/g1", "", http.StatusNotFound},
+		{http.MethodGet, "/plugins", "", http.StatusOK},
+		{http.MethodPut, "/plugins/p1/disable", "", http.StatusNoContent},
+		{http.MethodPut, "/plugins/p1/enable", "", http.StatusNoContent},
+		{http.MethodPut, "/plugins/unknown/enable", "", http.StatusNotFound},
+		{http.MethodPut, "/plugins/p1/actions/a1/disable", "", http.StatusNoContent},
+		{http.MethodPut, "/plugins/p1/actions/unknown/disable", "", http.StatusNotFound},
+		{http.MethodPut, "/plugins/p1/monitor/on", "", http.StatusNoContent},
+		{http.MethodPut, "/plugins/p1/actions/a1/monitor/off", "", http.StatusNoContent},
+		{http.MethodGet, "/monitor", "", http.StatusOK},
+		{http.MethodPut, "/monitor/on", "", http.StatusNoContent},
+		{http.MethodPut, "/monitor/maybe", "", http.StatusNotFound},
+		{http.MethodGet, "/trace", "", http.StatusOK},
+		{http.MethodPut, "/trace", "", http.StatusNoContent},
+		{http.MethodPut, "/trace", `{"nets": ["10.0.0.0/8"], "ports": [53]}`, http.StatusNoContent},
+		{http.MethodPut, "/trace", `{"nets": ["bad"]}`, http.StatusBadRequest},
+		{http.MethodDelete, "/trace", "", http.StatusNoContent},
+		{http.MethodGet, "/stats", "", http.StatusOK},
+		{http.MethodPost, "/reload", "", http.StatusNoContent},
+		{http.MethodGet, "/reload", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/unknown", "", http.StatusNotFound},
+	}
+	ta := newTestAPI(t)
+	defer ta.svc.Shutdown()
+	// tests are executed in order, they change the state of the service
+	for _, test := range tests {
+		rec := ta.do(test.method, test.path, test.body)
+		if rec.Code != test.code {
+			t.Errorf("%s %s %s = %v, want %v: %s", test.method, test.path, test.body, rec.Code, test.code, rec.Body.String())
+		}
+	}
+}
+
+func TestAPIQueues(t *testing.T) {
+	ta := newTestAPI(t)
+	defer ta.svc.Shutdown()
+	rec := ta.do(http.MethodPost, "/queues", `{"qid": 2, "plugins": ["p1"]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /queues = %v: %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		QID     int      `json:"qid"`
+		Group   string   `json:"group"`
+		Running bool     `json:"running"`
+		Plugins []string `json:"plugins"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if created.QID != 2 || created.Group != "2" || !created.Running || len(created.Plugins) != 1 || created.Plugins[0] != "p1" {
+		t.Errorf("POST /queues = %+v", created)
+	}
+	if _, ok := ta.svc.Queue(2); !ok {
+		t.Error("queue 2 not registered")
+	}
+	rec = ta.do(http.MethodGet, "/queues", "")
+	var queues []struct {
+		QID int `json:"qid"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&queues); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(queues) != 2 {
+		t.Errorf("GET /queues = %+v, want 2 queues", queues)
+	}
+}
+
+func TestAPISwitches(t *testing.T) {
+	ta := newTestAPI(t)
+	defer ta.svc.Shutdown()
+	ta.do(http.MethodPut, "/plugins/p1/disable", "")
+	if ta.switches.Enabled("p1") {
+		t.Error("plugin p1 is enabled")
+	}
+	ta.do(http.MethodPut, "/plugins/p1/actions/a1/monitor/on", "")
+	if !ta.switches.Monitor(nfqueue.ActionName("p1", "a1")) {
+		t.Error("action p1.a1 is not monitored")
+	}
+	ta.do(http.MethodPut, "/monitor/on", "")
+	if !ta.switches.MonitorAll() {
+		t.Error("global monitor is off")
+	}
+	rec := ta.do(http.MethodGet, "/plugins", "")
+	var plugins []struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+		Actions []struct {
+			Name    string `json:"name"`
+			Monitor bool   `json:"monitor"`
+		} `json:"actions"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&plugins); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(plugins) != 1 || plugins[0].Name != "p1" || plugins[0].Enabled ||
+		len(plugins[0].Actions) != 1 || plugins[0].Actions[0].Name != "a1" || !plugins[0].Actions[0].Monitor {
+		t.Errorf("GET /plugins = %+v", plugins)
+	}
+}
+
+func TestAPIReloadError(t *testing.T) {
+	ta := newTestAPI(t)
+	defer ta.svc.Shutdown()
+	ta.plugins.reloadErr = errors.New("bad definitions")
+	rec := ta.do(http.MethodPost, "/reload", "")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("POST /reload = %v, want %v", rec.Code, http.StatusInternalServerError)
+	}
+	if ta.plugins.reloads != 1 {
+		t.Errorf("reloads = %v, want 1", ta.plugins.reloads)
+	}
+}
+
+func TestAPINotAvailable(t *testing.T) {
+	ta := newTestAPI(t)
+	defer ta.svc.Shutdown()
+	api := admin.New(ta.svc, ta.plugins, nil, nil, yalogi.LogNull)
+	var tests = []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPut, "/plugins/p1/disable"},
+		{http.MethodPut, "/plugins/p1/monitor/on"},
+		{http.MethodPut, "/monitor/on"},
+		{http.MethodPut, "/trace"},
+		{http.MethodDelete, "/trace"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotImplemented {
+			t.Errorf("%s %s = %v, want %v", test.method, test.path, rec.Code, http.StatusNotImplemented)
+		}
+	}
+}
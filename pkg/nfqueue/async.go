@@ -0,0 +1,179 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// Defer defers the verdict of the packet. The hook calling it must return
+// the Pending verdict and call resolve when the verdict is available. If
+// timeout is greater than zero and the verdict is not resolved, onTimeout
+// verdict is applied. Resolving with Default continues the processing of
+// the packet with the next hooks. Returns false if the processor doesn't
+// support asynchronous verdicts, then hooks must work synchronously.
+func (md *Metadata) Defer(timeout time.Duration, onTimeout Verdict) (resolve func(Verdict), ok bool) {
+	if md.async == nil {
+		return nil, false
+	}
+	return md.async.newPending(timeout, onTimeout), true
+}
+
+// Chain is used by plugins that run their own hooks to continue their
+// processing when a deferred verdict is resolved. The function fn is
+// called with the resolved verdict and must return the verdict of the
+// plugin. Call unchain when the hook that could defer the verdict returns.
+func (md *Metadata) Chain(fn func(Verdict) Verdict) (unchain func()) {
+	if md.async == nil {
+		return func() {}
+	}
+	return md.async.push(fn)
+}
+
+// asyncPacket stores the state of the asynchronous processing of a packet
+type asyncPacket struct {
+	mu    sync.Mutex
+	chain []func(Verdict) Verdict
+	pend  *pending
+	// guard executes the resolution
+	guard func(func())
+	// resume continues the processing in the processor
+	resume func(Verdict)
+}
+
+type pending struct {
+	a     *asyncPacket
+	chain []func(Verdict) Verdict
+	timer *time.Timer
+	// state
+	mu       sync.Mutex
+	done     bool
+	returned bool
+	v        Verdict
+}
+
+func (a *asyncPacket) push(fn func(Verdict) Verdict) func() {
+	a.mu.Lock()
+	n := len(a.chain)
+	a.chain = append(a.chain, fn)
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		a.chain = a.chain[:n]
+		a.mu.Unlock()
+	}
+}
+
+func (a *asyncPacket) newPending(timeout time.Duration, onTimeout Verdict) func(Verdict) {
+	a.mu.Lock()
+	p := &pending{a: a, chain: make([]func(Verdict) Verdict, len(a.chain))}
+	copy(p.chain, a.chain)
+	a.pend = p
+	a.mu.Unlock()
+	if timeout > 0 {
+		p.timer = time.AfterFunc(timeout, func() { p.complete(onTimeout) })
+	}
+	return p.complete
+}
+
+// pending returns the pending verdict not returned yet
+func (a *asyncPacket) pending() *pending {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p := a.pend
+	if p != nil && p.isReturned() {
+		return nil
+	}
+	return p
+}
+
+// returned must be called when Pending verdict is received from a hook
+// and it will not be propagated. It returns false if there is no pending
+// verdict.
+func (a *asyncPacket) returned() bool {
+	p := a.pending()
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	p.returned = true
+	done, v := p.done, p.v
+	p.mu.Unlock()
+	if done {
+		// resolved before returning, avoid reentrance in the caller
+		go a.resolve(p, v)
+	}
+	return true
+}
+
+// cancel pending verdict, must be called when a hook deferred the verdict
+// but it didn't return Pending
+func (a *asyncPacket) cancel() {
+	p := a.pending()
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.done, p.returned = true, true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.mu.Unlock()
+}
+
+func (a *asyncPacket) resolve(p *pending, v Verdict) {
+	if a.guard != nil {
+		a.guard(func() { a.doResolve(p, v) })
+		return
+	}
+	a.doResolve(p, v)
+}
+
+func (a *asyncPacket) doResolve(p *pending, v Verdict) {
+	a.mu.Lock()
+	if a.pend == p {
+		a.pend = nil
+	}
+	a.mu.Unlock()
+	for i := len(p.chain) - 1; i >= 0; i-- {
+		a.mu.Lock()
+		a.chain = p.chain[:i]
+		a.mu.Unlock()
+		v = p.chain[i](v)
+		if v == Pending {
+			if a.returned() {
+				return
+			}
+			// pending verdict without defer, processor must handle it
+			break
+		}
+	}
+	a.mu.Lock()
+	a.chain = nil
+	a.mu.Unlock()
+	a.resume(v)
+}
+
+func (p *pending) complete(v Verdict) {
+	p.mu.Lock()
+	if p.done {
+		p.mu.Unlock()
+		return
+	}
+	p.done, p.v = true, v
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	returned := p.returned
+	p.mu.Unlock()
+	if returned {
+		p.a.resolve(p, v)
+	}
+}
+
+func (p *pending) isReturned() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.returned
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/luids-io/core/apiservice"
@@ -24,6 +25,7 @@ type Builder struct {
 	plugins    map[string]bool
 	pluginList []nfqueue.Plugin
 	actions    map[string]bool
+	monitor    []string
 
 	localNets []*net.IPNet
 	startup   []func() error
@@ -31,9 +33,10 @@ type Builder struct {
 }
 
 type options struct {
-	logger   yalogi.Logger
-	dataDir  string
-	cacheDir string
+	logger    yalogi.Logger
+	dataDir   string
+	cacheDir  string
+	conntrack bool
 }
 
 // SetLogger sets a logger for the component
@@ -57,6 +60,14 @@ func CacheDir(s string) Option {
 	}
 }
 
+// Conntrack sets if conntrack information is requested to the queues, so
+// builders can check the options that require it
+func Conntrack(b bool) Option {
+	return func(o *options) {
+		o.conntrack = b
+	}
+}
+
 var defaultOpts = options{logger: yalogi.LogNull}
 
 // Option is used for builder configuration
@@ -126,6 +137,9 @@ func (b *Builder) BuildPlugin(def PluginDef) (nfqueue.Plugin, error) {
 	//register
 	b.plugins[def.Name] = true
 	b.pluginList = append(b.pluginList, n)
+	if def.Monitor {
+		b.monitor = append(b.monitor, def.Name)
+	}
 	return n, nil
 }
 
@@ -135,7 +149,7 @@ func (b *Builder) BuildAction(pname, pclass string, def ActionDef) (nfqueue.Acti
 	if def.Name == "" {
 		return nil, errors.New("name field is required")
 	}
-	aname := fmt.Sprintf("%s.%s", pname, def.Name)
+	aname := nfqueue.ActionName(pname, def.Name)
 	aclass := fmt.Sprintf("%s.%s", pclass, def.Class)
 	//check if exists
 	_, ok := b.actions[aname]
@@ -157,6 +171,9 @@ func (b *Builder) BuildAction(pname, pclass string, def ActionDef) (nfqueue.Acti
 	}
 	//register
 	b.actions[aname] = true
+	if def.Monitor {
+		b.monitor = append(b.monitor, aname)
+	}
 	return n, nil
 }
 
@@ -165,6 +182,11 @@ func (b Builder) Logger() yalogi.Logger {
 	return b.logger
 }
 
+// Conntrack returns true if the queues provide conntrack information
+func (b Builder) Conntrack() bool {
+	return b.opts.conntrack
+}
+
 // APIService returns service by name
 func (b Builder) APIService(name string) (apiservice.Service, bool) {
 	return b.services.GetService(name)
@@ -268,6 +290,25 @@ func (b *Builder) Plugins() []nfqueue.Plugin {
 	return ret
 }
 
+// Actions returns the names of the actions builded, they are prefixed with
+// the name of the plugin: "plugin.action"
+func (b *Builder) Actions() []string {
+	ret := make([]string, 0, len(b.actions))
+	for name := range b.actions {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Monitored returns the names of the plugins and actions builded with
+// monitor mode in their definitions
+func (b *Builder) Monitored() []string {
+	ret := make([]string, len(b.monitor), len(b.monitor))
+	copy(ret, b.monitor)
+	return ret
+}
+
 // RegisterPluginBuilder registers a plugin builder for class
 func RegisterPluginBuilder(class string, builder BuildPluginFn) {
 	registryPluginBuilder[class] = builder
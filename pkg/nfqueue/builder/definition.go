@@ -16,6 +16,11 @@ type PluginDef struct {
 	Class string `json:"class"`
 	// Disabled
 	Disabled bool `json:"disabled"`
+	// Monitor computes the verdicts of the plugin without applying them
+	Monitor bool `json:"monitor,omitempty"`
+	// Priority of the plugin in the pipeline, lower runs first. Plugins
+	// with the same priority run in load order.
+	Priority int `json:"priority,omitempty"`
 	// Services is a map of services used by plugin
 	Services map[string]string `json:"services,omitempty"`
 	// Actions is a list of actions
@@ -32,6 +37,8 @@ type ActionDef struct {
 	Class string `json:"class"`
 	// Disabled
 	Disabled bool `json:"disabled"`
+	// Monitor computes the verdicts of the action without applying them
+	Monitor bool `json:"monitor,omitempty"`
 	// Services is a map of services used by plugin
 	Services map[string]string `json:"services,omitempty"`
 	// Rules is a list of ruleset definitions
@@ -0,0 +1,86 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import "time"
+
+// Processing stages reported in errors to collectors
+const (
+	StageReceive  = "receive"
+	StageDecode   = "decode"
+	StageMetadata = "metadata"
+	StageHook     = "hook"
+	StageMangle   = "mangle"
+	StageVerdict  = "verdict"
+	StageTick     = "tick"
+	StageClose    = "close"
+	StageTimeout  = "timeout"
+)
+
+// Collector receives the events of the packet processing, it's used for
+// collecting metrics. Implementations must be safe for concurrent use.
+type Collector interface {
+	// PacketReceived is called when a packet is received from the queue
+	PacketReceived(qid int)
+	// PacketDecoded is called with the result of decoding the packet
+	PacketDecoded(qid int, ok bool)
+	// Verdict is called when the verdict of a packet is set
+	Verdict(qid int, v Verdict)
+	// Hook is called when a packet hook of a plugin returns, action is
+	// empty except for plugins that run actions and report them
+	Hook(qid int, plugin, action string, v Verdict, elapsed time.Duration)
+	// Error is called when an error happens in the processing stage, tick
+	// and close errors are reported with the first qid of the group
+	Error(qid int, stage string)
+	// Backlog is called with the change in the number of packets waiting
+	// for a verdict
+	Backlog(qid int, delta int)
+	// Monitor is called with the verdict not applied because of the
+	// monitor mode, plugin is empty if it's the policy
+	Monitor(qid int, plugin, action string, v Verdict)
+}
+
+// ObserveAction is used by plugins that run actions to report the
+// execution of an action hook to the collector and the trace
+func (md *Metadata) ObserveAction(action string, v Verdict, err error, elapsed time.Duration) {
+	if md.collector != nil {
+		md.collector.Hook(md.QID, md.Plugin, action, v, elapsed)
+	}
+	if md.trace != nil {
+		md.trace.add(md.Plugin, action, v, err, elapsed)
+	}
+}
+
+// observeHook reports the execution of a plugin hook
+func (md *Metadata) observeHook(plugin string, v Verdict, err error, elapsed time.Duration) {
+	if md.collector != nil {
+		md.collector.Hook(md.QID, plugin, "", v, elapsed)
+	}
+	if md.trace != nil {
+		md.trace.add(plugin, "", v, err, elapsed)
+	}
+}
+
+// Observed returns true if a collector receives events or the packet is
+// traced, so plugins can avoid measuring times when it's not required
+func (md *Metadata) Observed() bool {
+	return md.collector != nil || md.trace != nil
+}
+
+func collectorOrNull(c Collector) Collector {
+	if c == nil {
+		return nullCollector{}
+	}
+	return c
+}
+
+// nullCollector is used if there is no collector configured
+type nullCollector struct{}
+
+func (nullCollector) PacketReceived(int)                               {}
+func (nullCollector) PacketDecoded(int, bool)                          {}
+func (nullCollector) Verdict(int, Verdict)                             {}
+func (nullCollector) Hook(int, string, string, Verdict, time.Duration) {}
+func (nullCollector) Error(int, string)                                {}
+func (nullCollector) Backlog(int, int)                                 {}
+func (nullCollector) Monitor(int, string, string, Verdict)             {}
@@ -0,0 +1,222 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/netlink"
+)
+
+// CtState represents the conntrack state of a packet
+type CtState int
+
+// Conntrack states
+const (
+	CtInvalid CtState = iota
+	CtNew
+	CtEstablished
+	CtRelated
+	CtUntracked
+)
+
+func (s CtState) String() string {
+	switch s {
+	case CtInvalid:
+		return "invalid"
+	case CtNew:
+		return "new"
+	case CtEstablished:
+		return "established"
+	case CtRelated:
+		return "related"
+	case CtUntracked:
+		return "untracked"
+	default:
+		return fmt.Sprintf("unknown(%v)", int(s))
+	}
+}
+
+// ToCtState returns a conntrack state from a string
+func ToCtState(s string) (CtState, error) {
+	switch s {
+	case "invalid":
+		return CtInvalid, nil
+	case "new":
+		return CtNew, nil
+	case "established":
+		return CtEstablished, nil
+	case "related":
+		return CtRelated, nil
+	case "untracked":
+		return CtUntracked, nil
+	default:
+		return CtState(-1), fmt.Errorf("invalid conntrack state %s", s)
+	}
+}
+
+// CtTuple stores a conntrack tuple
+type CtTuple struct {
+	Proto   uint8
+	SrcIP   net.IP
+	DstIP   net.IP
+	SrcPort uint16
+	DstPort uint16
+}
+
+func (t CtTuple) String() string {
+	return fmt.Sprintf("%v:%v->%v:%v/%v", t.SrcIP, t.SrcPort, t.DstIP, t.DstPort, t.Proto)
+}
+
+// Conntrack stores the connection tracking information of a packet
+type Conntrack struct {
+	// State of the connection
+	State CtState
+	// IsReply is true if the packet is in the reply direction
+	IsReply bool
+	// ID of the connection
+	ID uint32
+	// Status bits of the connection
+	Status uint32
+	// Mark is the connection mark
+	Mark uint32
+	// Original and Reply tuples
+	Original, Reply CtTuple
+}
+
+// ctinfo values (enum ip_conntrack_info)
+const (
+	ipCtEstablished      = 0
+	ipCtRelated          = 1
+	ipCtNew              = 2
+	ipCtEstablishedReply = 3
+	ipCtRelatedReply     = 4
+	ipCtUntracked        = 7
+)
+
+// ctnetlink attributes
+const (
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+	ctaStatus     = 3
+	ctaID         = 12
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	nlaTypeMask = 0x3fff
+)
+
+// newConntrack decodes conntrack info and NFQA_CT attribute
+func newConntrack(ctinfo uint32, data []byte) (*Conntrack, error) {
+	ct := &Conntrack{}
+	switch ctinfo {
+	case ipCtEstablished:
+		ct.State = CtEstablished
+	case ipCtRelated:
+		ct.State = CtRelated
+	case ipCtNew:
+		ct.State = CtNew
+	case ipCtEstablishedReply:
+		ct.State, ct.IsReply = CtEstablished, true
+	case ipCtRelatedReply:
+		ct.State, ct.IsReply = CtRelated, true
+	case ipCtUntracked:
+		ct.State = CtUntracked
+	default:
+		ct.State = CtInvalid
+	}
+	if len(data) == 0 {
+		return ct, nil
+	}
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return ct, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() & nlaTypeMask {
+		case ctaTupleOrig:
+			ad.Do(func(b []byte) error { return decodeCtTuple(&ct.Original, b) })
+		case ctaTupleReply:
+			ad.Do(func(b []byte) error { return decodeCtTuple(&ct.Reply, b) })
+		case ctaStatus:
+			ct.Status = ad.Uint32()
+		case ctaMark:
+			ct.Mark = ad.Uint32()
+		case ctaID:
+			ct.ID = ad.Uint32()
+		}
+	}
+	return ct, ad.Err()
+}
+
+func decodeCtTuple(t *CtTuple, data []byte) error {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() & nlaTypeMask {
+		case ctaTupleIP:
+			ad.Do(func(b []byte) error { return decodeCtTupleIP(t, b) })
+		case ctaTupleProto:
+			ad.Do(func(b []byte) error { return decodeCtTupleProto(t, b) })
+		}
+	}
+	return ad.Err()
+}
+
+func decodeCtTupleIP(t *CtTuple, data []byte) error {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return err
+	}
+	for ad.Next() {
+		switch ad.Type() & nlaTypeMask {
+		case ctaIPv4Src, ctaIPv6Src:
+			t.SrcIP = net.IP(ad.Bytes())
+		case ctaIPv4Dst, ctaIPv6Dst:
+			t.DstIP = net.IP(ad.Bytes())
+		}
+	}
+	if ad.Err() != nil {
+		return ad.Err()
+	}
+	if t.SrcIP == nil || t.DstIP == nil {
+		return errors.New("incomplete tuple ip")
+	}
+	return nil
+}
+
+func decodeCtTupleProto(t *CtTuple, data []byte) error {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() & nlaTypeMask {
+		case ctaProtoNum:
+			t.Proto = ad.Uint8()
+		case ctaProtoSrcPort:
+			t.SrcPort = ad.Uint16()
+		case ctaProtoDstPort:
+			t.DstPort = ad.Uint16()
+		}
+	}
+	return ad.Err()
+}
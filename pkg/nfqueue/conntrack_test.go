@@ -0,0 +1,153 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+func marshalAttrs(t *testing.T, attrs ...netlink.Attribute) []byte {
+	t.Helper()
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		t.Fatalf("marshaling attributes: %v", err)
+	}
+	return data
+}
+
+func ctTupleAttr(t *testing.T, typ uint16, src, dst net.IP, proto uint8, sport, dport uint16) netlink.Attribute {
+	t.Helper()
+	srcType, dstType := uint16(ctaIPv4Src), uint16(ctaIPv4Dst)
+	if src.To4() == nil {
+		srcType, dstType = ctaIPv6Src, ctaIPv6Dst
+	} else {
+		src, dst = src.To4(), dst.To4()
+	}
+	ip := marshalAttrs(t,
+		netlink.Attribute{Type: srcType, Data: src},
+		netlink.Attribute{Type: dstType, Data: dst})
+	pr := marshalAttrs(t,
+		netlink.Attribute{Type: ctaProtoNum, Data: []byte{proto}},
+		netlink.Attribute{Type: ctaProtoSrcPort, Data: []byte{byte(sport >> 8), byte(sport)}},
+		netlink.Attribute{Type: ctaProtoDstPort, Data: []byte{byte(dport >> 8), byte(dport)}})
+	tuple := marshalAttrs(t,
+		netlink.Attribute{Type: ctaTupleIP | nlaFNested, Data: ip},
+		netlink.Attribute{Type: ctaTupleProto | nlaFNested, Data: pr})
+	return netlink.Attribute{Type: typ | nlaFNested, Data: tuple}
+}
+
+func TestNewConntrackState(t *testing.T) {
+	var tests = []struct {
+		ctinfo  uint32
+		state   CtState
+		isReply bool
+	}{
+		{ipCtEstablished, CtEstablished, false},
+		{ipCtRelated, CtRelated, false},
+		{ipCtNew, CtNew, false},
+		{ipCtEstablishedReply, CtEstablished, true},
+		{ipCtRelatedReply, CtRelated, true},
+		{ipCtUntracked, CtUntracked, false},
+		{5, CtInvalid, false},
+		{100, CtInvalid, false},
+	}
+	for _, test := range tests {
+		ct, err := newConntrack(test.ctinfo, nil)
+		if err != nil {
+			t.Errorf("newConntrack(%v) err = %v", test.ctinfo, err)
+			continue
+		}
+		if ct.State != test.state || ct.IsReply != test.isReply {
+			t.Errorf("newConntrack(%v) = %v %v, want %v %v", test.ctinfo, ct.State, ct.IsReply, test.state, test.isReply)
+		}
+	}
+}
+
+func TestNewConntrack(t *testing.T) {
+	ip4a, ip4b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	ip6a, ip6b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	var tests = []struct {
+		name    string
+		data    []byte
+		want    Conntrack
+		wantErr bool
+	}{
+		{"ipv4",
+			marshalAttrs(t,
+				ctTupleAttr(t, ctaTupleOrig, ip4a, ip4b, ipProtoTCP, 1024, 80),
+				ctTupleAttr(t, ctaTupleReply, ip4b, ip4a, ipProtoTCP, 80, 1024),
+				netlink.Attribute{Type: ctaStatus, Data: be32(0x18e)},
+				netlink.Attribute{Type: ctaMark, Data: be32(0x80000001)},
+				netlink.Attribute{Type: ctaID, Data: be32(12345)},
+			),
+			Conntrack{
+				State:    CtNew,
+				ID:       12345,
+				Status:   0x18e,
+				Mark:     0x80000001,
+				Original: CtTuple{Proto: ipProtoTCP, SrcIP: ip4a.To4(), DstIP: ip4b.To4(), SrcPort: 1024, DstPort: 80},
+				Reply:    CtTuple{Proto: ipProtoTCP, SrcIP: ip4b.To4(), DstIP: ip4a.To4(), SrcPort: 80, DstPort: 1024},
+			},
+			false},
+		{"ipv6",
+			marshalAttrs(t,
+				ctTupleAttr(t, ctaTupleOrig, ip6a, ip6b, ipProtoUDP, 5353, 53),
+			),
+			Conntrack{
+				State:    CtNew,
+				Original: CtTuple{Proto: ipProtoUDP, SrcIP: ip6a, DstIP: ip6b, SrcPort: 5353, DstPort: 53},
+			},
+			false},
+		{"unknown attributes",
+			marshalAttrs(t,
+				netlink.Attribute{Type: 100, Data: []byte{1, 2, 3}},
+				netlink.Attribute{Type: ctaMark, Data: be32(7)},
+			),
+			Conntrack{State: CtNew, Mark: 7},
+			false},
+		{"incomplete tuple",
+			marshalAttrs(t,
+				netlink.Attribute{Type: ctaTupleOrig | nlaFNested, Data: marshalAttrs(t,
+					netlink.Attribute{Type: ctaTupleIP | nlaFNested, Data: marshalAttrs(t,
+						netlink.Attribute{Type: ctaIPv4Src, Data: ip4a.To4()})}),
+				},
+			),
+			Conntrack{State: CtNew},
+			true},
+		{"malformed",
+			[]byte{0xff, 0xff, 0x01},
+			Conntrack{State: CtNew},
+			true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ct, err := newConntrack(ipCtNew, test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newConntrack() err = %v, wantErr %v", err, test.wantErr)
+			}
+			if ct == nil {
+				t.Fatal("newConntrack() = nil")
+			}
+			if test.wantErr {
+				return
+			}
+			if ct.State != test.want.State || ct.ID != test.want.ID || ct.Status != test.want.Status || ct.Mark != test.want.Mark {
+				t.Errorf("newConntrack() = %+v, want %+v", ct, test.want)
+			}
+			if !equalTuple(ct.Original, test.want.Original) {
+				t.Errorf("Original = %v, want %v", ct.Original, test.want.Original)
+			}
+			if !equalTuple(ct.Reply, test.want.Reply) {
+				t.Errorf("Reply = %v, want %v", ct.Reply, test.want.Reply)
+			}
+		})
+	}
+}
+
+func equalTuple(a, b CtTuple) bool {
+	return a.Proto == b.Proto && a.SrcIP.Equal(b.SrcIP) && a.DstIP.Equal(b.DstIP) &&
+		a.SrcPort == b.SrcPort && a.DstPort == b.DstPort
+}
@@ -0,0 +1,367 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// FlowClosedTimeout is the idle time before expiring tcp flows closed by
+// fin or rst flags
+var FlowClosedTimeout = 10 * time.Second
+
+// flowLayers are the layers required for tracking flows
+var flowLayers = []gopacket.LayerType{layers.LayerTypeTCP, layers.LayerTypeUDP}
+
+// FlowKey identifies a flow in both directions, endpoints are sorted so
+// packets of the reply direction have the same key
+type FlowKey struct {
+	Proto        uint8
+	IP1, IP2     [16]byte
+	Port1, Port2 uint16
+}
+
+func (k FlowKey) String() string {
+	return fmt.Sprintf("%v %s:%v <-> %s:%v", layers.IPProtocol(k.Proto),
+		net.IP(k.IP1[:]), k.Port1, net.IP(k.IP2[:]), k.Port2)
+}
+
+// FlowState is the state of a flow
+type FlowState int
+
+// Flow states
+const (
+	// FlowNew is a flow with packets only in the original direction
+	FlowNew FlowState = iota
+	// FlowEstablished is a flow with packets in both directions
+	FlowEstablished
+	// FlowClosed is a tcp flow closed by fin or rst flags
+	FlowClosed
+)
+
+func (s FlowState) String() string {
+	switch s {
+	case FlowNew:
+		return "new"
+	case FlowEstablished:
+		return "established"
+	case FlowClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("unknown(%v)", int(s))
+}
+
+// Flow stores the state of a flow. The endpoints are set from the first
+// packet seen, so source is the originator of the flow. It's safe for
+// concurrent use.
+type Flow struct {
+	Key              FlowKey
+	Proto            layers.IPProtocol
+	SrcIP, DstIP     net.IP
+	SrcPort, DstPort uint16
+	FirstSeen        time.Time
+
+	mu       sync.Mutex
+	state    FlowState
+	lastSeen time.Time
+	packets  [2]uint64
+	bytes    [2]uint64
+	attrs    map[string]interface{}
+}
+
+// State returns the state of the flow
+func (f *Flow) State() FlowState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+// LastSeen returns the timestamp of the last packet of the flow
+func (f *Flow) LastSeen() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastSeen
+}
+
+// Packets returns the packets seen in the original and reply directions
+func (f *Flow) Packets() (orig, reply uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.packets[0], f.packets[1]
+}
+
+// Bytes returns the bytes seen in the original and reply directions, they
+// are computed from ip headers so they include not copied data
+func (f *Flow) Bytes() (orig, reply uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bytes[0], f.bytes[1]
+}
+
+// Get returns the value of the attribute of the flow
+func (f *Flow) Get(name string) (interface{}, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.attrs[name]
+	return v, ok
+}
+
+// Set the value of the attribute of the flow, plugins and actions should
+// prefix the names with their own names to avoid collisions
+func (f *Flow) Set(name string, v interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.attrs == nil {
+		f.attrs = make(map[string]interface{})
+	}
+	f.attrs[name] = v
+}
+
+// Delete the attribute of the flow
+func (f *Flow) Delete(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.attrs, name)
+}
+
+// update counters and state with a packet of the flow
+func (f *Flow) update(ts time.Time, reply bool, size int, tcp *layers.TCP) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir := 0
+	if reply {
+		dir = 1
+		if f.state == FlowNew {
+			f.state = FlowEstablished
+		}
+	}
+	f.packets[dir]++
+	f.bytes[dir] += uint64(size)
+	if ts.After(f.lastSeen) {
+		f.lastSeen = ts
+	}
+	if tcp != nil && (tcp.FIN || tcp.RST) {
+		f.state = FlowClosed
+	}
+}
+
+// expired returns true if the flow is idle since the timeout
+func (f *Flow) expired(now time.Time, timeout time.Duration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state == FlowClosed && timeout > FlowClosedTimeout {
+		timeout = FlowClosedTimeout
+	}
+	return now.Sub(f.lastSeen) > timeout
+}
+
+func (f *Flow) String() string {
+	return fmt.Sprintf("%v %s:%v -> %s:%v", f.Proto, f.SrcIP, f.SrcPort, f.DstIP, f.DstPort)
+}
+
+// FlowTable tracks the flows of the packets processed, it can be shared by
+// multiple processors. Idle flows are expired on ticks. It's safe for
+// concurrent use.
+type FlowTable struct {
+	timeout time.Duration
+	max     int
+
+	mu    sync.RWMutex
+	flows map[FlowKey]*Flow
+
+	// expiration on ticks is shared by the groups of queues using the table
+	emu     sync.Mutex
+	users   int
+	estop   chan struct{}
+	edoneCh chan struct{}
+}
+
+// NewFlowTable returns a new flow table, flows without packets during
+// timeout are expired. If max is greater than zero, new flows aren't
+// tracked when the table is full.
+func NewFlowTable(timeout time.Duration, max int) *FlowTable {
+	return &FlowTable{
+		timeout: timeout,
+		max:     max,
+		flows:   make(map[FlowKey]*Flow),
+	}
+}
+
+// Lookup returns the flow by key
+func (t *FlowTable) Lookup(key FlowKey) (*Flow, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	f, ok := t.flows[key]
+	return f, ok
+}
+
+// Len returns the number of flows tracked
+func (t *FlowTable) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.flows)
+}
+
+// Flows returns the flows tracked
+func (t *FlowTable) Flows() []*Flow {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ret := make([]*Flow, 0, len(t.flows))
+	for _, f := range t.flows {
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// Expire removes the flows idle since the timeout and returns the number
+// of flows removed
+func (t *FlowTable) Expire(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for key, f := range t.flows {
+		if f.expired(now, t.timeout) {
+			delete(t.flows, key)
+			n++
+		}
+	}
+	return n
+}
+
+// startExpire expires idle flows on ticks until all the users stop it, so
+// flows are expired once per tick regardless of the number of users
+func (t *FlowTable) startExpire(tick time.Duration) {
+	t.emu.Lock()
+	defer t.emu.Unlock()
+	t.users++
+	if t.estop != nil || tick <= 0 {
+		return
+	}
+	t.estop, t.edoneCh = make(chan struct{}), make(chan struct{})
+	go t.doExpire(tick, t.estop, t.edoneCh)
+}
+
+// stopExpire releases a user of the expiration, it's stopped by the last
+func (t *FlowTable) stopExpire() {
+	t.emu.Lock()
+	defer t.emu.Unlock()
+	t.users--
+	if t.users > 0 || t.estop == nil {
+		return
+	}
+	close(t.estop)
+	<-t.edoneCh
+	t.estop, t.edoneCh = nil, nil
+}
+
+func (t *FlowTable) doExpire(tick time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.Expire(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// track returns the flow of the packet, it's created if it doesn't exist.
+// Returns nil if the packet has not an ip layer or the table is full.
+func (t *FlowTable) track(packet gopacket.Packet, ts time.Time) (*Flow, bool) {
+	flow := &Flow{FirstSeen: ts, lastSeen: ts}
+	var size int
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		flow.Proto, flow.SrcIP, flow.DstIP = ip.Protocol, ip.SrcIP, ip.DstIP
+		size = int(ip.Length)
+	case *layers.IPv6:
+		flow.Proto, flow.SrcIP, flow.DstIP = ipv6Proto(packet, ip), ip.SrcIP, ip.DstIP
+		size = int(ip.Length) + 40
+	default:
+		return nil, false
+	}
+	var tcp *layers.TCP
+	switch tl := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		flow.Proto, flow.SrcPort, flow.DstPort = layers.IPProtocolTCP, uint16(tl.SrcPort), uint16(tl.DstPort)
+		tcp = tl
+	case *layers.UDP:
+		flow.Proto, flow.SrcPort, flow.DstPort = layers.IPProtocolUDP, uint16(tl.SrcPort), uint16(tl.DstPort)
+	}
+	flow.Key = newFlowKey(flow.Proto, flow.SrcIP, flow.DstIP, flow.SrcPort, flow.DstPort)
+
+	t.mu.RLock()
+	found, ok := t.flows[flow.Key]
+	t.mu.RUnlock()
+	if !ok {
+		t.mu.Lock()
+		found, ok = t.flows[flow.Key]
+		if !ok {
+			if t.max > 0 && len(t.flows) >= t.max {
+				t.mu.Unlock()
+				return nil, false
+			}
+			// packets are decoded without copying the payload
+			flow.SrcIP = append(net.IP(nil), flow.SrcIP...)
+			flow.DstIP = append(net.IP(nil), flow.DstIP...)
+			t.flows[flow.Key] = flow
+			found = flow
+		}
+		t.mu.Unlock()
+	}
+	reply := found.SrcPort != flow.SrcPort || !found.SrcIP.Equal(flow.SrcIP)
+	found.update(ts, reply, size, tcp)
+	return found, reply
+}
+
+// ipv6Proto returns the protocol of the layer after the extension headers
+func ipv6Proto(packet gopacket.Packet, ip *layers.IPv6) layers.IPProtocol {
+	proto := ip.NextHeader
+	for _, l := range packet.Layers() {
+		switch ext := l.(type) {
+		case *layers.IPv6HopByHop:
+			proto = ext.NextHeader
+		case *layers.IPv6Routing:
+			proto = ext.NextHeader
+		case *layers.IPv6Destination:
+			proto = ext.NextHeader
+		case *layers.IPv6Fragment:
+			proto = ext.NextHeader
+		}
+	}
+	return proto
+}
+
+func newFlowKey(proto layers.IPProtocol, src, dst net.IP, sport, dport uint16) FlowKey {
+	key := FlowKey{Proto: uint8(proto)}
+	var ip1, ip2 [16]byte
+	copy(ip1[:], src.To16())
+	copy(ip2[:], dst.To16())
+	c := bytes.Compare(ip1[:], ip2[:])
+	if c > 0 || (c == 0 && sport > dport) {
+		ip1, ip2, sport, dport = ip2, ip1, dport, sport
+	}
+	key.IP1, key.IP2, key.Port1, key.Port2 = ip1, ip2, sport, dport
+	return key
+}
+
+// Flow returns the flow of the packet, nil if flows are not tracked
+func (md *Metadata) Flow() *Flow {
+	return md.flow
+}
+
+// FlowReply returns true if the packet is in the reply direction of the
+// flow
+func (md *Metadata) FlowReply() bool {
+	return md.flowReply
+}
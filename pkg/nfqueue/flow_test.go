@@ -0,0 +1,213 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestNewFlowKey(t *testing.T) {
+	a4, b4 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	a6 := net.ParseIP("2001:db8::1")
+	tcp, udp := layers.IPProtocolTCP, layers.IPProtocolUDP
+	var tests = []struct {
+		name  string
+		a, b  FlowKey
+		equal bool
+	}{
+		{"reply", newFlowKey(tcp, a4, b4, 1024, 80), newFlowKey(tcp, b4, a4, 80, 1024), true},
+		{"same addresses reply", newFlowKey(udp, a4, a4, 1024, 53), newFlowKey(udp, a4, a4, 53, 1024), true},
+		{"ipv4 in ipv6", newFlowKey(tcp, a4, b4, 1024, 80), newFlowKey(tcp, a4.To16(), b4.To4(), 1024, 80), true},
+		{"other port", newFlowKey(tcp, a4, b4, 1024, 80), newFlowKey(tcp, a4, b4, 1025, 80), false},
+		{"other protocol", newFlowKey(tcp, a4, b4, 1024, 80), newFlowKey(udp, a4, b4, 1024, 80), false},
+		{"other address", newFlowKey(tcp, a4, b4, 1024, 80), newFlowKey(tcp, a6, b4, 1024, 80), false},
+	}
+	for _, test := range tests {
+		if (test.a == test.b) != test.equal {
+			t.Errorf("newFlowKey(%s) = %v, %v, equal want %v", test.name, test.a, test.b, test.equal)
+		}
+	}
+	key := newFlowKey(tcp, b4, a4, 80, 1024)
+	if !net.IP(key.IP1[:]).Equal(a4) || key.Port1 != 1024 || !net.IP(key.IP2[:]).Equal(b4) || key.Port2 != 80 {
+		t.Errorf("newFlowKey() = %v, endpoints not sorted", key)
+	}
+}
+
+func flowPacket(t *testing.T, src, dst string, ls ...gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	var ip gopacket.SerializableLayer
+	var proto layers.IPProtocol
+	switch l := ls[0].(type) {
+	case *layers.TCP:
+		proto = layers.IPProtocolTCP
+	case *layers.UDP:
+		proto = layers.IPProtocolUDP
+	case *layers.IPv6Destination:
+		proto = layers.IPProtocolIPv6Destination
+	default:
+		t.Fatalf("unexpected layer %v", l)
+	}
+	if srcIP.To4() != nil {
+		ip = &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, SrcIP: srcIP, DstIP: dstIP}
+	} else {
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: srcIP, DstIP: dstIP}
+	}
+	data := rawPacket(t, append([]gopacket.SerializableLayer{ip}, ls...)...)
+	return gopacket.NewPacket(data, ipLayerType(data), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+}
+
+func TestFlowTableTrack(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	table := NewFlowTable(time.Minute, 2)
+	payload := gopacket.Payload("data")
+
+	orig := flowPacket(t, "10.0.0.1", "10.0.0.2", &layers.TCP{SrcPort: 1024, DstPort: 80, SYN: true}, payload)
+	f, reply := table.track(orig, ts)
+	if f == nil || reply {
+		t.Fatalf("track() = %v, %v, want new flow", f, reply)
+	}
+	if f.State() != FlowNew || f.Proto != layers.IPProtocolTCP || f.SrcPort != 1024 || f.DstPort != 80 ||
+		f.SrcIP.String() != "10.0.0.1" || f.DstIP.String() != "10.0.0.2" || !f.FirstSeen.Equal(ts) {
+		t.Errorf("track() = %v %v, want new tcp flow", f, f.State())
+	}
+	// addresses are copied, packets are decoded without copying data
+	for i := range orig.Data() {
+		orig.Data()[i] = 0
+	}
+	if f.SrcIP.String() != "10.0.0.1" || f.DstIP.String() != "10.0.0.2" {
+		t.Errorf("flow addresses = %v, %v, they're not copied", f.SrcIP, f.DstIP)
+	}
+
+	ts2 := ts.Add(time.Second)
+	r, reply := table.track(flowPacket(t, "10.0.0.2", "10.0.0.1", &layers.TCP{SrcPort: 80, DstPort: 1024, SYN: true, ACK: true}, payload), ts2)
+	if r != f || !reply {
+		t.Fatalf("track() reply = %v, %v, want the same flow", r, reply)
+	}
+	if f.State() != FlowEstablished || !f.LastSeen().Equal(ts2) {
+		t.Errorf("flow = %v last seen %v, want established at %v", f.State(), f.LastSeen(), ts2)
+	}
+	// packets out of order don't move back last seen
+	table.track(flowPacket(t, "10.0.0.1", "10.0.0.2", &layers.TCP{SrcPort: 1024, DstPort: 80, ACK: true}, payload), ts)
+	if !f.LastSeen().Equal(ts2) {
+		t.Errorf("last seen = %v, want %v", f.LastSeen(), ts2)
+	}
+	if o, r := f.Packets(); o != 2 || r != 1 {
+		t.Errorf("Packets() = %v, %v, want 2, 1", o, r)
+	}
+	if o, r := f.Bytes(); o != 2*44 || r != 44 {
+		t.Errorf("Bytes() = %v, %v, want 88, 44", o, r)
+	}
+	table.track(flowPacket(t, "10.0.0.2", "10.0.0.1", &layers.TCP{SrcPort: 80, DstPort: 1024, FIN: true}, payload), ts2)
+	if f.State() != FlowClosed {
+		t.Errorf("state = %v, want closed", f.State())
+	}
+
+	// ipv6 with extension headers
+	f6, _ := table.track(flowPacket(t, "2001:db8::1", "2001:db8::2", destOptions(layers.IPProtocolUDP, 20),
+		&layers.UDP{SrcPort: 1024, DstPort: 8080}, payload), ts)
+	if f6 == nil || f6.Proto != layers.IPProtocolUDP || f6.SrcPort != 1024 || f6.DstPort != 8080 {
+		t.Fatalf("track() ipv6 = %v, want udp flow", f6)
+	}
+	if _, ok := table.Lookup(newFlowKey(layers.IPProtocolUDP, f6.DstIP, f6.SrcIP, 8080, 1024)); !ok {
+		t.Error("Lookup() ipv6 flow not found")
+	}
+
+	// table full
+	if f, _ := table.track(flowPacket(t, "10.0.0.3", "10.0.0.4", &layers.UDP{SrcPort: 1024, DstPort: 8080}, payload), ts); f != nil {
+		t.Errorf("track() in full table = %v, want nil", f)
+	}
+	if table.Len() != 2 || len(table.Flows()) != 2 {
+		t.Errorf("Len() = %v, want 2", table.Len())
+	}
+	// not ip
+	eth := gopacket.NewPacket(testEthPacket(nil), layers.LayerTypeEthernet, gopacket.Default)
+	if f, _ := table.track(eth, ts); f != nil {
+		t.Errorf("track() without ip = %v, want nil", f)
+	}
+}
+
+func TestFlowTableExpire(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	table := NewFlowTable(time.Minute, 0)
+	payload := gopacket.Payload("data")
+	udp, _ := table.track(flowPacket(t, "10.0.0.1", "10.0.0.2", &layers.UDP{SrcPort: 1024, DstPort: 8080}, payload), ts)
+	tcp, _ := table.track(flowPacket(t, "10.0.0.1", "10.0.0.2", &layers.TCP{SrcPort: 1024, DstPort: 80}, payload), ts)
+	closed, _ := table.track(flowPacket(t, "10.0.0.1", "10.0.0.2", &layers.TCP{SrcPort: 1025, DstPort: 80, RST: true}, payload), ts)
+
+	var tests = []struct {
+		now  time.Time
+		n    int
+		left []*Flow
+	}{
+		{ts.Add(FlowClosedTimeout), 0, []*Flow{udp, tcp, closed}},
+		{ts.Add(FlowClosedTimeout + time.Second), 1, []*Flow{udp, tcp}},
+		{ts.Add(time.Minute), 0, []*Flow{udp, tcp}},
+		{ts.Add(time.Minute + time.Second), 2, nil},
+	}
+	for _, test := range tests {
+		if n := table.Expire(test.now); n != test.n {
+			t.Errorf("Expire(%v) = %v, want %v", test.now.Sub(ts), n, test.n)
+		}
+		for _, f := range test.left {
+			if got, ok := table.Lookup(f.Key); !ok || got != f {
+				t.Errorf("Expire(%v) removed flow %v", test.now.Sub(ts), f)
+			}
+		}
+		if table.Len() != len(test.left) {
+			t.Errorf("Expire(%v) left %v flows, want %v", test.now.Sub(ts), table.Len(), len(test.left))
+		}
+	}
+}
+
+func TestFlowTableStartExpire(t *testing.T) {
+	table := NewFlowTable(time.Millisecond, 0)
+	table.track(flowPacket(t, "10.0.0.1", "10.0.0.2", &layers.UDP{SrcPort: 1024, DstPort: 8080}, gopacket.Payload("data")), time.Now())
+	// shared by two groups
+	table.startExpire(5 * time.Millisecond)
+	table.startExpire(5 * time.Millisecond)
+	table.stopExpire()
+	deadline := time.Now().Add(time.Second)
+	for table.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("flow not expired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	table.stopExpire()
+	table.emu.Lock()
+	running := table.estop != nil
+	table.emu.Unlock()
+	if running {
+		t.Error("expiration running after the last stop")
+	}
+}
+
+func TestRequiredLayers(t *testing.T) {
+	hooks := NewHooks()
+	hooks.Require(layers.LayerTypeIPv4)
+	var tests = []struct {
+		name  string
+		cfg   Config
+		hooks *Hooks
+		want  []gopacket.LayerType
+	}{
+		{"no flows", Config{}, hooks, []gopacket.LayerType{layers.LayerTypeIPv4}},
+		{"flows", Config{Flows: NewFlowTable(time.Minute, 0)}, hooks,
+			[]gopacket.LayerType{layers.LayerTypeIPv4, layers.LayerTypeTCP, layers.LayerTypeUDP}},
+		{"flows without hooks", Config{Flows: NewFlowTable(time.Minute, 0)}, NewHooks(),
+			[]gopacket.LayerType{layers.LayerTypeTCP, layers.LayerTypeUDP}},
+	}
+	for _, test := range tests {
+		got := test.cfg.requiredLayers(test.hooks)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("requiredLayers(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ip protocols with ports and ipv6 extension headers
+const (
+	ipProtoHopByHop = 0
+	ipProtoTCP      = 6
+	ipProtoUDP      = 17
+	ipProtoRouting  = 43
+	ipProtoFragment = 44
+	ipProtoDestOpts = 60
+	ipProtoSCTP     = 132
+	ipProtoUDPLite  = 136
+)
+
+// ipTuple stores the raw 5-tuple of an ip packet, ports are nil in
+// fragments and protocols without ports
+type ipTuple struct {
+	src, dst     []byte
+	proto        byte
+	sport, dport []byte
+}
+
+// rawTuple returns the 5-tuple of the raw ip packet without decoding it,
+// ipv6 extension headers are skipped
+func rawTuple(data []byte) (ipTuple, bool) {
+	var t ipTuple
+	if len(data) == 0 {
+		return t, false
+	}
+	var l4 []byte
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return t, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		t.src, t.dst, t.proto = data[12:16], data[16:20], data[9]
+		frag := binary.BigEndian.Uint16(data[6:8])
+		if frag&0x3fff == 0 && ihl >= 20 && len(data) >= ihl {
+			l4 = data[ihl:]
+		}
+	case 6:
+		if len(data) < 40 {
+			return t, false
+		}
+		t.src, t.dst = data[8:24], data[24:40]
+		t.proto, l4 = ipv6Payload(data[6], data[40:])
+	default:
+		return t, false
+	}
+	switch t.proto {
+	case ipProtoTCP, ipProtoUDP, ipProtoSCTP, ipProtoUDPLite:
+		if len(l4) >= 4 {
+			t.sport, t.dport = l4[0:2], l4[2:4]
+		}
+	}
+	return t, true
+}
+
+// ipv6Payload skips the extension headers and returns the upper layer
+// protocol and its data, data is nil in fragments and truncated headers
+func ipv6Payload(proto byte, data []byte) (byte, []byte) {
+	for {
+		switch proto {
+		case ipProtoHopByHop, ipProtoRouting, ipProtoDestOpts:
+			if len(data) < 8 || len(data) < (int(data[1])+1)*8 {
+				return proto, nil
+			}
+			proto, data = data[0], data[(int(data[1])+1)*8:]
+		case ipProtoFragment:
+			if len(data) < 8 {
+				return proto, nil
+			}
+			return data[0], nil
+		default:
+			return proto, data
+		}
+	}
+}
+
+// ports returns the source and destination ports, zero if there aren't
+func (t ipTuple) ports() (uint16, uint16) {
+	if len(t.sport) < 2 || len(t.dport) < 2 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint16(t.sport), binary.BigEndian.Uint16(t.dport)
+}
+
+// flowHash returns a symmetric hash of the 5-tuple of the raw ip packet,
+// so both directions of a flow get the same value. Fragments and unknown
+// protocols are hashed using only addresses and protocol.
+func flowHash(data []byte) uint32 {
+	t, ok := rawTuple(data)
+	if !ok {
+		return 0
+	}
+	src, dst, sport, dport := t.src, t.dst, t.sport, t.dport
+	// sort endpoints to get the same hash in both directions
+	c := bytes.Compare(src, dst)
+	if c > 0 || (c == 0 && bytes.Compare(sport, dport) > 0) {
+		src, dst = dst, src
+		sport, dport = dport, sport
+	}
+	h := fnvOffset32
+	h = fnvAdd(h, src)
+	h = fnvAdd(h, dst)
+	h = fnvAdd(h, sport)
+	h = fnvAdd(h, dport)
+	h ^= uint32(t.proto)
+	h *= fnvPrime32
+	return fmix32(h)
+}
+
+// fnv-1a hashing without allocations
+const (
+	fnvOffset32 uint32 = 2166136261
+	fnvPrime32  uint32 = 16777619
+)
+
+// fmix32 is the murmur3 finalizer, low bits of fnv are weak for modulo
+func fmix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+func fnvAdd(h uint32, data []byte) uint32 {
+	for _, b := range data {
+		h ^= uint32(b)
+		h *= fnvPrime32
+	}
+	return h
+}
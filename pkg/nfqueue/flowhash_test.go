@@ -0,0 +1,179 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func rawPacket(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatalf("serializing layers: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFlowHash(t *testing.T) {
+	a4, b4, c4 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")
+	a6, b6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ip4 := func(src, dst net.IP, proto layers.IPProtocol, flags layers.IPv4Flag, offset uint16) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, Flags: flags, FragOffset: offset, SrcIP: src, DstIP: dst}
+	}
+	ip6 := func(src, dst net.IP, proto layers.IPProtocol) *layers.IPv6 {
+		return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: src, DstIP: dst}
+	}
+	tcp := func(sport, dport layers.TCPPort) *layers.TCP {
+		return &layers.TCP{SrcPort: sport, DstPort: dport, Window: 1024}
+	}
+	udp := func(sport, dport layers.UDPPort) *layers.UDP {
+		return &layers.UDP{SrcPort: sport, DstPort: dport}
+	}
+	// ipv6 fragment header, it isn't serializable
+	frag6 := func(src, dst net.IP, offset uint16, more bool, data []byte) []byte {
+		hdr := []byte{byte(layers.IPProtocolUDP), 0, byte(offset >> 5), byte(offset << 3), 0, 0, 0, 1}
+		if more {
+			hdr[3] |= 1
+		}
+		return rawPacket(t, ip6(src, dst, layers.IPProtocolIPv6Fragment), gopacket.Payload(append(hdr, data...)))
+	}
+	payload := gopacket.Payload("data")
+
+	var tests = []struct {
+		name  string
+		a, b  []byte
+		equal bool
+	}{
+		{"ipv4 tcp reply",
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolTCP, 0, 0), tcp(1024, 80), payload),
+			rawPacket(t, ip4(b4, a4, layers.IPProtocolTCP, 0, 0), tcp(80, 1024), payload),
+			true},
+		{"ipv4 udp reply",
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolUDP, 0, 0), udp(1024, 8080), payload),
+			rawPacket(t, ip4(b4, a4, layers.IPProtocolUDP, 0, 0), udp(8080, 1024), payload),
+			true},
+		{"ipv4 same addresses reply",
+			rawPacket(t, ip4(a4, a4, layers.IPProtocolUDP, 0, 0), udp(1024, 8080), payload),
+			rawPacket(t, ip4(a4, a4, layers.IPProtocolUDP, 0, 0), udp(8080, 1024), payload),
+			true},
+		{"ipv6 tcp reply",
+			rawPacket(t, ip6(a6, b6, layers.IPProtocolTCP), tcp(1024, 80), payload),
+			rawPacket(t, ip6(b6, a6, layers.IPProtocolTCP), tcp(80, 1024), payload),
+			true},
+		{"ipv4 other port",
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolTCP, 0, 0), tcp(1024, 80), payload),
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolTCP, 0, 0), tcp(1025, 80), payload),
+			false},
+		{"ipv4 other address",
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolTCP, 0, 0), tcp(1024, 80), payload),
+			rawPacket(t, ip4(a4, c4, layers.IPProtocolTCP, 0, 0), tcp(1024, 80), payload),
+			false},
+		{"ipv4 other protocol",
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolTCP, 0, 0), tcp(1024, 80), payload),
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolUDP, 0, 0), udp(1024, 80), payload),
+			false},
+		{"ipv4 fragments",
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolUDP, layers.IPv4MoreFragments, 0), udp(1024, 8080), payload),
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolUDP, 0, 185), payload),
+			true},
+		{"ipv6 fragments",
+			frag6(a6, b6, 0, true, rawPacket(t, udp(1024, 8080), payload)),
+			frag6(a6, b6, 185, false, []byte("more data")),
+			true},
+		{"ipv6 extensions reply",
+			rawPacket(t, ip6(a6, b6, layers.IPProtocolIPv6Destination), destOptions(layers.IPProtocolUDP, 20), udp(1024, 8080), payload),
+			rawPacket(t, ip6(b6, a6, layers.IPProtocolUDP), udp(8080, 1024), payload),
+			true},
+		{"ipv6 extensions other port",
+			rawPacket(t, ip6(a6, b6, layers.IPProtocolIPv6Destination), destOptions(layers.IPProtocolUDP, 20), udp(1024, 8080), payload),
+			rawPacket(t, ip6(a6, b6, layers.IPProtocolIPv6Destination), destOptions(layers.IPProtocolUDP, 20), udp(1025, 8080), payload),
+			false},
+		{"unknown protocol reply",
+			rawPacket(t, ip4(a4, b4, layers.IPProtocolGRE, 0, 0), payload),
+			rawPacket(t, ip4(b4, a4, layers.IPProtocolGRE, 0, 0), gopacket.Payload("other")),
+			true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ha, hb := flowHash(test.a), flowHash(test.b)
+			if (ha == hb) != test.equal {
+				t.Errorf("flowHash() = %#x, %#x, equal want %v", ha, hb, test.equal)
+			}
+		})
+	}
+}
+
+func TestFlowHashInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short ipv4", []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 6}},
+		{"short ipv6", []byte{0x60, 0, 0, 0, 0, 0, 6, 64}},
+		{"unknown version", append([]byte{0x50}, make([]byte, 59)...)},
+	}
+	for _, test := range tests {
+		if h := flowHash(test.data); h != 0 {
+			t.Errorf("flowHash(%s) = %#x, want 0", test.name, h)
+		}
+	}
+}
+
+func TestRawTuple(t *testing.T) {
+	a4, b4 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	a6, b6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	udp := &layers.UDP{SrcPort: 1024, DstPort: 8080}
+	payload := gopacket.Payload("data")
+
+	var tests = []struct {
+		name         string
+		data         []byte
+		proto        layers.IPProtocol
+		sport, dport uint16
+		ok           bool
+	}{
+		{"ipv4 udp",
+			rawPacket(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: a4, DstIP: b4}, udp, payload),
+			layers.IPProtocolUDP, 1024, 8080, true},
+		{"ipv4 fragment",
+			rawPacket(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, Flags: layers.IPv4MoreFragments, SrcIP: a4, DstIP: b4}, udp, payload),
+			layers.IPProtocolUDP, 0, 0, true},
+		{"ipv4 gre",
+			rawPacket(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolGRE, SrcIP: a4, DstIP: b4}, payload),
+			layers.IPProtocolGRE, 0, 0, true},
+		{"ipv6 udp",
+			rawPacket(t, &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: a6, DstIP: b6}, udp, payload),
+			layers.IPProtocolUDP, 1024, 8080, true},
+		{"ipv6 extensions",
+			rawPacket(t, &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Destination, SrcIP: a6, DstIP: b6},
+				destOptions(layers.IPProtocolIPv6Destination, 20), destOptions(layers.IPProtocolUDP, 100), udp, payload),
+			layers.IPProtocolUDP, 1024, 8080, true},
+		{"ipv6 truncated extension",
+			rawPacket(t, &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Destination, SrcIP: a6, DstIP: b6},
+				gopacket.Payload{byte(layers.IPProtocolUDP), 4, 0, 0}),
+			layers.IPProtocolIPv6Destination, 0, 0, true},
+		{"short", []byte{0x45, 0, 0, 20}, 0, 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tuple, ok := rawTuple(test.data)
+			if ok != test.ok {
+				t.Fatalf("rawTuple() ok = %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			sport, dport := tuple.ports()
+			if layers.IPProtocol(tuple.proto) != test.proto || sport != test.sport || dport != test.dport {
+				t.Errorf("rawTuple() = %v %v:%v, want %v %v:%v", layers.IPProtocol(tuple.proto), sport, dport, test.proto, test.sport, test.dport)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/luids-io/core/yalogi"
+)
+
+// group of queues sharing the packet processing pipeline, so hooks and
+// the state of the plugins are shared by all the queues of the group
+type group struct {
+	logger     yalogi.Logger
+	desc       string
+	qid        int //first qid
+	hrunner    *hooksRunner
+	depth      int
+	collector  Collector
+	ifaces     *ifaceCache
+	lastPacket int64 //unix nano, atomic access
+	queues     []*queue
+
+	stop    context.CancelFunc
+	errorCh chan error
+	tdoneCh chan struct{}
+	// hmu serializes tick hooks with packet hooks and protects the
+	// pipeline (hrunner and depth) of reloads
+	hmu sync.RWMutex
+	// failure of the group, it's sent before closing the errors channel
+	fmu       sync.Mutex
+	failErr   error
+	closeOnce sync.Once
+}
+
+func newGroup(qids []int, hrunner *hooksRunner, depth int, logger yalogi.Logger) *group {
+	return &group{
+		logger:  logger,
+		desc:    groupDesc(qids),
+		qid:     qids[0],
+		hrunner: hrunner,
+		depth:   depth,
+		ifaces:  newIfaceCache(),
+		errorCh: make(chan error, ErrorsBuffer),
+	}
+}
+
+// groupDesc returns the description used in errors
+func groupDesc(qids []int) string {
+	if len(qids) == 1 {
+		return fmt.Sprintf("qid(#%v)", qids[0])
+	}
+	s := make([]string, 0, len(qids))
+	for _, qid := range qids {
+		s = append(s, strconv.Itoa(qid))
+	}
+	return fmt.Sprintf("qids(#%s)", strings.Join(s, ","))
+}
+
+func (g *group) start(tick time.Duration) {
+	//creates context for cancelation
+	ctx := context.Background()
+	ctx, g.stop = context.WithCancel(ctx)
+	// start timer gorutine
+	if tick > 0 {
+		g.tdoneCh = make(chan struct{})
+		go g.doTick(ctx, tick)
+	}
+}
+
+// reload replaces the pipeline of the group and returns the previous one,
+// packets in process finish with it. It isn't closed, so it can be restored.
+func (g *group) reload(hrunner *hooksRunner, depth int) *hooksRunner {
+	g.logger.Debugf("reloading hooks in nfqueue group %s", g.desc)
+	g.hmu.Lock()
+	old := g.hrunner
+	g.hrunner, g.depth = hrunner, depth
+	g.hmu.Unlock()
+	return old
+}
+
+// closeRunner waits for the packets in process with a pipeline replaced by
+// a reload and executes its close hooks
+func (g *group) closeRunner(hrunner *hooksRunner) {
+	if !hrunner.wait(DrainTimeout) {
+		g.logger.Warnf("timeout draining packets of replaced hooks in %s", g.desc)
+	}
+	for _, err := range hrunner.Close() {
+		g.logger.Warnf("on close %s: %v", g.desc, err)
+	}
+}
+
+// fail closes the group in background because of the error
+func (g *group) fail(err error) {
+	g.fmu.Lock()
+	defer g.fmu.Unlock()
+	if g.failErr != nil {
+		return
+	}
+	g.failErr = err
+	g.logger.Errorf("%v", err)
+	go g.close()
+}
+
+func (g *group) close() {
+	g.closeOnce.Do(g.doClose)
+}
+
+func (g *group) doClose() {
+	g.logger.Debugf("closing nfqueue group %s", g.desc)
+	if g.stop != nil {
+		g.stop()
+	}
+	for _, q := range g.queues {
+		q.close()
+	}
+	// if tick gorutine, then wait it for close
+	if g.tdoneCh != nil {
+		<-g.tdoneCh
+	}
+	// clean up
+	errs := g.hrunner.Close()
+	for _, err := range errs {
+		g.errorCh <- fmt.Errorf("on close %s: %v", g.desc, err)
+		g.collector.Error(g.qid, StageClose)
+	}
+	g.fmu.Lock()
+	state := QueueStopped
+	if g.failErr != nil {
+		state = QueueFailed
+		g.errorCh <- g.failErr
+	}
+	g.fmu.Unlock()
+	for _, q := range g.queues {
+		q.stats.setState(state)
+	}
+	close(g.errorCh)
+}
+
+func (g *group) doTick(ctx context.Context, tick time.Duration) {
+	g.logger.Debugf("starting tick in nfqueue group %s", g.desc)
+	lastTick := time.Now()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+LOOPTICK:
+	for {
+		select {
+		case <-ticker.C:
+			g.hmu.Lock()
+			errs := g.hrunner.Tick(lastTick, time.Unix(0, atomic.LoadInt64(&g.lastPacket)))
+			g.hmu.Unlock()
+			for _, err := range errs {
+				g.errorCh <- fmt.Errorf("on tick in %s: %v", g.desc, err)
+				g.collector.Error(g.qid, StageTick)
+			}
+			lastTick = time.Now()
+		case <-ctx.Done():
+			break LOOPTICK
+		}
+	}
+	close(g.tdoneCh)
+	return
+}
@@ -3,14 +3,27 @@
 package nfqueue
 
 import (
+	"context"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 )
 
 type (
-	//CbPacket defines a callback on packet
-	CbPacket func(gopacket.Packet, time.Time) (Verdict, error)
+	//CbPacket defines a callback on packet. The context is cancelled when
+	//the packet processing deadline is exceeded. It can return Pending if
+	//the verdict was deferred using Metadata.Defer
+	CbPacket func(context.Context, gopacket.Packet, *Metadata) (Verdict, error)
+	//CbMangle defines a callback on packet that can modify it. If the
+	//returned packet is not nil, it replaces the original packet.
+	CbMangle func(context.Context, gopacket.Packet, *Metadata) (gopacket.Packet, Verdict, error)
+	//CbVerdict defines a callback called after the verdict of the packet
+	//is set with the name of the plugin that decided it, empty if it was
+	//decided by the processor (policy, errors or timeouts). It can't
+	//change the verdict.
+	CbVerdict func(gopacket.Packet, *Metadata, string, Verdict) error
 	//CbTick defines callback for tick routines
 	CbTick func(time.Time, time.Time) error
 	//CbClose defines callback for cleanups
@@ -21,33 +34,102 @@ type (
 type OnPacket struct {
 	Layer    gopacket.LayerType
 	Callback CbPacket
+	Mangle   CbMangle
+	// Plugin is the name of the plugin that registered the hook
+	Plugin string
+	// Priority of the hook in the pipeline, hooks with lower priority
+	// run first and hooks with the same priority in registration order
+	Priority int
 }
 
-// Hooks is responsible for packet processor
+// OnVerdict stores verdict callbacks
+type OnVerdict struct {
+	Callback CbVerdict
+	// Plugin is the name of the plugin that registered the hook
+	Plugin string
+}
+
+// Hooks is responsible for packet processor. Packet hooks are executed
+// sorted by priority regardless of their layer.
 type Hooks struct {
-	layers   []gopacket.LayerType
-	onPacket map[gopacket.LayerType][]OnPacket
-	sorted   []OnPacket
-	onTick   []CbTick
-	onClose  []CbClose
+	layers    []gopacket.LayerType
+	required  []gopacket.LayerType
+	sorted    []OnPacket
+	onVerdict []OnVerdict
+	onTick    []CbTick
+	onClose   []closeHook
+	// verdicts of the pipeline
+	policy, onError Verdict
+	strategy        Strategy
+	// plugin registering hooks and its priority
+	plugin   string
+	priority int
+	// plugins added and the runners using them, if refs is nil the close
+	// hooks of the plugins are executed by every runner
+	plugins []string
+	refs    *pluginRefs
+}
+
+// closeHook stores a close callback and the plugin that registered it
+type closeHook struct {
+	callback CbClose
+	plugin   string
 }
 
 // NewHooks returns a new hooks collection
 func NewHooks() *Hooks {
-	return &Hooks{onPacket: make(map[gopacket.LayerType][]OnPacket)}
+	return &Hooks{}
 }
 
 // OnPacket adds a callback function on new packet
 func (h *Hooks) OnPacket(layer gopacket.LayerType, fn CbPacket) {
-	callbacks, ok := h.onPacket[layer]
-	if !ok {
-		h.layers = append(h.layers, layer)
-		callbacks = make([]OnPacket, 0)
+	h.addPacketHook(OnPacket{Layer: layer, Callback: fn})
+}
+
+// OnMangle adds a callback function on new packet that can modify it
+func (h *Hooks) OnMangle(layer gopacket.LayerType, fn CbMangle) {
+	h.addPacketHook(OnPacket{Layer: layer, Mangle: fn})
+}
+
+// Add registers the hooks and the layers required by the plugin, the
+// packet hooks get the priority of the plugin if it's Prioritized
+func (h *Hooks) Add(p Plugin) {
+	h.plugin, h.priority = p.Name(), 0
+	if pp, ok := p.(Prioritized); ok {
+		h.priority = pp.Priority()
 	}
-	cb := OnPacket{Layer: layer, Callback: fn}
-	callbacks = append(callbacks, cb)
-	h.sorted = append(h.sorted, cb)
-	h.onPacket[layer] = callbacks
+	p.Register(h)
+	h.plugin, h.priority = "", 0
+	h.Require(p.Layers()...)
+	h.plugins = append(h.plugins, p.Name())
+}
+
+func (h *Hooks) addPacketHook(cb OnPacket) {
+	cb.Plugin, cb.Priority = h.plugin, h.priority
+	if !containsLayer(h.layers, cb.Layer) {
+		h.layers = append(h.layers, cb.Layer)
+	}
+	// insert after the hooks with the same priority
+	i := sort.Search(len(h.sorted), func(i int) bool {
+		return h.sorted[i].Priority > cb.Priority
+	})
+	h.sorted = append(h.sorted, OnPacket{})
+	copy(h.sorted[i+1:], h.sorted[i:])
+	h.sorted[i] = cb
+}
+
+// Require adds layers required by the packet processing pipeline
+func (h *Hooks) Require(layers ...gopacket.LayerType) {
+	for _, layer := range layers {
+		if !containsLayer(h.required, layer) {
+			h.required = append(h.required, layer)
+		}
+	}
+}
+
+// OnVerdict adds a callback function called after the verdict is set
+func (h *Hooks) OnVerdict(fn CbVerdict) {
+	h.onVerdict = append(h.onVerdict, OnVerdict{Callback: fn, Plugin: h.plugin})
 }
 
 // OnTick adds a callback function on each tick
@@ -57,7 +139,29 @@ func (h *Hooks) OnTick(fn CbTick) {
 
 // OnClose adds a callback function when closes source
 func (h *Hooks) OnClose(fn CbClose) {
-	h.onClose = append(h.onClose, fn)
+	h.onClose = append(h.onClose, closeHook{callback: fn, plugin: h.plugin})
+}
+
+// SetVerdicts sets the policy and onerror verdicts of the pipeline, if
+// not Default they override the configuration of the processor
+func (h *Hooks) SetVerdicts(policy, onError Verdict) {
+	h.policy, h.onError = policy, onError
+}
+
+// Verdicts returns the policy and onerror verdicts of the pipeline
+func (h *Hooks) Verdicts() (policy, onError Verdict) {
+	return h.policy, h.onError
+}
+
+// SetStrategy sets how the verdicts of the packet hooks are combined,
+// FirstMatch by default
+func (h *Hooks) SetStrategy(s Strategy) {
+	h.strategy = s
+}
+
+// Strategy returns the strategy of the pipeline
+func (h *Hooks) Strategy() Strategy {
+	return h.strategy
 }
 
 // Layers return registered layers
@@ -67,14 +171,27 @@ func (h *Hooks) Layers() []gopacket.LayerType {
 	return ret
 }
 
-// PacketHooksByLayer returns on packet hooks by layer
+// RequiredLayers returns layers required by the pipeline, including the
+// registered layers
+func (h *Hooks) RequiredLayers() []gopacket.LayerType {
+	ret := make([]gopacket.LayerType, len(h.required), len(h.required)+len(h.layers))
+	copy(ret, h.required)
+	for _, layer := range h.layers {
+		if !containsLayer(ret, layer) {
+			ret = append(ret, layer)
+		}
+	}
+	return ret
+}
+
+// PacketHooksByLayer returns on packet hooks by layer in order
 func (h *Hooks) PacketHooksByLayer(layer gopacket.LayerType) []OnPacket {
-	stored, ok := h.onPacket[layer]
-	if !ok {
-		return []OnPacket{}
+	ret := make([]OnPacket, 0)
+	for _, cb := range h.sorted {
+		if cb.Layer == layer {
+			ret = append(ret, cb)
+		}
 	}
-	ret := make([]OnPacket, len(stored), len(stored))
-	copy(ret, stored)
 	return ret
 }
 
@@ -85,6 +202,13 @@ func (h *Hooks) PacketHooks() []OnPacket {
 	return ret
 }
 
+// VerdictHooks returns on verdict hooks
+func (h *Hooks) VerdictHooks() []OnVerdict {
+	ret := make([]OnVerdict, len(h.onVerdict), len(h.onVerdict))
+	copy(ret, h.onVerdict)
+	return ret
+}
+
 // TickHooks returns on tick hooks
 func (h *Hooks) TickHooks() []CbTick {
 	ret := make([]CbTick, len(h.onTick), len(h.onTick))
@@ -94,52 +218,123 @@ func (h *Hooks) TickHooks() []CbTick {
 
 // CloseHooks returns on close hooks
 func (h *Hooks) CloseHooks() []CbClose {
-	ret := make([]CbClose, len(h.onClose), len(h.onClose))
-	copy(ret, h.onClose)
+	ret := make([]CbClose, 0, len(h.onClose))
+	for _, cb := range h.onClose {
+		ret = append(ret, cb.callback)
+	}
 	return ret
 }
 
+func containsLayer(list []gopacket.LayerType, layer gopacket.LayerType) bool {
+	for _, l := range list {
+		if l == layer {
+			return true
+		}
+	}
+	return false
+}
+
 // hooksRunner executes Hooks
 type hooksRunner struct {
-	layers   []gopacket.LayerType
-	onPacket map[gopacket.LayerType][]OnPacket
-	onTick   []CbTick
-	onClose  []CbClose
+	layers    []gopacket.LayerType
+	onPacket  []OnPacket
+	onVerdict []OnVerdict
+	onTick    []CbTick
+	onClose   []closeHook
+	strategy  Strategy
+	// plugins used by the runner
+	plugins []string
+	refs    *pluginRefs
+	// pending tracks the packets in process with the runner
+	pending sync.WaitGroup
 }
 
-// NewHooksRunner returns a HooksRunner
+// NewHooksRunner returns a HooksRunner, it uses the plugins of the hooks
+// until it's closed or discarded
 func newHooksRunner(h *Hooks) *hooksRunner {
-	runner := &hooksRunner{onPacket: make(map[gopacket.LayerType][]OnPacket)}
+	runner := &hooksRunner{strategy: h.strategy, refs: h.refs}
 	runner.layers = h.Layers()
-	for _, layer := range runner.layers {
-		runner.onPacket[layer] = h.PacketHooksByLayer(layer)
-	}
+	runner.onPacket = h.PacketHooks()
+	runner.onVerdict = h.VerdictHooks()
 	runner.onTick = h.TickHooks()
-	runner.onClose = h.CloseHooks()
+	runner.onClose = make([]closeHook, len(h.onClose), len(h.onClose))
+	copy(runner.onClose, h.onClose)
+	runner.plugins = make([]string, len(h.plugins), len(h.plugins))
+	copy(runner.plugins, h.plugins)
+	runner.refs.acquire(runner.plugins)
 	return runner
 }
 
-// Packet executes all registered onPacket hooks for the layerType
-// passed in a secuencial way. If some of the hooks returns true, then
-// the execution stops and returns true.
-func (h *hooksRunner) Packet(layer gopacket.LayerType, packet gopacket.Packet, ts time.Time) (Verdict, []error) {
-	callbacks, ok := h.onPacket[layer]
-	if ok {
-		var v Verdict
-		errs := make([]error, 0, len(callbacks))
-		for _, cb := range callbacks {
+// Packet executes all registered onPacket hooks in order in a secuencial
+// way, hooks of layers not decoded in the packet are skipped. If some of
+// the hooks returns a verdict that ends the processing in the strategy,
+// then the execution stops and returns it, otherwise the verdict held by
+// the strategy is returned. If some of the hooks modified the packet, the
+// last modified packet is returned, nil otherwise.
+func (h *hooksRunner) Packet(ctx context.Context, packet gopacket.Packet, md *Metadata) (Verdict, gopacket.Packet, []error) {
+	v, mangled, _, errs := h.PacketFrom(ctx, 0, packet, md)
+	return v, mangled, errs
+}
+
+// PacketFrom executes onPacket hooks starting from the hook with index
+// start. It returns also the index of the next hook to be executed.
+func (h *hooksRunner) PacketFrom(ctx context.Context, start int, packet gopacket.Packet, md *Metadata) (Verdict, gopacket.Packet, int, []error) {
+	callbacks := h.onPacket
+	if start < len(callbacks) {
+		var mangled gopacket.Packet
+		errs := make([]error, 0, len(callbacks)-start)
+		for i := start; i < len(callbacks); i++ {
+			cb := callbacks[i]
+			if packet.Layer(cb.Layer) == nil || !md.switches.Enabled(cb.Plugin) {
+				continue
+			}
+			var v Verdict
 			var err error
-			v, err = cb.Callback(packet, ts)
+			var start time.Time
+			if md.Observed() {
+				start = time.Now()
+			}
+			md.Plugin = cb.Plugin
+			if cb.Mangle != nil {
+				var p gopacket.Packet
+				p, v, err = cb.Mangle(ctx, packet, md)
+				if p != nil {
+					packet, mangled = p, p
+				}
+			} else {
+				v, err = cb.Callback(ctx, packet, md)
+			}
+			if md.Observed() {
+				md.observeHook(cb.Plugin, v, err, time.Since(start))
+			}
+			v = md.monitorPlugin(cb.Plugin, v)
 			if err != nil {
 				errs = append(errs, err)
 			}
-			if v != Default {
-				return v, errs
+			if h.strategy.decide(md, v) {
+				return v, mangled, i + 1, errs
 			}
+			md.Plugin, md.Action = "", ""
 		}
-		return v, errs
+		return md.release(), mangled, len(callbacks), errs
 	}
-	return Default, nil
+	return md.release(), nil, start, nil
+}
+
+// Verdict executes onVerdict hooks of the enabled plugins with the verdict
+// set to the packet and the plugin that decided it
+func (h *hooksRunner) Verdict(packet gopacket.Packet, md *Metadata, plugin string, v Verdict) []error {
+	errs := make([]error, 0, len(h.onVerdict))
+	for _, cb := range h.onVerdict {
+		if !md.switches.Enabled(cb.Plugin) {
+			continue
+		}
+		err := cb.Callback(packet, md, plugin, v)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
 }
 
 // Tick executes onTick registered hooks. It pass the last timestamp.
@@ -154,11 +349,16 @@ func (h *hooksRunner) Tick(lastTick, lastPacket time.Time) []error {
 	return errs
 }
 
-// Close executes on close registered hooks.
+// Close executes on close registered hooks. The hooks of plugins used by
+// other runners are skipped, they're executed by the last one.
 func (h *hooksRunner) Close() []error {
+	unused := h.refs.release(h.plugins)
 	errs := make([]error, 0, len(h.onClose))
 	for _, cb := range h.onClose {
-		err := cb()
+		if h.refs != nil && cb.plugin != "" && !unused[cb.plugin] {
+			continue
+		}
+		err := cb.callback()
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -166,7 +366,71 @@ func (h *hooksRunner) Close() []error {
 	return errs
 }
 
+// discard releases the plugins of a runner that was never used, close
+// hooks are not executed
+func (h *hooksRunner) discard() {
+	h.refs.release(h.plugins)
+}
+
+// wait returns true if the packets in process with the runner finished
+// before the timeout
+func (h *hooksRunner) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		h.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 // Layers returns layertypes
 func (h *hooksRunner) Layers() []gopacket.LayerType {
 	return h.layers
 }
+
+// pluginRefs counts the runners using each plugin, so the close hooks of
+// plugins shared by several groups are executed only once. Plugins are
+// identified by name, so a new pluginRefs is required when plugins are
+// replaced.
+type pluginRefs struct {
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+func newPluginRefs() *pluginRefs {
+	return &pluginRefs{refs: make(map[string]int)}
+}
+
+func (r *pluginRefs) acquire(plugins []string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range plugins {
+		r.refs[name]++
+	}
+}
+
+// release returns the plugins that are not used by other runners
+func (r *pluginRefs) release(plugins []string) map[string]bool {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unused := make(map[string]bool, len(plugins))
+	for _, name := range plugins {
+		r.refs[name]--
+		if r.refs[name] <= 0 {
+			delete(r.refs, name)
+			unused[name] = true
+		}
+	}
+	return unused
+}
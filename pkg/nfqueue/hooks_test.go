@@ -0,0 +1,131 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// orderPlugin registers packet hooks that record their execution order
+type orderPlugin struct {
+	name   string
+	layers []gopacket.LayerType
+	order  *[]string
+}
+
+func (p orderPlugin) Name() string                 { return p.name }
+func (p orderPlugin) Class() string                { return "test" }
+func (p orderPlugin) Layers() []gopacket.LayerType { return p.layers }
+func (p orderPlugin) CleanUp()                     {}
+
+func (p orderPlugin) Register(h *Hooks) {
+	for _, layer := range p.layers {
+		name := p.name + "/" + layer.String()
+		h.OnPacket(layer, func(context.Context, gopacket.Packet, *Metadata) (Verdict, error) {
+			*p.order = append(*p.order, name)
+			return Default, nil
+		})
+	}
+}
+
+// prioPlugin is an orderPlugin with priority
+type prioPlugin struct {
+	orderPlugin
+	priority int
+}
+
+func (p prioPlugin) Priority() int { return p.priority }
+
+func TestHooksPriority(t *testing.T) {
+	ip, udp := []gopacket.LayerType{layers.LayerTypeIPv4}, []gopacket.LayerType{layers.LayerTypeUDP}
+	both := []gopacket.LayerType{layers.LayerTypeUDP, layers.LayerTypeIPv4}
+	var tests = []struct {
+		name    string
+		chain   []string
+		plugins func(order *[]string) []Plugin
+		want    []string
+	}{
+		{"registration order",
+			nil,
+			func(order *[]string) []Plugin {
+				return []Plugin{orderPlugin{"p1", ip, order}, orderPlugin{"p2", udp, order}, orderPlugin{"p3", ip, order}}
+			},
+			[]string{"p1/IPv4", "p2/UDP", "p3/IPv4"}},
+		{"priority",
+			nil,
+			func(order *[]string) []Plugin {
+				return []Plugin{
+					prioPlugin{orderPlugin{"p1", ip, order}, 10},
+					prioPlugin{orderPlugin{"p2", udp, order}, -5},
+					orderPlugin{"p3", ip, order},
+				}
+			},
+			[]string{"p2/UDP", "p3/IPv4", "p1/IPv4"}},
+		{"same priority",
+			nil,
+			func(order *[]string) []Plugin {
+				return []Plugin{
+					prioPlugin{orderPlugin{"p1", ip, order}, 1},
+					prioPlugin{orderPlugin{"p2", ip, order}, 0},
+					prioPlugin{orderPlugin{"p3", udp, order}, 1},
+					prioPlugin{orderPlugin{"p4", ip, order}, 0},
+				}
+			},
+			[]string{"p2/IPv4", "p4/IPv4", "p1/IPv4", "p3/UDP"}},
+		{"plugin hooks regardless of layer",
+			nil,
+			func(order *[]string) []Plugin {
+				return []Plugin{orderPlugin{"p1", ip, order}, prioPlugin{orderPlugin{"p2", both, order}, -1}}
+			},
+			[]string{"p2/UDP", "p2/IPv4", "p1/IPv4"}},
+		{"chain",
+			[]string{"p3", "p1"},
+			func(order *[]string) []Plugin {
+				return []Plugin{orderPlugin{"p1", ip, order}, orderPlugin{"p2", ip, order}, orderPlugin{"p3", ip, order}}
+			},
+			[]string{"p3/IPv4", "p1/IPv4"}},
+		{"priority overrides chain",
+			[]string{"p3", "p1", "p2"},
+			func(order *[]string) []Plugin {
+				return []Plugin{
+					prioPlugin{orderPlugin{"p1", ip, order}, -1},
+					orderPlugin{"p2", ip, order},
+					prioPlugin{orderPlugin{"p3", ip, order}, 1},
+				}
+			},
+			[]string{"p1/IPv4", "p2/IPv4", "p3/IPv4"}},
+	}
+	data := rawPacket(t,
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+			SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")},
+		&layers.UDP{SrcPort: 1024, DstPort: 8080},
+		gopacket.Payload("data"))
+	packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			order := make([]string, 0)
+			hooks, err := NewGroupHooks(GroupConfig{Plugins: test.chain, Policy: Accept, OnError: Accept}, test.plugins(&order))
+			if err != nil {
+				t.Fatalf("NewGroupHooks() err = %v", err)
+			}
+			registered := make([]string, 0)
+			for _, cb := range hooks.PacketHooks() {
+				registered = append(registered, cb.Plugin+"/"+cb.Layer.String())
+			}
+			if !reflect.DeepEqual(registered, test.want) {
+				t.Errorf("PacketHooks() = %v, want %v", registered, test.want)
+			}
+			runner := newHooksRunner(hooks)
+			runner.Packet(context.Background(), packet, &Metadata{})
+			if !reflect.DeepEqual(order, test.want) {
+				t.Errorf("executed = %v, want %v", order, test.want)
+			}
+		})
+	}
+}
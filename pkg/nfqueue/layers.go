@@ -0,0 +1,130 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Decode depths, full depth decodes all layers
+const (
+	depthFull      = 0
+	depthNetwork   = 1
+	depthTransport = 2
+)
+
+// Copy ranges required by decode depths, they include ip options, ipv6
+// extension headers up to maxIPv6Extensions bytes and transport headers
+// with options. Packets with longer headers are truncated before the
+// decoded layers, so they can't be decoded and get the onerror verdict.
+const (
+	maxIPv6Extensions  = 512
+	copyRangeNetwork   = 40 + maxIPv6Extensions
+	copyRangeTransport = copyRangeNetwork + 60
+)
+
+// ipLayerType returns the first layer of the raw ip packet from the
+// version nibble
+func ipLayerType(data []byte) gopacket.LayerType {
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return layers.LayerTypeIPv6
+	}
+	return layers.LayerTypeIPv4
+}
+
+// layerDepth returns the decode depth required by the layer
+func layerDepth(layer gopacket.LayerType) int {
+	switch layer {
+	case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+		return depthNetwork
+	case layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeUDPLite,
+		layers.LayerTypeSCTP, layers.LayerTypeICMPv4, layers.LayerTypeICMPv6:
+		return depthTransport
+	default:
+		return depthFull
+	}
+}
+
+// decodeDepth returns the minimal decode depth required by layers
+func decodeDepth(required []gopacket.LayerType) int {
+	if len(required) == 0 {
+		return depthFull
+	}
+	depth := depthNetwork
+	for _, layer := range required {
+		d := layerDepth(layer)
+		if d == depthFull {
+			return depthFull
+		}
+		if d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
+
+// copyRange returns the minimal copy range required for decode depth
+func copyRange(depth int) uint32 {
+	switch depth {
+	case depthNetwork:
+		return copyRangeNetwork
+	case depthTransport:
+		return copyRangeTransport
+	default:
+		return DefaultCopyRange
+	}
+}
+
+// depthDecoder wraps a decoder and stops decoding layers when depth is
+// reached, the remaining data is decoded as payload
+type depthDecoder struct {
+	next  gopacket.Decoder
+	depth int
+}
+
+func newDecoder(first gopacket.LayerType, depth int) gopacket.Decoder {
+	if depth == depthFull {
+		return first
+	}
+	return depthDecoder{next: first, depth: depth}
+}
+
+// Decode implements gopacket.Decoder
+func (d depthDecoder) Decode(data []byte, p gopacket.PacketBuilder) error {
+	return d.next.Decode(data, depthBuilder{PacketBuilder: p, depth: d.depth})
+}
+
+type depthBuilder struct {
+	gopacket.PacketBuilder
+	depth int
+}
+
+// NextDecoder overrides gopacket.PacketBuilder
+func (b depthBuilder) NextDecoder(next gopacket.Decoder) error {
+	if next == nil {
+		return b.PacketBuilder.NextDecoder(next)
+	}
+	// ipv6 extension headers don't count as a layer
+	if isIPv6Extension(next) {
+		return b.PacketBuilder.NextDecoder(depthDecoder{next: next, depth: b.depth})
+	}
+	if b.depth <= 1 {
+		return b.PacketBuilder.NextDecoder(gopacket.LayerTypePayload)
+	}
+	return b.PacketBuilder.NextDecoder(depthDecoder{next: next, depth: b.depth - 1})
+}
+
+// isIPv6Extension returns true if the decoder is an ipv6 extension header,
+// the ipv6 layer passes the layer type and extension headers pass the ip
+// protocol of the next header
+func isIPv6Extension(d gopacket.Decoder) bool {
+	switch d {
+	case layers.LayerTypeIPv6HopByHop, layers.LayerTypeIPv6Routing,
+		layers.LayerTypeIPv6Fragment, layers.LayerTypeIPv6Destination,
+		layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing,
+		layers.IPProtocolIPv6Fragment, layers.IPProtocolIPv6Destination:
+		return true
+	}
+	return false
+}
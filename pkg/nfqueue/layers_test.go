@@ -0,0 +1,131 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestDecodeDepth(t *testing.T) {
+	var tests = []struct {
+		name     string
+		required []gopacket.LayerType
+		want     int
+		copy     uint32
+	}{
+		{"none", nil, depthFull, DefaultCopyRange},
+		{"network", []gopacket.LayerType{layers.LayerTypeIPv4, layers.LayerTypeIPv6}, depthNetwork, copyRangeNetwork},
+		{"transport", []gopacket.LayerType{layers.LayerTypeIPv4, layers.LayerTypeTCP}, depthTransport, copyRangeTransport},
+		{"icmp", []gopacket.LayerType{layers.LayerTypeICMPv6}, depthTransport, copyRangeTransport},
+		{"application", []gopacket.LayerType{layers.LayerTypeUDP, layers.LayerTypeDNS}, depthFull, DefaultCopyRange},
+		{"payload", []gopacket.LayerType{gopacket.LayerTypePayload}, depthFull, DefaultCopyRange},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := decodeDepth(test.required)
+			if got != test.want {
+				t.Errorf("decodeDepth() = %v, want %v", got, test.want)
+			}
+			if c := copyRange(got); c != test.copy {
+				t.Errorf("copyRange(%v) = %v, want %v", got, c, test.copy)
+			}
+		})
+	}
+}
+
+func TestIPLayerType(t *testing.T) {
+	var tests = []struct {
+		data []byte
+		want gopacket.LayerType
+	}{
+		{[]byte{0x45}, layers.LayerTypeIPv4},
+		{[]byte{0x60}, layers.LayerTypeIPv6},
+		{[]byte{0x00}, layers.LayerTypeIPv4},
+		{nil, layers.LayerTypeIPv4},
+	}
+	for _, test := range tests {
+		if got := ipLayerType(test.data); got != test.want {
+			t.Errorf("ipLayerType(%x) = %v, want %v", test.data, got, test.want)
+		}
+	}
+}
+
+func destOptions(next layers.IPProtocol, size int) *layers.IPv6Destination {
+	dst := &layers.IPv6Destination{}
+	dst.NextHeader = next
+	dst.Options = []*layers.IPv6DestinationOption{
+		{OptionType: 0x1e, OptionData: make([]byte, size)},
+	}
+	return dst
+}
+
+func TestDepthDecoder(t *testing.T) {
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	udp := &layers.UDP{SrcPort: 1024, DstPort: 8080}
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	ip6ext := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Destination, SrcIP: src, DstIP: dst}
+
+	var tests = []struct {
+		name  string
+		ls    []gopacket.SerializableLayer
+		depth int
+		want  []gopacket.LayerType
+	}{
+		{"ipv4 network",
+			[]gopacket.SerializableLayer{ip4, udp, gopacket.Payload("data")},
+			depthNetwork,
+			[]gopacket.LayerType{layers.LayerTypeIPv4, gopacket.LayerTypePayload}},
+		{"ipv4 transport",
+			[]gopacket.SerializableLayer{ip4, udp, gopacket.Payload("data")},
+			depthTransport,
+			[]gopacket.LayerType{layers.LayerTypeIPv4, layers.LayerTypeUDP, gopacket.LayerTypePayload}},
+		{"ipv6 network",
+			[]gopacket.SerializableLayer{ip6, udp, gopacket.Payload("data")},
+			depthNetwork,
+			[]gopacket.LayerType{layers.LayerTypeIPv6, gopacket.LayerTypePayload}},
+		{"ipv6 extensions network",
+			[]gopacket.SerializableLayer{ip6ext, destOptions(layers.IPProtocolIPv6Destination, 200),
+				destOptions(layers.IPProtocolUDP, 200), udp, gopacket.Payload("data")},
+			depthNetwork,
+			[]gopacket.LayerType{layers.LayerTypeIPv6, layers.LayerTypeIPv6Destination,
+				layers.LayerTypeIPv6Destination, gopacket.LayerTypePayload}},
+		{"ipv6 extensions transport",
+			[]gopacket.SerializableLayer{ip6ext, destOptions(layers.IPProtocolUDP, 200), udp, gopacket.Payload("data")},
+			depthTransport,
+			[]gopacket.LayerType{layers.LayerTypeIPv6, layers.LayerTypeIPv6Destination,
+				layers.LayerTypeUDP, gopacket.LayerTypePayload}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := gopacket.NewSerializeBuffer()
+			udp.SetNetworkLayerForChecksum(test.ls[0].(gopacket.NetworkLayer))
+			opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+			if err := gopacket.SerializeLayers(buf, opts, test.ls...); err != nil {
+				t.Fatalf("serializing layers: %v", err)
+			}
+			data := buf.Bytes()
+			// packet is truncated to the copy range of the depth
+			if max := int(copyRange(test.depth)); len(data) > max {
+				data = data[:max]
+			}
+			packet := gopacket.NewPacket(data, newDecoder(ipLayerType(data), test.depth), gopacket.Default)
+			if err := packet.ErrorLayer(); err != nil {
+				t.Fatalf("decoding packet: %v", err.Error())
+			}
+			var got []gopacket.LayerType
+			for _, l := range packet.Layers() {
+				got = append(got, l.LayerType())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("layers = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"errors"
+
+	"github.com/google/gopacket"
+)
+
+// checksumLayer is implemented by transport layers with pseudo-header checksums
+type checksumLayer interface {
+	SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+}
+
+// SerializePacket returns the payload of a modified packet, recomputing
+// lengths and checksums. Layers that are not serializable are copied raw
+// with its payload, so only the layers before them can be mangled.
+func SerializePacket(packet gopacket.Packet) ([]byte, error) {
+	netLayer := packet.NetworkLayer()
+	if netLayer == nil {
+		return nil, errors.New("network layer not found")
+	}
+	sls := make([]gopacket.SerializableLayer, 0, len(packet.Layers()))
+	for _, layer := range packet.Layers() {
+		sl, ok := layer.(gopacket.SerializableLayer)
+		if !ok {
+			raw := make([]byte, 0, len(layer.LayerContents())+len(layer.LayerPayload()))
+			raw = append(raw, layer.LayerContents()...)
+			raw = append(raw, layer.LayerPayload()...)
+			sls = append(sls, gopacket.Payload(raw))
+			break
+		}
+		if cl, ok := layer.(checksumLayer); ok {
+			err := cl.SetNetworkLayerForChecksum(netLayer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sls = append(sls, sl)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, sls...)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
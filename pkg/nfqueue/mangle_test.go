@@ -0,0 +1,116 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+)
+
+func serializeLayers(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	for _, l := range ls {
+		if tl, ok := l.(interface {
+			SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+		}); ok {
+			tl.SetNetworkLayerForChecksum(ls[0].(gopacket.NetworkLayer))
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, ls...)
+	if err != nil {
+		t.Fatalf("serializing layers: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func ipv4Layer(proto layers.IPProtocol, ttl uint8) *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		TTL:      ttl,
+		Protocol: proto,
+		SrcIP:    net.ParseIP("10.0.0.1"),
+		DstIP:    net.ParseIP("10.0.0.2"),
+	}
+}
+
+func ipv6Layer(proto layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: proto,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+}
+
+func TestSerializePacket(t *testing.T) {
+	esp := []byte{0, 0, 0, 1, 0, 0, 0, 2, 0xca, 0xfe, 0xca, 0xfe}
+	var tests = []struct {
+		name   string
+		first  gopacket.LayerType
+		data   []byte
+		mangle func(gopacket.Packet)
+		want   []byte
+	}{
+		{"ipv4 ttl",
+			layers.LayerTypeIPv4,
+			serializeLayers(t, ipv4Layer(layers.IPProtocolUDP, 64), &layers.UDP{SrcPort: 1024, DstPort: 8080}, gopacket.Payload("query")),
+			func(p gopacket.Packet) {
+				p.Layer(layers.LayerTypeIPv4).(*layers.IPv4).TTL = 1
+			},
+			serializeLayers(t, ipv4Layer(layers.IPProtocolUDP, 1), &layers.UDP{SrcPort: 1024, DstPort: 8080}, gopacket.Payload("query"))},
+		{"udp port and checksum",
+			layers.LayerTypeIPv4,
+			serializeLayers(t, ipv4Layer(layers.IPProtocolUDP, 64), &layers.UDP{SrcPort: 1024, DstPort: 8080}, gopacket.Payload("query")),
+			func(p gopacket.Packet) {
+				p.Layer(layers.LayerTypeUDP).(*layers.UDP).DstPort = 8081
+			},
+			serializeLayers(t, ipv4Layer(layers.IPProtocolUDP, 64), &layers.UDP{SrcPort: 1024, DstPort: 8081}, gopacket.Payload("query"))},
+		{"ipv6 tcp payload length",
+			layers.LayerTypeIPv6,
+			serializeLayers(t, ipv6Layer(layers.IPProtocolTCP), &layers.TCP{SrcPort: 1024, DstPort: 80, Window: 1024}, gopacket.Payload("GET")),
+			func(p gopacket.Packet) {
+				app := p.Layer(gopacket.LayerTypePayload).(*gopacket.Payload)
+				*app = gopacket.Payload("GET / HTTP/1.1")
+			},
+			serializeLayers(t, ipv6Layer(layers.IPProtocolTCP), &layers.TCP{SrcPort: 1024, DstPort: 80, Window: 1024}, gopacket.Payload("GET / HTTP/1.1"))},
+		{"not serializable copied raw",
+			layers.LayerTypeIPv4,
+			serializeLayers(t, ipv4Layer(layers.IPProtocolESP, 64), gopacket.Payload(esp)),
+			func(p gopacket.Packet) {
+				p.Layer(layers.LayerTypeIPv4).(*layers.IPv4).TTL = 10
+			},
+			serializeLayers(t, ipv4Layer(layers.IPProtocolESP, 10), gopacket.Payload(esp))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := gopacket.NewPacket(test.data, test.first, gopacket.Default)
+			if err := packet.ErrorLayer(); err != nil {
+				t.Fatalf("decoding packet: %v", err.Error())
+			}
+			test.mangle(packet)
+			got, err := nfqueue.SerializePacket(packet)
+			if err != nil {
+				t.Fatalf("SerializePacket() err = %v", err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("SerializePacket() = %x, want %x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSerializePacketErrors(t *testing.T) {
+	packet := gopacket.NewPacket([]byte("not an ip packet"), gopacket.LayerTypePayload, gopacket.Default)
+	if _, err := nfqueue.SerializePacket(packet); err == nil {
+		t.Error("SerializePacket() without network layer: expected error")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	nfq "github.com/florianl/go-nfqueue"
+)
+
+// Metadata stores the netfilter information of a queued packet
+type Metadata struct {
+	// QID is the queue id
+	QID int
+	// PacketID is the netfilter packet id
+	PacketID uint32
+	// Timestamp is the kernel timestamp or the reception time if kernel
+	// didn't provide it
+	Timestamp time.Time
+	// Hook is the netfilter hook
+	Hook uint8
+	// HwProtocol is the link layer protocol
+	HwProtocol uint16
+	// InDev, OutDev, PhysInDev and PhysOutDev store interface indexes,
+	// zero if not available
+	InDev, OutDev, PhysInDev, PhysOutDev uint32
+	// InIface and OutIface store the interface names
+	InIface, OutIface string
+	// Mark is the packet mark
+	Mark uint32
+	// HasCtInfo is true if CtInfo is available
+	HasCtInfo bool
+	// CtInfo is the conntrack info
+	CtInfo uint32
+	// Conntrack stores the connection tracking information, nil if it's
+	// not available
+	Conntrack *Conntrack
+	// HwAddr is the source hardware address
+	HwAddr net.HardwareAddr
+	// HasOwner is true if packet was generated by a local socket and UID
+	// and GID are available
+	HasOwner bool
+	// UID and GID of the socket owner
+	UID, GID uint32
+	// Plugin and Action that returned the verdict, they are set by the
+	// hooks runners
+	Plugin, Action string
+	// WouldBe is the verdict not applied because of the monitor mode and
+	// WouldBePlugin and WouldBeAction returned it, Default if none
+	WouldBe                      Verdict
+	WouldBePlugin, WouldBeAction string
+
+	// verdict held by the strategy while the remaining hooks run
+	held                   Verdict
+	heldPlugin, heldAction string
+
+	async     *asyncPacket
+	collector Collector
+	switches  *Switches
+	trace     *Trace
+	flow      *Flow
+	flowReply bool
+}
+
+func newMetadata(qid int, a nfq.Attribute, ifaces *ifaceCache) (*Metadata, error) {
+	var err error
+	md := &Metadata{QID: qid}
+	if a.PacketID != nil {
+		md.PacketID = *a.PacketID
+	}
+	if a.Timestamp != nil {
+		md.Timestamp = *a.Timestamp
+	} else {
+		md.Timestamp = time.Now()
+	}
+	if a.Hook != nil {
+		md.Hook = *a.Hook
+	}
+	if a.HwProtocol != nil {
+		md.HwProtocol = *a.HwProtocol
+	}
+	if a.InDev != nil {
+		md.InDev = *a.InDev
+		md.InIface = ifaces.name(md.InDev)
+	}
+	if a.OutDev != nil {
+		md.OutDev = *a.OutDev
+		md.OutIface = ifaces.name(md.OutDev)
+	}
+	if a.PhysInDev != nil {
+		md.PhysInDev = *a.PhysInDev
+	}
+	if a.PhysOutDev != nil {
+		md.PhysOutDev = *a.PhysOutDev
+	}
+	if a.Mark != nil {
+		md.Mark = *a.Mark
+	}
+	if a.CtInfo != nil {
+		md.HasCtInfo = true
+		md.CtInfo = *a.CtInfo
+		var ctdata []byte
+		if a.Ct != nil {
+			ctdata = *a.Ct
+		}
+		md.Conntrack, err = newConntrack(md.CtInfo, ctdata)
+	}
+	if a.HwAddr != nil {
+		md.HwAddr = net.HardwareAddr(append([]byte(nil), *a.HwAddr...))
+	}
+	if a.UID != nil && a.GID != nil {
+		md.HasOwner = true
+		md.UID, md.GID = *a.UID, *a.GID
+	}
+	return md, err
+}
+
+// IfaceCacheTTL sets the time the interface names are cached
+var IfaceCacheTTL = time.Minute
+
+// ifaceCache resolves interface names from indexes
+type ifaceCache struct {
+	mu      sync.RWMutex
+	names   map[uint32]string
+	updated time.Time
+}
+
+func newIfaceCache() *ifaceCache {
+	return &ifaceCache{names: make(map[uint32]string)}
+}
+
+func (c *ifaceCache) name(idx uint32) string {
+	c.mu.RLock()
+	name, ok := c.names[idx]
+	expired := time.Since(c.updated) > IfaceCacheTTL
+	c.mu.RUnlock()
+	if ok && !expired {
+		return name
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !expired {
+		// not found, check if it was added by other goroutine
+		if name, ok := c.names[idx]; ok {
+			return name
+		}
+	}
+	c.refresh()
+	name, ok = c.names[idx]
+	if !ok {
+		// cache misses until next refresh
+		c.names[idx] = ""
+	}
+	return name
+}
+
+func (c *ifaceCache) refresh() {
+	c.updated = time.Now()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	names := make(map[uint32]string, len(ifaces))
+	for _, iface := range ifaces {
+		names[uint32(iface.Index)] = iface.Name
+	}
+	c.names = names
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	nfq "github.com/florianl/go-nfqueue"
+)
+
+func TestNewMetadata(t *testing.T) {
+	u8 := func(v uint8) *uint8 { return &v }
+	u16 := func(v uint16) *uint16 { return &v }
+	u32 := func(v uint32) *uint32 { return &v }
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	hwaddr := []byte{0, 1, 2, 3, 4, 5}
+	// index and name of an existing interface, if any
+	var ifIndex uint32 = 0xfffffff
+	var ifName string
+	if ifaces, err := net.Interfaces(); err == nil && len(ifaces) > 0 {
+		ifIndex, ifName = uint32(ifaces[0].Index), ifaces[0].Name
+	}
+
+	var tests = []struct {
+		name    string
+		a       nfq.Attribute
+		want    Metadata
+		wantCt  *Conntrack
+		wantErr bool
+	}{
+		{"empty",
+			nfq.Attribute{PacketID: u32(1)},
+			Metadata{QID: 5, PacketID: 1},
+			nil, false},
+		{"all",
+			nfq.Attribute{
+				PacketID:   u32(2),
+				Timestamp:  &ts,
+				Hook:       u8(1),
+				HwProtocol: u16(0x0800),
+				InDev:      u32(ifIndex),
+				OutDev:     u32(0xffffffe),
+				PhysInDev:  u32(3),
+				PhysOutDev: u32(4),
+				Mark:       u32(0x10),
+				HwAddr:     &hwaddr,
+				UID:        u32(1000),
+				GID:        u32(100),
+			},
+			Metadata{
+				QID: 5, PacketID: 2, Timestamp: ts, Hook: 1, HwProtocol: 0x0800,
+				InDev: ifIndex, OutDev: 0xffffffe, PhysInDev: 3, PhysOutDev: 4,
+				InIface: ifName, Mark: 0x10, HwAddr: hwaddr,
+				HasOwner: true, UID: 1000, GID: 100,
+			},
+			nil, false},
+		{"uid without gid",
+			nfq.Attribute{PacketID: u32(3), UID: u32(1000)},
+			Metadata{QID: 5, PacketID: 3},
+			nil, false},
+		{"ctinfo without ct",
+			nfq.Attribute{PacketID: u32(4), CtInfo: u32(ipCtEstablishedReply)},
+			Metadata{QID: 5, PacketID: 4, HasCtInfo: true, CtInfo: ipCtEstablishedReply},
+			&Conntrack{State: CtEstablished, IsReply: true}, false},
+		{"bad ct",
+			nfq.Attribute{PacketID: u32(5), CtInfo: u32(ipCtNew), Ct: &[]byte{0xff}},
+			Metadata{QID: 5, PacketID: 5, HasCtInfo: true, CtInfo: ipCtNew},
+			&Conntrack{State: CtNew}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := time.Now()
+			md, err := newMetadata(5, test.a, newIfaceCache())
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newMetadata() err = %v, wantErr %v", err, test.wantErr)
+			}
+			if md == nil {
+				t.Fatal("newMetadata() = nil")
+			}
+			if test.a.Timestamp == nil {
+				// reception time is used
+				if md.Timestamp.Before(before) || md.Timestamp.After(time.Now()) {
+					t.Errorf("Timestamp = %v, want reception time", md.Timestamp)
+				}
+				md.Timestamp = time.Time{}
+			}
+			got := *md
+			if (got.Conntrack == nil) != (test.wantCt == nil) {
+				t.Fatalf("Conntrack = %v, want %v", got.Conntrack, test.wantCt)
+			}
+			if got.Conntrack != nil && (got.Conntrack.State != test.wantCt.State || got.Conntrack.IsReply != test.wantCt.IsReply) {
+				t.Errorf("Conntrack = %+v, want %+v", got.Conntrack, test.wantCt)
+			}
+			got.Conntrack = nil
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("newMetadata() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+	// hardware address is copied from the netlink buffer
+	a := nfq.Attribute{PacketID: u32(1), HwAddr: &hwaddr}
+	md, _ := newMetadata(1, a, newIfaceCache())
+	hwaddr[0] = 0xff
+	if md.HwAddr[0] != 0 {
+		t.Errorf("HwAddr = %v, not copied", md.HwAddr)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+// Package metrics implements a collector of the packet processing that
+// exports prometheus metrics.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+)
+
+// Namespace used in metric names
+const Namespace = "lunfqueue"
+
+// Collector implements nfqueue.Collector and prometheus.Collector
+type Collector struct {
+	received *prometheus.CounterVec
+	decoded  *prometheus.CounterVec
+	verdicts *prometheus.CounterVec
+	hooks    *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	backlog  *prometheus.GaugeVec
+	monitor  *prometheus.CounterVec
+}
+
+// New returns a new collector, it must be registered in a prometheus
+// registry.
+func New() *Collector {
+	return &Collector{
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "packets_received_total",
+			Help:      "Total number of packets received from the queue.",
+		}, []string{"qid"}),
+		decoded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "packets_decoded_total",
+			Help:      "Total number of packets decoded by result.",
+		}, []string{"qid", "result"}),
+		verdicts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "verdicts_total",
+			Help:      "Total number of verdicts set by value.",
+		}, []string{"qid", "verdict"}),
+		hooks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "hooks_total",
+			Help:      "Total number of packet hooks executed by plugin and action.",
+		}, []string{"plugin", "action", "verdict"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "hook_duration_seconds",
+			Help:      "Latency of the packet hooks by plugin and action.",
+			Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		}, []string{"plugin", "action"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "errors_total",
+			Help:      "Total number of errors by processing stage.",
+		}, []string{"qid", "stage"}),
+		backlog: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "backlog",
+			Help:      "Number of packets waiting for a verdict.",
+		}, []string{"qid"}),
+		monitor: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "monitor_verdicts_total",
+			Help:      "Total number of verdicts not applied because of the monitor mode.",
+		}, []string{"qid", "plugin", "action", "verdict"}),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.received.Describe(ch)
+	c.decoded.Describe(ch)
+	c.verdicts.Describe(ch)
+	c.hooks.Describe(ch)
+	c.latency.Describe(ch)
+	c.errors.Describe(ch)
+	c.backlog.Describe(ch)
+	c.monitor.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.received.Collect(ch)
+	c.decoded.Collect(ch)
+	c.verdicts.Collect(ch)
+	c.hooks.Collect(ch)
+	c.latency.Collect(ch)
+	c.errors.Collect(ch)
+	c.backlog.Collect(ch)
+	c.monitor.Collect(ch)
+}
+
+// PacketReceived implements nfqueue.Collector
+func (c *Collector) PacketReceived(qid int) {
+	c.received.WithLabelValues(strconv.Itoa(qid)).Inc()
+}
+
+// PacketDecoded implements nfqueue.Collector
+func (c *Collector) PacketDecoded(qid int, ok bool) {
+	result := "ok"
+	if !ok {
+		result = "failed"
+	}
+	c.decoded.WithLabelValues(strconv.Itoa(qid), result).Inc()
+}
+
+// Verdict implements nfqueue.Collector
+func (c *Collector) Verdict(qid int, v nfqueue.Verdict) {
+	c.verdicts.WithLabelValues(strconv.Itoa(qid), v.Kind().String()).Inc()
+}
+
+// Hook implements nfqueue.Collector
+func (c *Collector) Hook(qid int, plugin, action string, v nfqueue.Verdict, elapsed time.Duration) {
+	c.hooks.WithLabelValues(plugin, action, v.Kind().String()).Inc()
+	c.latency.WithLabelValues(plugin, action).Observe(elapsed.Seconds())
+}
+
+// Error implements nfqueue.Collector
+func (c *Collector) Error(qid int, stage string) {
+	c.errors.WithLabelValues(strconv.Itoa(qid), stage).Inc()
+}
+
+// Backlog implements nfqueue.Collector
+func (c *Collector) Backlog(qid int, delta int) {
+	c.backlog.WithLabelValues(strconv.Itoa(qid)).Add(float64(delta))
+}
+
+// Monitor implements nfqueue.Collector
+func (c *Collector) Monitor(qid int, plugin, action string, v nfqueue.Verdict) {
+	c.monitor.WithLabelValues(strconv.Itoa(qid), plugin, action, v.Kind().String()).Inc()
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"context"
+	"encoding/binary"
+
+	nfq "github.com/florianl/go-nfqueue"
+	"github.com/mdlayher/netlink"
+)
+
+// netlink constants not exported by go-nfqueue
+const (
+	nfnlSubSysQueue = 0x03
+	nfQnlMsgVerdict = 1
+	nfnetlinkV0     = 0
+	nfQaVerdictHdr  = 2
+	nfQaMark        = 3
+	nfQaPayload     = 10
+	nfQaCt          = 11
+	ctaMark         = 8
+	nlaFNested      = 0x8000
+	nfQueueNumShift = 16
+	afUnspec        = 0
+)
+
+// Netlink is the interface of a connection to a netfilter queue
+type Netlink interface {
+	// Register starts receiving packets, fn is called for each packet
+	// until ctx is cancelled
+	Register(ctx context.Context, fn nfq.HookFunc) error
+	// SetVerdict sets the verdict of the packet with id, if payload is not
+	// nil it replaces the packet
+	SetVerdict(id uint32, v Verdict, payload []byte) error
+	// Close the connection
+	Close() error
+}
+
+// OpenNetlinkFn defines functions that open connections to netfilter queues
+type OpenNetlinkFn func(cfg *nfq.Config) (Netlink, error)
+
+// OpenNetlink opens a connection to the netfilter queue of the kernel
+func OpenNetlink(cfg *nfq.Config) (Netlink, error) {
+	nl, err := nfq.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &kernelNetlink{nl: nl, qid: cfg.NfQueue}, nil
+}
+
+// kernelNetlink implements Netlink using go-nfqueue
+type kernelNetlink struct {
+	nl  *nfq.Nfqueue
+	qid uint16
+}
+
+// Register implements Netlink
+func (k *kernelNetlink) Register(ctx context.Context, fn nfq.HookFunc) error {
+	return k.nl.Register(ctx, fn)
+}
+
+// SetVerdict implements Netlink
+func (k *kernelNetlink) SetVerdict(id uint32, v Verdict, payload []byte) error {
+	return sendVerdict(k.nl, k.qid, id, v, payload)
+}
+
+// Close implements Netlink
+func (k *kernelNetlink) Close() error {
+	return k.nl.Close()
+}
+
+// sendVerdict sends a verdict message to the kernel. go-nfqueue only
+// supports plain verdicts, so the message is built here to be able to
+// pass the queue number, packet mark, connection mark and the modified
+// payload (if not nil).
+func sendVerdict(nl *nfq.Nfqueue, qid uint16, id uint32, v Verdict, payload []byte) error {
+	attrs, err := verdictAttrs(id, v, payload)
+	if err != nil {
+		return err
+	}
+	req, err := verdictMsg(qid, attrs)
+	if err != nil {
+		return err
+	}
+	_, err = nl.Con.Send(req)
+	return err
+}
+
+// verdictAttrs returns the attributes of the verdict message
+func verdictAttrs(id uint32, v Verdict, payload []byte) ([]netlink.Attribute, error) {
+	code := uint32(toNfqVerdict(v))
+	if qnum, ok := v.QueueNum(); ok {
+		code |= uint32(qnum) << nfQueueNumShift
+	}
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr[0:4], code)
+	binary.BigEndian.PutUint32(hdr[4:8], id)
+	attrs := []netlink.Attribute{{Type: nfQaVerdictHdr, Data: hdr}}
+	if mark, ok := v.Mark(); ok {
+		attrs = append(attrs, netlink.Attribute{Type: nfQaMark, Data: be32(mark)})
+	}
+	if mark, ok := v.ConnMark(); ok {
+		ct, err := netlink.MarshalAttributes([]netlink.Attribute{{Type: ctaMark, Data: be32(mark)}})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, netlink.Attribute{Type: nfQaCt | nlaFNested, Data: ct})
+	}
+	if payload != nil {
+		attrs = append(attrs, netlink.Attribute{Type: nfQaPayload, Data: payload})
+	}
+	return attrs, nil
+}
+
+// verdictMsg returns the netlink message with the verdict attributes
+func verdictMsg(qid uint16, attrs []netlink.Attribute) (netlink.Message, error) {
+	cmd, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	data := make([]byte, 4, 4+len(cmd))
+	data[0] = afUnspec
+	data[1] = nfnetlinkV0
+	binary.BigEndian.PutUint16(data[2:4], qid)
+	data = append(data, cmd...)
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((nfnlSubSysQueue << 8) | nfQnlMsgVerdict),
+			Flags: netlink.Request,
+		},
+		Data: data,
+	}, nil
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	nfq "github.com/florianl/go-nfqueue"
+	"github.com/mdlayher/netlink"
+)
+
+func TestVerdictAttrs(t *testing.T) {
+	payload := []byte{0x45, 0x00, 0x00, 0x14}
+	var tests = []struct {
+		name     string
+		v        Verdict
+		payload  []byte
+		code     uint32
+		mark     []byte
+		connmark []byte
+	}{
+		{"accept", Accept, nil, nfq.NfAccept, nil, nil},
+		{"drop", Drop, nil, nfq.NfDrop, nil, nil},
+		{"repeat", Repeat, nil, nfq.NfRepeat, nil, nil},
+		{"queue", QueueTo(0x1234), nil, nfq.NfQeueue | 0x1234<<16, nil, nil},
+		{"mark", Accept.WithMark(0x80000001), nil, nfq.NfAccept, []byte{0x80, 0, 0, 1}, nil},
+		{"connmark", Repeat.WithConnMark(0xff), nil, nfq.NfRepeat, nil, []byte{0, 0, 0, 0xff}},
+		{"payload", Accept, payload, nfq.NfAccept, nil, nil},
+		{"empty payload", Accept, []byte{}, nfq.NfAccept, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attrs, err := verdictAttrs(42, test.v, test.payload)
+			if err != nil {
+				t.Fatalf("verdictAttrs() err = %v", err)
+			}
+			msg, err := verdictMsg(7, attrs)
+			if err != nil {
+				t.Fatalf("verdictMsg() err = %v", err)
+			}
+			if msg.Header.Type != netlink.HeaderType(nfnlSubSysQueue<<8|nfQnlMsgVerdict) {
+				t.Errorf("message type = %#x", msg.Header.Type)
+			}
+			// nfgenmsg header with queue number in network byte order
+			if len(msg.Data) < 4 || !bytes.Equal(msg.Data[:4], []byte{afUnspec, nfnetlinkV0, 0, 7}) {
+				t.Fatalf("message header = %v", msg.Data)
+			}
+			got, err := netlink.UnmarshalAttributes(msg.Data[4:])
+			if err != nil {
+				t.Fatalf("unmarshal attributes: %v", err)
+			}
+			found := make(map[uint16][]byte)
+			for _, a := range got {
+				found[a.Type] = a.Data
+			}
+			hdr, ok := found[nfQaVerdictHdr]
+			if !ok || len(hdr) != 8 {
+				t.Fatalf("verdict header = %v", hdr)
+			}
+			if code := binary.BigEndian.Uint32(hdr[0:4]); code != test.code {
+				t.Errorf("verdict code = %#x, want %#x", code, test.code)
+			}
+			if id := binary.BigEndian.Uint32(hdr[4:8]); id != 42 {
+				t.Errorf("packet id = %v, want 42", id)
+			}
+			if mark, ok := found[nfQaMark]; ok != (test.mark != nil) || !bytes.Equal(mark, test.mark) {
+				t.Errorf("mark = %v, want %v", mark, test.mark)
+			}
+			ct, ok := found[nfQaCt|nlaFNested]
+			if ok != (test.connmark != nil) {
+				t.Fatalf("conntrack attribute = %v, want %v", ok, test.connmark != nil)
+			}
+			if ok {
+				nested, err := netlink.UnmarshalAttributes(ct)
+				if err != nil || len(nested) != 1 || nested[0].Type != ctaMark || !bytes.Equal(nested[0].Data, test.connmark) {
+					t.Errorf("conntrack attribute = %v %v, want mark %v", nested, err, test.connmark)
+				}
+			}
+			data, ok := found[nfQaPayload]
+			if ok != (test.payload != nil) || !bytes.Equal(data, test.payload) {
+				t.Errorf("payload = %v, want %v", data, test.payload)
+			}
+		})
+	}
+}
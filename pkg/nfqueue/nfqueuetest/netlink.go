@@ -0,0 +1,193 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+// Package nfqueuetest provides an in-memory netlink implementation for
+// testing packet processors and plugins without a kernel queue.
+package nfqueuetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	nfq "github.com/florianl/go-nfqueue"
+
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+)
+
+// VerdictsBuffer sets the size of the verdicts channel of the queues
+var VerdictsBuffer = 1024
+
+// Netlink opens in-memory queues, it can be used as nfqueue.OpenNetlinkFn
+// in processor configuration.
+type Netlink struct {
+	mu     sync.Mutex
+	queues map[uint16]*Queue
+	// OpenErr is returned when opening queues if not nil
+	OpenErr error
+}
+
+// New returns a new in-memory netlink
+func New() *Netlink {
+	return &Netlink{queues: make(map[uint16]*Queue)}
+}
+
+// Open implements nfqueue.OpenNetlinkFn
+func (n *Netlink) Open(cfg *nfq.Config) (nfqueue.Netlink, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.OpenErr != nil {
+		return nil, n.OpenErr
+	}
+	if q, ok := n.queues[cfg.NfQueue]; ok && !q.isClosed() {
+		return nil, errors.New("queue is opened")
+	}
+	q := &Queue{
+		cfg:      *cfg,
+		verdicts: make(chan Verdict, VerdictsBuffer),
+		closed:   make(chan struct{}),
+	}
+	n.queues[cfg.NfQueue] = q
+	return q, nil
+}
+
+// Queue returns the last opened queue with qid
+func (n *Netlink) Queue(qid uint16) (*Queue, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	q, ok := n.queues[qid]
+	return q, ok
+}
+
+// Verdict stores a verdict set by the processor
+type Verdict struct {
+	ID      uint32
+	Verdict nfqueue.Verdict
+	Payload []byte
+}
+
+// Queue is an in-memory netfilter queue
+type Queue struct {
+	cfg      nfq.Config
+	mu       sync.Mutex
+	fn       nfq.HookFunc
+	ctx      context.Context
+	lastID   uint32
+	verdicts chan Verdict
+	closed   chan struct{}
+	once     sync.Once
+	vErr     error
+}
+
+// Config returns the configuration used to open the queue
+func (q *Queue) Config() nfq.Config {
+	return q.cfg
+}
+
+// Register implements nfqueue.Netlink
+func (q *Queue) Register(ctx context.Context, fn nfq.HookFunc) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isClosed() {
+		return errors.New("queue is closed")
+	}
+	if q.fn != nil {
+		return errors.New("queue is registered")
+	}
+	q.fn, q.ctx = fn, ctx
+	return nil
+}
+
+// SetVerdict implements nfqueue.Netlink
+func (q *Queue) SetVerdict(id uint32, v nfqueue.Verdict, payload []byte) error {
+	if q.isClosed() {
+		return errors.New("queue is closed")
+	}
+	q.mu.Lock()
+	err := q.vErr
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if payload != nil {
+		data = make([]byte, len(payload))
+		copy(data, payload)
+	}
+	select {
+	case q.verdicts <- Verdict{ID: id, Verdict: v, Payload: data}:
+		return nil
+	default:
+		return errors.New("verdicts buffer is full")
+	}
+}
+
+// FailVerdicts makes that setting verdicts returns err, it's used for
+// simulating a broken netlink connection. A nil err restores it.
+func (q *Queue) FailVerdicts(err error) {
+	q.mu.Lock()
+	q.vErr = err
+	q.mu.Unlock()
+}
+
+// Close implements nfqueue.Netlink
+func (q *Queue) Close() error {
+	q.once.Do(func() { close(q.closed) })
+	return nil
+}
+
+// Closed returns a channel that is closed when the queue is closed
+func (q *Queue) Closed() <-chan struct{} {
+	return q.closed
+}
+
+func (q *Queue) isClosed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Verdicts returns the channel with the verdicts set by the processor
+func (q *Queue) Verdicts() <-chan Verdict {
+	return q.verdicts
+}
+
+// Inject queues the raw ip packet data and returns its packet id. The
+// payload is truncated to the copy range of the queue configuration.
+func (q *Queue) Inject(data []byte) (uint32, error) {
+	q.mu.Lock()
+	q.lastID++
+	id := q.lastID
+	q.mu.Unlock()
+	caplen := uint32(len(data))
+	if q.cfg.MaxPacketLen > 0 && uint32(len(data)) > q.cfg.MaxPacketLen {
+		data = data[:q.cfg.MaxPacketLen]
+	}
+	now := time.Now()
+	a := nfq.Attribute{PacketID: &id, Timestamp: &now, CapLen: &caplen}
+	if q.cfg.Copymode != nfq.NfQnlCopyMeta {
+		payload := make([]byte, len(data))
+		copy(payload, data)
+		a.Payload = &payload
+	}
+	return id, q.InjectAttribute(a)
+}
+
+// InjectAttribute queues the packet with the attributes, it's passed to
+// the registered function in the caller goroutine.
+func (q *Queue) InjectAttribute(a nfq.Attribute) error {
+	q.mu.Lock()
+	fn, ctx := q.fn, q.ctx
+	q.mu.Unlock()
+	if fn == nil {
+		return errors.New("queue is not registered")
+	}
+	if q.isClosed() || ctx.Err() != nil {
+		return errors.New("queue is closed")
+	}
+	fn(a)
+	return nil
+}
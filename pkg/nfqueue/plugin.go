@@ -18,6 +18,12 @@ type Plugin interface {
 	CleanUp()
 }
 
+// Prioritized is implemented by plugins with a priority in the packet
+// processing pipeline, hooks of plugins with lower priority run first
+type Prioritized interface {
+	Priority() int
+}
+
 // Action defines interface for actions (used by plugins)
 type Action interface {
 	// Name returns the name of the action instance
@@ -2,10 +2,30 @@
 
 package ipp
 
-import "github.com/luids-io/netfilter/pkg/nfqueue"
+import (
+	"fmt"
+
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+)
 
 // Action defines interface action
 type Action interface {
 	nfqueue.Action
 	Register(*Hooks)
 }
+
+// AsyncAction is implemented by actions that can defer the verdict of the
+// packets. Hooks of the actions that don't implement it or return false
+// must not defer verdicts.
+type AsyncAction interface {
+	Async() bool
+}
+
+// MonitorDesc returns the description of the verdict for logs if the action
+// is in monitor mode
+func MonitorDesc(monitor bool, v nfqueue.Verdict) string {
+	if !monitor {
+		return ""
+	}
+	return fmt.Sprintf(" (monitor: would be %v)", v)
+}
@@ -32,10 +32,19 @@ const (
 type Config struct {
 	Mode      Mode
 	LocalNets []*net.IPNet
+	// OnlyNew checks only packets of new connections (requires conntrack)
+	OnlyNew bool
+	// Original checks the addresses of the original conntrack tuple, so
+	// pre-NAT addresses are checked (requires conntrack)
+	Original bool
 	//rules
 	WhenListed   Rule
 	WhenUnlisted Rule
 	OnError      nfqueue.Verdict
+	// Async defers the verdict of the packet while checking
+	Async     bool
+	Timeout   time.Duration
+	OnTimeout nfqueue.Verdict
 }
 
 // Rule stores information
@@ -50,7 +59,7 @@ type Rule struct {
 // Mode sets mode for checking
 type Mode int
 
-//Available values
+// Available values
 const (
 	CheckBoth Mode = iota
 	CheckSrc
@@ -64,6 +73,11 @@ type Action struct {
 	unlisted  Rule
 	onError   nfqueue.Verdict
 	cmode     Mode
+	onlyNew   bool
+	original  bool
+	async     bool
+	timeout   time.Duration
+	onTimeout nfqueue.Verdict
 	checker   xlist.Checker
 	localnets []*net.IPNet
 	logger    yalogi.Logger
@@ -77,6 +91,11 @@ func New(aname string, c xlist.Checker, cfg Config, l yalogi.Logger) (*Action, e
 		unlisted:  cfg.WhenUnlisted,
 		onError:   cfg.OnError,
 		cmode:     cfg.Mode,
+		onlyNew:   cfg.OnlyNew,
+		original:  cfg.Original,
+		async:     cfg.Async,
+		timeout:   cfg.Timeout,
+		onTimeout: cfg.OnTimeout,
 		localnets: cfg.LocalNets,
 		checker:   c,
 		logger:    l,
@@ -89,6 +108,11 @@ func (a *Action) Name() string {
 	return a.name
 }
 
+// Async implements ipp.AsyncAction interface
+func (a *Action) Async() bool {
+	return a.async
+}
+
 // Class implements ipp.Action interface
 func (a *Action) Class() string {
 	return ActionClass
@@ -103,24 +127,67 @@ func (a *Action) PluginClass() string {
 func (a *Action) Register(hooks *ipp.Hooks) {
 	a.logger.Debugf("registering hooks %s", a.name)
 
-	hooks.OnPacketIPv4(func(packet gopacket.Packet, ip4 *layers.IPv4, ts time.Time) (nfqueue.Verdict, error) {
+	hooks.OnPacketIPv4(func(ctx context.Context, packet gopacket.Packet, ip4 *layers.IPv4, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
 		src, dst := ip4.NetworkFlow().Endpoints()
-		srcIP := net.IP(src.Raw())
-		dstIP := net.IP(dst.Raw())
-		return a.doCheck(srcIP, dstIP, xlist.IPv4)
+		srcIP, dstIP, ok := a.addresses(net.IP(src.Raw()), net.IP(dst.Raw()), md)
+		if !ok {
+			return nfqueue.Default, nil
+		}
+		return a.check(ctx, srcIP, dstIP, xlist.IPv4, md)
 	})
 
-	hooks.OnPacketIPv6(func(packet gopacket.Packet, ip6 *layers.IPv6, ts time.Time) (nfqueue.Verdict, error) {
+	hooks.OnPacketIPv6(func(ctx context.Context, packet gopacket.Packet, ip6 *layers.IPv6, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
 		src, dst := ip6.NetworkFlow().Endpoints()
-		srcIP := net.IP(src.Raw())
-		dstIP := net.IP(dst.Raw())
-		return a.doCheck(srcIP, dstIP, xlist.IPv6)
+		srcIP, dstIP, ok := a.addresses(net.IP(src.Raw()), net.IP(dst.Raw()), md)
+		if !ok {
+			return nfqueue.Default, nil
+		}
+		return a.check(ctx, srcIP, dstIP, xlist.IPv6, md)
 	})
 }
 
-func (a *Action) doCheck(src, dst net.IP, res xlist.Resource) (nfqueue.Verdict, error) {
+// addresses returns the addresses to check using conntrack information if
+// available, returns false if packet must not be checked
+func (a *Action) addresses(src, dst net.IP, md *nfqueue.Metadata) (net.IP, net.IP, bool) {
+	ct := md.Conntrack
+	if ct == nil {
+		return src, dst, true
+	}
+	if a.onlyNew && ct.State != nfqueue.CtNew {
+		return nil, nil, false
+	}
+	if a.original && ct.Original.SrcIP != nil {
+		if ct.IsReply {
+			return ct.Original.DstIP, ct.Original.SrcIP, true
+		}
+		return ct.Original.SrcIP, ct.Original.DstIP, true
+	}
+	return src, dst, true
+}
+
+// check defers the verdict and checks in background if async is enabled
+func (a *Action) check(ctx context.Context, src, dst net.IP, res xlist.Resource, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
+	monitor := md.ActionMonitored(a.name)
+	if a.async {
+		if resolve, ok := md.Defer(a.timeout, a.onTimeout); ok {
+			go func() {
+				v, err := a.doCheck(ctx, src, dst, res, monitor)
+				if err != nil {
+					a.logger.Warnf("%v", err)
+				}
+				resolve(v)
+			}()
+			return nfqueue.Pending, nil
+		}
+	}
+	return a.doCheck(ctx, src, dst, res, monitor)
+}
+
+// doCheck checks the addresses and applies the rule, if monitor is true
+// the verdict will not be applied and it's included in the event
+func (a *Action) doCheck(ctx context.Context, src, dst net.IP, res xlist.Resource, monitor bool) (nfqueue.Verdict, error) {
 	// check ips in xlist
-	resp, err := a.checkIPs(src, dst, res)
+	resp, err := a.checkIPs(ctx, src, dst, res)
 	if err != nil {
 		return a.onError, fmt.Errorf("%s: check %v: %v", a.name, resp.ip, err)
 	}
@@ -137,7 +204,7 @@ func (a *Action) doCheck(src, dst net.IP, res xlist.Resource) (nfqueue.Verdict,
 	}
 	// do rule
 	if rule.Log {
-		a.logger.Infof("%s: %v->%v %v %+v", a.name, src, dst, resp.ip, resp.r)
+		a.logger.Infof("%s: %v->%v %v %+v%s", a.name, src, dst, resp.ip, resp.r, ipp.MonitorDesc(monitor, rule.Verdict))
 	}
 	if rule.EventRaise {
 		ecode := NetListedIP
@@ -149,6 +216,10 @@ func (a *Action) doCheck(src, dst net.IP, res xlist.Resource) (nfqueue.Verdict,
 		e.Set("reason", reason.Clean(resp.r.Reason))
 		e.Set("srcip", src.String())
 		e.Set("dstip", dst.String())
+		if monitor {
+			e.Set("monitor", true)
+			e.Set("wouldbe", rule.Verdict.String())
+		}
 		event.Notify(e)
 	}
 	return rule.Verdict, nil
@@ -159,18 +230,18 @@ type response struct {
 	r  xlist.Response
 }
 
-func (a *Action) checkIPs(src, dst net.IP, res xlist.Resource) (response, error) {
+func (a *Action) checkIPs(ctx context.Context, src, dst net.IP, res xlist.Resource) (response, error) {
 	var err error
 	var resp response
 	if (a.cmode == CheckSrc || a.cmode == CheckBoth) && !a.isLocal(src) {
-		resp.r, err = a.checker.Check(context.Background(), src.String(), res)
+		resp.r, err = a.checker.Check(ctx, src.String(), res)
 		if resp.r.Result || err != nil {
 			resp.ip = src
 			return resp, err
 		}
 	}
 	if (a.cmode == CheckDst || a.cmode == CheckBoth) && !a.isLocal(dst) {
-		resp.r, err = a.checker.Check(context.Background(), dst.String(), res)
+		resp.r, err = a.checker.Check(ctx, dst.String(), res)
 		if resp.r.Result {
 			resp.ip = dst
 		}
@@ -92,6 +92,21 @@ func getConfig(b *builder.Builder, def builder.ActionDef) (Config, error) {
 				return cfg, err
 			}
 		}
+		cfg.OnlyNew, _, err = option.Bool(def.Opts, "onlynew")
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Original, _, err = option.Bool(def.Opts, "original")
+		if err != nil {
+			return cfg, err
+		}
+		if (cfg.OnlyNew || cfg.Original) && !b.Conntrack() {
+			return cfg, errors.New("'onlynew' and 'original' require conntrack enabled in queues")
+		}
+		cfg.Async, cfg.Timeout, cfg.OnTimeout, err = ipp.AsyncOpts(def.Opts)
+		if err != nil {
+			return cfg, err
+		}
 	}
 	return cfg, nil
 }
@@ -36,6 +36,10 @@ type Config struct {
 	WhenResolved   Rule
 	WhenUnresolved Rule
 	OnError        nfqueue.Verdict
+	// Async defers the verdict of the packet while checking
+	Async     bool
+	Timeout   time.Duration
+	OnTimeout nfqueue.Verdict
 }
 
 // Rule stores information
@@ -52,6 +56,9 @@ type Action struct {
 	resolved   Rule
 	unresolved Rule
 	onError    nfqueue.Verdict
+	async      bool
+	timeout    time.Duration
+	onTimeout  nfqueue.Verdict
 	checkers   []dnsutil.ResolvChecker
 	localnets  []*net.IPNet
 	logger     yalogi.Logger
@@ -64,6 +71,9 @@ func New(aname string, checkers []dnsutil.ResolvChecker, cfg Config, l yalogi.Lo
 		resolved:   cfg.WhenResolved,
 		unresolved: cfg.WhenUnresolved,
 		onError:    cfg.OnError,
+		async:      cfg.Async,
+		timeout:    cfg.Timeout,
+		onTimeout:  cfg.OnTimeout,
 		localnets:  cfg.LocalNets,
 		checkers:   checkers,
 		logger:     l,
@@ -76,6 +86,11 @@ func (a *Action) Name() string {
 	return a.name
 }
 
+// Async implements ipp.AsyncAction interface
+func (a *Action) Async() bool {
+	return a.async
+}
+
 // Class implements ipp.Action interface
 func (a *Action) Class() string {
 	return ActionClass
@@ -90,36 +105,56 @@ func (a *Action) PluginClass() string {
 func (a *Action) Register(hooks *ipp.Hooks) {
 	a.logger.Debugf("registering hooks %s", a.name)
 
-	hooks.OnPacketIPv4(func(packet gopacket.Packet, ip4 *layers.IPv4, ts time.Time) (nfqueue.Verdict, error) {
+	hooks.OnPacketIPv4(func(ctx context.Context, packet gopacket.Packet, ip4 *layers.IPv4, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
 		src, dst := ip4.NetworkFlow().Endpoints()
 		srcIP := net.IP(src.Raw())
 		dstIP := net.IP(dst.Raw())
 		if !a.isLocal(srcIP) && a.isLocal(dstIP) {
-			return a.doCheck(srcIP, dstIP, dstIP, srcIP)
+			return a.check(ctx, srcIP, dstIP, dstIP, srcIP, md)
 		}
 		if !a.isLocal(dstIP) && a.isLocal(srcIP) {
-			return a.doCheck(srcIP, dstIP, srcIP, dstIP)
+			return a.check(ctx, srcIP, dstIP, srcIP, dstIP, md)
 		}
 		return nfqueue.Default, nil
 	})
 
-	hooks.OnPacketIPv6(func(packet gopacket.Packet, ip6 *layers.IPv6, ts time.Time) (nfqueue.Verdict, error) {
+	hooks.OnPacketIPv6(func(ctx context.Context, packet gopacket.Packet, ip6 *layers.IPv6, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
 		src, dst := ip6.NetworkFlow().Endpoints()
 		srcIP := net.IP(src.Raw())
 		dstIP := net.IP(dst.Raw())
 		if !a.isLocal(srcIP) && a.isLocal(dstIP) {
-			return a.doCheck(srcIP, dstIP, dstIP, srcIP)
+			return a.check(ctx, srcIP, dstIP, dstIP, srcIP, md)
 		}
 		if !a.isLocal(dstIP) && a.isLocal(srcIP) {
-			return a.doCheck(srcIP, dstIP, srcIP, dstIP)
+			return a.check(ctx, srcIP, dstIP, srcIP, dstIP, md)
 		}
 		return nfqueue.Default, nil
 	})
 }
 
-func (a *Action) doCheck(src, dst, client, server net.IP) (nfqueue.Verdict, error) {
+// check defers the verdict and checks in background if async is enabled
+func (a *Action) check(ctx context.Context, src, dst, client, server net.IP, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
+	monitor := md.ActionMonitored(a.name)
+	if a.async {
+		if resolve, ok := md.Defer(a.timeout, a.onTimeout); ok {
+			go func() {
+				v, err := a.doCheck(ctx, src, dst, client, server, monitor)
+				if err != nil {
+					a.logger.Warnf("%v", err)
+				}
+				resolve(v)
+			}()
+			return nfqueue.Pending, nil
+		}
+	}
+	return a.doCheck(ctx, src, dst, client, server, monitor)
+}
+
+// doCheck checks the addresses and applies the rule, if monitor is true
+// the verdict will not be applied and it's included in the event
+func (a *Action) doCheck(ctx context.Context, src, dst, client, server net.IP, monitor bool) (nfqueue.Verdict, error) {
 	// check ips in cache
-	resp, err := a.checkResolved(client, server)
+	resp, err := a.checkResolved(ctx, client, server)
 	if err != nil {
 		return a.onError, fmt.Errorf("%s: check %v,%v: %v", a.name, client, server, err)
 	}
@@ -130,7 +165,7 @@ func (a *Action) doCheck(src, dst, client, server net.IP) (nfqueue.Verdict, erro
 	}
 	// do rule
 	if rule.Log {
-		a.logger.Infof("%s: %v->%v %v %+v", a.name, src, dst, server, resp)
+		a.logger.Infof("%s: %v->%v %v %+v%s", a.name, src, dst, server, resp, ipp.MonitorDesc(monitor, rule.Verdict))
 	}
 	if rule.EventRaise {
 		ecode := NetUnresolvedIP
@@ -146,13 +181,16 @@ func (a *Action) doCheck(src, dst, client, server net.IP) (nfqueue.Verdict, erro
 		} else {
 			e.Set("store", resp.Store.String())
 		}
+		if monitor {
+			e.Set("monitor", true)
+			e.Set("wouldbe", rule.Verdict.String())
+		}
 		event.Notify(e)
 	}
 	return rule.Verdict, nil
 }
 
-func (a *Action) checkResolved(client, server net.IP) (dnsutil.CacheResponse, error) {
-	ctx := context.Background()
+func (a *Action) checkResolved(ctx context.Context, client, server net.IP) (dnsutil.CacheResponse, error) {
 	// if one checker
 	if len(a.checkers) == 1 {
 		a.checkers[0].Check(ctx, client, server, "")
@@ -80,6 +80,12 @@ func getConfig(b *builder.Builder, def builder.ActionDef) (Config, error) {
 			return cfg, err
 		}
 	}
+	if def.Opts != nil {
+		cfg.Async, cfg.Timeout, cfg.OnTimeout, err = ipp.AsyncOpts(def.Opts)
+		if err != nil {
+			return cfg, err
+		}
+	}
 	return cfg, nil
 }
 
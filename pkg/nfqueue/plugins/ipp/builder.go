@@ -4,7 +4,9 @@ package ipp
 
 import (
 	"errors"
+	"time"
 
+	"github.com/luids-io/core/option"
 	"github.com/luids-io/netfilter/pkg/nfqueue"
 	"github.com/luids-io/netfilter/pkg/nfqueue/builder"
 )
@@ -15,7 +17,7 @@ func Builder() builder.BuildPluginFn {
 		if def.Name == "" {
 			return nil, errors.New("'name' is required")
 		}
-		cfg := Config{}
+		cfg := Config{Priority: def.Priority}
 		if len(def.Actions) > 0 {
 			cfg.Actions = make([]Action, 0, len(def.Actions))
 			for _, actionDef := range def.Actions {
@@ -34,6 +36,41 @@ func Builder() builder.BuildPluginFn {
 	}
 }
 
+// DefaultAsyncTimeout is the timeout of the deferred verdicts of the actions
+// with async enabled and without timeout
+var DefaultAsyncTimeout = 5 * time.Second
+
+// AsyncOpts returns the options "async", "timeout" (in milliseconds) and
+// "ontimeout" shared by actions that can defer the verdict of the packets
+func AsyncOpts(opts map[string]interface{}) (async bool, timeout time.Duration, onTimeout nfqueue.Verdict, err error) {
+	async, _, err = option.Bool(opts, "async")
+	if err != nil {
+		return
+	}
+	msecs, ok, err := option.Int(opts, "timeout")
+	if err != nil {
+		return
+	}
+	if ok {
+		if msecs < 0 {
+			err = errors.New("invalid 'timeout'")
+			return
+		}
+		timeout = time.Duration(msecs) * time.Millisecond
+	}
+	if async && timeout == 0 {
+		timeout = DefaultAsyncTimeout
+	}
+	s, ok, err := option.String(opts, "ontimeout")
+	if err != nil {
+		return
+	}
+	if ok {
+		onTimeout, err = nfqueue.ToVerdict(s)
+	}
+	return
+}
+
 func init() {
 	builder.RegisterPluginBuilder(PluginClass, Builder())
 }
@@ -3,20 +3,26 @@
 package ipp
 
 import (
+	"context"
 	"errors"
 	"strings"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+
+	"github.com/luids-io/core/yalogi"
 	"github.com/luids-io/netfilter/pkg/nfqueue"
 )
 
 type (
 	//CbPacketIPv4 defines a callback on packet
-	CbPacketIPv4 func(gopacket.Packet, *layers.IPv4, time.Time) (nfqueue.Verdict, error)
+	CbPacketIPv4 func(context.Context, gopacket.Packet, *layers.IPv4, *nfqueue.Metadata) (nfqueue.Verdict, error)
 	//CbPacketIPv6 defines a callback on packet
-	CbPacketIPv6 func(gopacket.Packet, *layers.IPv6, time.Time) (nfqueue.Verdict, error)
+	CbPacketIPv6 func(context.Context, gopacket.Packet, *layers.IPv6, *nfqueue.Metadata) (nfqueue.Verdict, error)
+	//CbVerdict defines a callback called after the verdict of the packet is
+	//set, see nfqueue.CbVerdict
+	CbVerdict func(gopacket.Packet, *nfqueue.Metadata, string, nfqueue.Verdict) error
 	//CbTick defines callback for tick routines
 	CbTick func(time.Time, time.Time) error
 	//CbClose defines callback for cleanups
@@ -27,8 +33,18 @@ type (
 type Hooks struct {
 	onPacketIP4 []CbPacketIPv4
 	onPacketIP6 []CbPacketIPv6
+	onVerdict   []CbVerdict
 	onTick      []CbTick
 	onClose     []CbClose
+	// names of the actions that registered packet and verdict hooks
+	action   string
+	actions4 []string
+	actions6 []string
+	actionsV []string
+	// packet hooks that can defer the verdict
+	async  bool
+	async4 []bool
+	async6 []bool
 }
 
 // NewHooks returns a new hooks collection
@@ -39,11 +55,21 @@ func NewHooks() *Hooks {
 // OnPacketIPv4 adds a callback function on new packet
 func (h *Hooks) OnPacketIPv4(fn CbPacketIPv4) {
 	h.onPacketIP4 = append(h.onPacketIP4, fn)
+	h.actions4 = append(h.actions4, h.action)
+	h.async4 = append(h.async4, h.async)
 }
 
 // OnPacketIPv6 adds a callback function on new packet
 func (h *Hooks) OnPacketIPv6(fn CbPacketIPv6) {
 	h.onPacketIP6 = append(h.onPacketIP6, fn)
+	h.actions6 = append(h.actions6, h.action)
+	h.async6 = append(h.async6, h.async)
+}
+
+// OnVerdict adds a callback function called after the verdict is set
+func (h *Hooks) OnVerdict(fn CbVerdict) {
+	h.onVerdict = append(h.onVerdict, fn)
+	h.actionsV = append(h.actionsV, h.action)
 }
 
 // OnTick adds a callback function on each tick
@@ -58,27 +84,66 @@ func (h *Hooks) OnClose(fn CbClose) {
 
 // hooksRunner executes Hooks
 type hooksRunner struct {
-	hooks *Hooks
+	hooks  *Hooks
+	logger yalogi.Logger
 }
 
 // newHooksRunner returns a HooksRunner
-func newHooksRunner(h *Hooks) *hooksRunner {
-	return &hooksRunner{hooks: h}
+func newHooksRunner(h *Hooks, logger yalogi.Logger) *hooksRunner {
+	return &hooksRunner{hooks: h, logger: logger}
 }
 
+func noUnchain() {}
+
 // PacketIPv4 executes on ipv4
-func (h *hooksRunner) PacketIPv4(packet gopacket.Packet, ip4 *layers.IPv4, ts time.Time) (nfqueue.Verdict, error) {
+func (h *hooksRunner) PacketIPv4(ctx context.Context, packet gopacket.Packet, ip4 *layers.IPv4, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
+	return h.packetIPv4From(ctx, 0, packet, ip4, md)
+}
+
+func (h *hooksRunner) packetIPv4From(ctx context.Context, start int, packet gopacket.Packet, ip4 *layers.IPv4, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
 	v := nfqueue.Default
 	errs := make([]string, 0, len(h.hooks.onPacketIP4))
-	for _, cb := range h.hooks.onPacketIP4 {
+	for i := start; i < len(h.hooks.onPacketIP4); i++ {
+		cb := h.hooks.onPacketIP4[i]
+		action := h.hooks.actions4[i]
+		if !md.ActionEnabled(action) {
+			continue
+		}
+		// continue with next hooks if verdict is deferred
+		unchain := noUnchain
+		if h.hooks.async4[i] {
+			next := i + 1
+			unchain = md.Chain(func(v nfqueue.Verdict) nfqueue.Verdict {
+				v = md.MonitorAction(action, v)
+				if v != nfqueue.Default {
+					return v
+				}
+				v, err := h.packetIPv4From(ctx, next, packet, ip4, md)
+				if err != nil {
+					h.logger.Warnf("%v", err)
+				}
+				return v
+			})
+		}
 		var err error
-		v, err = cb(packet, ip4, ts)
+		var begin time.Time
+		if md.Observed() {
+			begin = time.Now()
+		}
+		md.Action = action
+		v, err = cb(ctx, packet, ip4, md)
+		unchain()
+		if md.Observed() {
+			md.ObserveAction(action, v, err, time.Since(begin))
+		}
+		v = md.MonitorAction(action, v)
 		if err != nil {
 			errs = append(errs, err.Error())
 		}
 		if v != nfqueue.Default {
 			break
 		}
+		md.Action = ""
 	}
 	if len(errs) > 0 {
 		return v, errors.New(strings.Join(errs, ";"))
@@ -87,18 +152,54 @@ func (h *hooksRunner) PacketIPv4(packet gopacket.Packet, ip4 *layers.IPv4, ts ti
 }
 
 // PacketIPv6 executes on ipv6
-func (h *hooksRunner) PacketIPv6(packet gopacket.Packet, ip6 *layers.IPv6, ts time.Time) (nfqueue.Verdict, error) {
+func (h *hooksRunner) PacketIPv6(ctx context.Context, packet gopacket.Packet, ip6 *layers.IPv6, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
+	return h.packetIPv6From(ctx, 0, packet, ip6, md)
+}
+
+func (h *hooksRunner) packetIPv6From(ctx context.Context, start int, packet gopacket.Packet, ip6 *layers.IPv6, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
 	v := nfqueue.Default
 	errs := make([]string, 0, len(h.hooks.onPacketIP6))
-	for _, cb := range h.hooks.onPacketIP6 {
+	for i := start; i < len(h.hooks.onPacketIP6); i++ {
+		cb := h.hooks.onPacketIP6[i]
+		action := h.hooks.actions6[i]
+		if !md.ActionEnabled(action) {
+			continue
+		}
+		// continue with next hooks if verdict is deferred
+		unchain := noUnchain
+		if h.hooks.async6[i] {
+			next := i + 1
+			unchain = md.Chain(func(v nfqueue.Verdict) nfqueue.Verdict {
+				v = md.MonitorAction(action, v)
+				if v != nfqueue.Default {
+					return v
+				}
+				v, err := h.packetIPv6From(ctx, next, packet, ip6, md)
+				if err != nil {
+					h.logger.Warnf("%v", err)
+				}
+				return v
+			})
+		}
 		var err error
-		v, err = cb(packet, ip6, ts)
+		var begin time.Time
+		if md.Observed() {
+			begin = time.Now()
+		}
+		md.Action = action
+		v, err = cb(ctx, packet, ip6, md)
+		unchain()
+		if md.Observed() {
+			md.ObserveAction(action, v, err, time.Since(begin))
+		}
+		v = md.MonitorAction(action, v)
 		if err != nil {
 			errs = append(errs, err.Error())
 		}
 		if v != nfqueue.Default {
 			break
 		}
+		md.Action = ""
 	}
 	if len(errs) > 0 {
 		return v, errors.New(strings.Join(errs, ";"))
@@ -106,6 +207,24 @@ func (h *hooksRunner) PacketIPv6(packet gopacket.Packet, ip6 *layers.IPv6, ts ti
 	return v, nil
 }
 
+// Verdict executes onVerdict hooks of the enabled actions
+func (h *hooksRunner) Verdict(packet gopacket.Packet, md *nfqueue.Metadata, plugin string, v nfqueue.Verdict) error {
+	errs := make([]string, 0, len(h.hooks.onVerdict))
+	for i, cb := range h.hooks.onVerdict {
+		if !md.ActionEnabled(h.hooks.actionsV[i]) {
+			continue
+		}
+		err := cb(packet, md, plugin, v)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ";"))
+	}
+	return nil
+}
+
 // Tick executes onTick registered hooks. It pass the last timestamp.
 func (h *hooksRunner) Tick(lastTick, lastPacket time.Time) error {
 	errs := make([]string, 0, len(h.hooks.onTick))
@@ -3,6 +3,7 @@
 package ipp
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -18,20 +19,22 @@ const PluginClass = "ipp"
 
 // Config stores configuration for plugin creation
 type Config struct {
-	Actions []Action
+	Actions  []Action
+	Priority int
 }
 
 // Plugin implementation
 type Plugin struct {
-	name   string
-	logger yalogi.Logger
+	name     string
+	priority int
+	logger   yalogi.Logger
 	//internals
 	hrunner *hooksRunner
 }
 
 // New returns a new plugin instance
 func New(pname string, cfg Config, l yalogi.Logger) (*Plugin, error) {
-	p := &Plugin{name: pname, logger: l}
+	p := &Plugin{name: pname, priority: cfg.Priority, logger: l}
 	err := p.init(cfg)
 	if err != nil {
 		return nil, err
@@ -43,9 +46,14 @@ func (p *Plugin) init(cfg Config) error {
 	//create and register hooks from actions
 	hooks := NewHooks()
 	for _, action := range cfg.Actions {
+		hooks.action, hooks.async = action.Name(), false
+		if async, ok := action.(AsyncAction); ok {
+			hooks.async = async.Async()
+		}
 		action.Register(hooks)
 	}
-	p.hrunner = newHooksRunner(hooks)
+	hooks.action, hooks.async = "", false
+	p.hrunner = newHooksRunner(hooks, p.logger)
 	return nil
 }
 
@@ -59,26 +67,35 @@ func (p *Plugin) Class() string {
 	return PluginClass
 }
 
+// Priority implements nfqueue.Prioritized interface
+func (p *Plugin) Priority() int {
+	return p.priority
+}
+
 // Register implements nfqueue.Plugin interface
 func (p *Plugin) Register(hooks *nfqueue.Hooks) {
 	//register packets ip4
 	hooks.OnPacket(layers.LayerTypeIPv4,
-		func(packet gopacket.Packet, ts time.Time) (nfqueue.Verdict, error) {
+		func(ctx context.Context, packet gopacket.Packet, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
 			ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 			if !ok {
 				return nfqueue.Default, fmt.Errorf("%s: can't get ip4 layer", p.name)
 			}
-			return p.hrunner.PacketIPv4(packet, ip4, ts)
+			return p.hrunner.PacketIPv4(ctx, packet, ip4, md)
 		})
 	//register packets ip6
 	hooks.OnPacket(layers.LayerTypeIPv6,
-		func(packet gopacket.Packet, ts time.Time) (nfqueue.Verdict, error) {
+		func(ctx context.Context, packet gopacket.Packet, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
 			ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
 			if !ok {
 				return nfqueue.Default, fmt.Errorf("%s: can't get ip4 layer", p.name)
 			}
-			return p.hrunner.PacketIPv6(packet, ip6, ts)
+			return p.hrunner.PacketIPv6(ctx, packet, ip6, md)
 		})
+	//register verdicts
+	hooks.OnVerdict(func(packet gopacket.Packet, md *nfqueue.Metadata, plugin string, v nfqueue.Verdict) error {
+		return p.hrunner.Verdict(packet, md, plugin, v)
+	})
 	//register ticks
 	hooks.OnTick(func(lastTick, lastCapture time.Time) error {
 		return p.hrunner.Tick(lastTick, lastCapture)
@@ -4,59 +4,335 @@ package nfqueue
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	nfq "github.com/florianl/go-nfqueue"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 
 	"github.com/luids-io/core/yalogi"
 )
 
-// PacketProcessor attach to a netfilter queue with the qid
+// PacketProcessor attach to the netfilter queues with the qids. Queues
+// passed in the same call are a group that shares the hooks, so packets
+// of all queues are processed by the same pipeline.
 type PacketProcessor interface {
-	Process(qid int, hooks *Hooks) (stop func(), errs <-chan error, err error)
+	Process(qids []int, hooks *Hooks) (stop func(), errs <-chan error, err error)
+}
+
+// ReloadProcessor is implemented by processors that can replace the hooks
+// of a running group of queues without stopping them, the verdicts of the
+// pipeline are only applied when the group is started. The replaced hooks
+// aren't closed until closeOld is called, so they can be restored. closeOld
+// waits for the packets in process with the replaced hooks.
+type ReloadProcessor interface {
+	Reload(qids []int, hooks *Hooks) (closeOld func(), err error)
+}
+
+// StatsProcessor is implemented by processors that collect statistics
+type StatsProcessor interface {
+	Stats(qid int) (Stats, bool)
+}
+
+// Stats stores counters of a queue
+type Stats struct {
+	// Packets is the number of packets received
+	Packets uint64
+	// Timeouts is the number of packets that exceeded the deadline
+	Timeouts uint64
+	// LastPacket is the time of the last packet received
+	LastPacket time.Time
+	// State of the queue in the processor
+	State QueueState
+}
+
+// Add returns the sum of the counters, the most recent last packet and the
+// worst state
+func (s Stats) Add(o Stats) Stats {
+	last := s.LastPacket
+	if o.LastPacket.After(last) {
+		last = o.LastPacket
+	}
+	state := s.State
+	if o.State > state {
+		state = o.State
+	}
+	return Stats{
+		Packets:    s.Packets + o.Packets,
+		Timeouts:   s.Timeouts + o.Timeouts,
+		LastPacket: last,
+		State:      state,
+	}
+}
+
+// QueueState is the state of a queue in the processor
+type QueueState int32
+
+// Queue states
+const (
+	// QueueRunning is processing packets
+	QueueRunning QueueState = iota
+	// QueueStopped was stopped
+	QueueStopped
+	// QueueFailed was closed because of a failure
+	QueueFailed
+)
+
+func (s QueueState) String() string {
+	switch s {
+	case QueueRunning:
+		return "running"
+	case QueueStopped:
+		return "stopped"
+	case QueueFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("unknown(%v)", int(s))
+}
+
+// queueStats stores the counters of a queue, they are kept by the processor
+// when the queue is stopped, so they aren't reset by restarts
+type queueStats struct {
+	packets    uint64
+	timeouts   uint64
+	lastPacket int64 //unix nano
+	state      int32
+}
+
+func (st *queueStats) setState(s QueueState) {
+	atomic.StoreInt32(&st.state, int32(s))
+}
+
+func (st *queueStats) get() Stats {
+	stats := Stats{
+		Packets:  atomic.LoadUint64(&st.packets),
+		Timeouts: atomic.LoadUint64(&st.timeouts),
+		State:    QueueState(atomic.LoadInt32(&st.state)),
+	}
+	if last := atomic.LoadInt64(&st.lastPacket); last > 0 {
+		stats.LastPacket = time.Unix(0, last)
+	}
+	return stats
 }
 
 // queueProc implements a go-nfqueue processor
 type queueProc struct {
-	policy  Verdict
-	onError Verdict
-	tick    time.Duration
-	logger  yalogi.Logger
+	cfg    Config
+	logger yalogi.Logger
+
+	mu     sync.Mutex
+	queues map[int]*queue
+	stats  map[int]*queueStats
 }
 
+// WorkerBuffer sets the size of the packet channel of each worker
+var WorkerBuffer = 64
+
+// MaxVerdictErrors is the number of consecutive errors setting verdicts
+// after which a queue is considered failed and its group is closed. Zero
+// disables it.
+var MaxVerdictErrors = 16
+
+// DrainTimeout is the maximum time waiting for the packets in process when
+// a queue is closed, so their verdicts are set before closing netlink
+var DrainTimeout = 5 * time.Second
+
+// netlinkCloseTimeout is the time waiting for netlink close
+const netlinkCloseTimeout = time.Second
+
+// Default values for netlink queue parameters
+const (
+	DefaultQueueLen  = 1024
+	DefaultCopyRange = 0xFFFF
+)
+
 // Config defines configuration for a netfilter queue
 type Config struct {
 	Policy  Verdict
 	OnError Verdict
 	Tick    time.Duration
+	// QueueLen is the maximum number of packets in the kernel queue
+	QueueLen uint32
+	// CopyRange is the maximum number of bytes copied from each packet,
+	// if zero it's computed from the layers required by the hooks
+	CopyRange uint32
+	// CopyMeta copies only packet metadata, so packet hooks are not
+	// executed and the policy is applied to all packets
+	CopyMeta bool
+	// FailOpen accepts packets when the kernel queue is full
+	FailOpen bool
+	// GSO allows receiving packets without segmentation
+	GSO bool
+	// Conntrack requests connection tracking information to the kernel
+	Conntrack bool
+	// Workers is the number of goroutines processing packets, packets
+	// of the same flow are processed in order by the same worker. If
+	// zero, packets are processed in the netlink receiving goroutine.
+	// Packet hooks must be safe for concurrent use, tick hooks are never
+	// executed concurrently with packet hooks.
+	Workers int
+	// Timeout is the maximum time for processing a packet, if exceeded
+	// the OnTimeout verdict is applied. Zero disables the deadline.
+	Timeout time.Duration
+	// OnTimeout is the verdict for timed out packets, if Default then
+	// OnError verdict is applied
+	OnTimeout Verdict
+	// Netlink opens the connections to the queues, if nil the kernel
+	// netfilter queues are used
+	Netlink OpenNetlinkFn
+	// Collector receives the processing events for metrics
+	Collector Collector
+	// Switches disables plugins and actions at runtime, if nil all are
+	// enabled
+	Switches *Switches
+	// Tracer records the hooks executed for the packets, if nil packets
+	// are not traced
+	Tracer *Tracer
+	// Flows tracks the flows of the packets, if nil flows are not tracked.
+	// Idle flows are expired on ticks, so Tick must be set.
+	Flows *FlowTable
+}
+
+// requiredLayers returns the layers required by the hooks and the flow
+// table
+func (cfg Config) requiredLayers(hooks *Hooks) []gopacket.LayerType {
+	required := hooks.RequiredLayers()
+	if cfg.Flows != nil {
+		required = append(required, flowLayers...)
+	}
+	return required
 }
 
 // NewProcessor creates a new basic go-nfqueue processor
 func NewProcessor(cfg Config, logger yalogi.Logger) PacketProcessor {
+	if cfg.QueueLen == 0 {
+		cfg.QueueLen = DefaultQueueLen
+	}
+	if cfg.OnTimeout == Default {
+		cfg.OnTimeout = cfg.OnError
+	}
 	return &queueProc{
-		policy:  cfg.Policy,
-		onError: cfg.OnError,
-		tick:    cfg.Tick,
-		logger:  logger,
+		cfg:    cfg,
+		logger: logger,
+		queues: make(map[int]*queue),
+		stats:  make(map[int]*queueStats),
 	}
 }
 
 // Process implements Processor
-func (p queueProc) Process(qid int, hooks *Hooks) (func(), <-chan error, error) {
-	q := &queue{
-		qid:     qid,
-		policy:  p.policy,
-		onError: p.onError,
-		logger:  p.logger,
-	}
-	err := q.init(hooks, p.tick)
-	if err != nil {
-		return nil, nil, err
+func (p *queueProc) Process(qids []int, hooks *Hooks) (func(), <-chan error, error) {
+	if len(qids) == 0 {
+		return nil, nil, errors.New("qids are required")
+	}
+	cfg := p.cfg
+	depth := decodeDepth(cfg.requiredLayers(hooks))
+	if cfg.CopyRange == 0 {
+		cfg.CopyRange = copyRange(depth)
 	}
-	return q.close, q.errorCh, nil
+	policy, onError := hooks.Verdicts()
+	if policy == Default {
+		policy = cfg.Policy
+	}
+	if onError == Default {
+		onError = cfg.OnError
+	}
+	g := newGroup(qids, newHooksRunner(hooks), depth, p.logger)
+	g.collector = collectorOrNull(cfg.Collector)
+	for _, qid := range qids {
+		q := &queue{
+			qid:       qid,
+			policy:    policy,
+			onError:   onError,
+			cfg:       cfg,
+			g:         g,
+			collector: g.collector,
+			logger:    p.logger,
+			stats:     p.queueStats(qid),
+		}
+		err := q.init()
+		if err != nil {
+			for _, q := range g.queues {
+				q.close()
+			}
+			g.hrunner.discard()
+			return nil, nil, err
+		}
+		g.queues = append(g.queues, q)
+	}
+	g.start(cfg.Tick)
+	// flows are expired by the table, once for all the groups
+	var release sync.Once
+	if cfg.Flows != nil {
+		cfg.Flows.startExpire(cfg.Tick)
+	}
+	p.mu.Lock()
+	for _, q := range g.queues {
+		p.queues[q.qid] = q
+		q.stats.setState(QueueRunning)
+	}
+	p.mu.Unlock()
+	stop := func() {
+		p.mu.Lock()
+		for _, q := range g.queues {
+			if p.queues[q.qid] == q {
+				delete(p.queues, q.qid)
+			}
+		}
+		p.mu.Unlock()
+		g.close()
+		if cfg.Flows != nil {
+			release.Do(cfg.Flows.stopExpire)
+		}
+	}
+	return stop, g.errorCh, nil
+}
+
+// Reload implements ReloadProcessor
+func (p *queueProc) Reload(qids []int, hooks *Hooks) (func(), error) {
+	if len(qids) == 0 {
+		return nil, errors.New("qids are required")
+	}
+	p.mu.Lock()
+	q, ok := p.queues[qids[0]]
+	p.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("nfqueue %v is not processing", qids[0])
+	}
+	depth := decodeDepth(p.cfg.requiredLayers(hooks))
+	// copy range can't be changed without opening the queues again
+	if p.cfg.CopyRange == 0 && copyRange(depth) > q.cfg.CopyRange {
+		return nil, fmt.Errorf("hooks require a copy range greater than %v bytes in %s", q.cfg.CopyRange, q.g.desc)
+	}
+	g := q.g
+	old := g.reload(newHooksRunner(hooks), depth)
+	return func() { g.closeRunner(old) }, nil
+}
+
+// Stats implements StatsProcessor
+func (p *queueProc) Stats(qid int) (Stats, bool) {
+	p.mu.Lock()
+	st, ok := p.stats[qid]
+	p.mu.Unlock()
+	if !ok {
+		return Stats{}, false
+	}
+	return st.get(), true
+}
+
+// queueStats returns the counters of the queue, they're created the first
+// time the queue is processed
+func (p *queueProc) queueStats(qid int) *queueStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.stats[qid]
+	if !ok {
+		st = &queueStats{state: int32(QueueStopped)}
+		p.stats[qid] = st
+	}
+	return st
 }
 
 // queue wrappes a go-nfqueue
@@ -64,74 +340,143 @@ type queue struct {
 	logger          yalogi.Logger
 	qid             int
 	policy, onError Verdict
-	hrunner         *hooksRunner
-	lastPacket      time.Time
+	cfg             Config
+	g               *group
+	collector       Collector
+	stats           *queueStats
+	// consecutive verdict errors, atomic access
+	verrors uint32
 
-	netlink *nfq.Nfqueue
+	netlink Netlink
 	stop    context.CancelFunc
-	errorCh chan error
-	tdoneCh chan struct{}
-	closed  bool
+	// vmu serializes verdicts
+	vmu sync.Mutex
+	// workers
+	workers []chan nfq.Attribute
+	wg      sync.WaitGroup
+	// dmu protects closed, nlClosed and workers channels
+	dmu      sync.RWMutex
+	closed   bool
+	nlClosed bool
+	// done is closed when the queue is closing, unblocks dispatches
+	// waiting for a worker and sending tracks dispatches in progress
+	done    chan struct{}
+	sending sync.WaitGroup
+	// inflight tracks packets without verdict
+	inflight sync.WaitGroup
 }
 
-func (q *queue) init(hooks *Hooks, tick time.Duration) error {
-	// open with configuration and hooks
+func (q *queue) init() error {
+	q.done = make(chan struct{})
+	// open with configuration
 	err := q.doOpen()
 	if err != nil {
 		return fmt.Errorf("could not open nfqueue %v: %v", q.qid, err)
 	}
-	//creates error channel and hooks
-	q.hrunner = newHooksRunner(hooks)
-	q.errorCh = make(chan error, ErrorsBuffer)
+	// start workers
+	if q.cfg.Workers > 0 {
+		q.workers = make([]chan nfq.Attribute, 0, q.cfg.Workers)
+		for i := 0; i < q.cfg.Workers; i++ {
+			ch := make(chan nfq.Attribute, WorkerBuffer)
+			q.workers = append(q.workers, ch)
+			q.wg.Add(1)
+			go q.doWork(ch)
+		}
+	}
 	//creates context for cancelation
 	ctx := context.Background()
 	ctx, q.stop = context.WithCancel(ctx)
 	err = q.doRegister(ctx)
 	if err != nil {
+		q.stopWorkers()
 		return fmt.Errorf("can't register queue %v: %v", q.qid, err)
 	}
-	// start timer gorutine
-	if tick > 0 {
-		q.tdoneCh = make(chan struct{})
-		go q.doTick(ctx, tick)
-	}
 	return nil
 }
 
 func (q *queue) close() {
+	q.dmu.Lock()
 	if q.closed {
+		q.dmu.Unlock()
 		return
 	}
 	q.closed = true
+	close(q.done)
+	q.dmu.Unlock()
 	q.logger.Debugf("closing nfqueue %v", q.qid)
 	q.stop()
+	// process the packets received and wait for their verdicts
+	q.sending.Wait()
+	q.stopWorkers()
+	q.drain()
+	q.dmu.Lock()
+	q.nlClosed = true
+	q.dmu.Unlock()
 	// close netlink in a separate goroutine because a bug in netlink close sometimes hangs
+	closed := make(chan struct{})
 	go func() {
 		q.logger.Debugf("closing netlink %v", q.qid)
 		q.netlink.Close()
 		q.logger.Debugf("closed netlink %v", q.qid)
+		close(closed)
 	}()
-	// if tick gorutine, then wait it for close
-	if q.tdoneCh != nil {
-		<-q.tdoneCh
+	select {
+	case <-closed:
+	case <-time.After(netlinkCloseTimeout):
+		q.logger.Warnf("timeout closing netlink %v", q.qid)
 	}
-	// clean up
-	errs := q.hrunner.Close()
-	for _, err := range errs {
-		q.errorCh <- fmt.Errorf("on close qid(#%v): %v", q.qid, err)
+}
+
+// drain waits for the packets in process, deferred verdicts can be resolved
+// or expired until DrainTimeout
+func (q *queue) drain() {
+	drained := make(chan struct{})
+	go func() {
+		q.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(DrainTimeout):
+		q.logger.Warnf("timeout draining packets in nfqueue %v", q.qid)
 	}
-	close(q.errorCh)
+}
+
+func (q *queue) stopWorkers() {
+	for _, ch := range q.workers {
+		close(ch)
+	}
+	q.wg.Wait()
 }
 
 func (q *queue) doOpen() error {
 	var err error
 	q.logger.Debugf("connecting to nfqueue %v", q.qid)
-	q.netlink, err = nfq.Open(
+	copymode := uint8(nfq.NfQnlCopyPacket)
+	if q.cfg.CopyMeta {
+		copymode = nfq.NfQnlCopyMeta
+	}
+	flags := uint32(nfq.NfQaCfgFlagUIDGid)
+	if q.cfg.FailOpen {
+		flags |= nfq.NfQaCfgFlagFailOpen
+	}
+	if q.cfg.GSO {
+		flags |= nfq.NfQaCfgFlagGSO
+	}
+	if q.cfg.Conntrack {
+		flags |= nfq.NfQaCfgFlagConntrack
+	}
+	open := q.cfg.Netlink
+	if open == nil {
+		open = OpenNetlink
+	}
+	q.netlink, err = open(
 		&nfq.Config{
 			NfQueue:      uint16(q.qid),
-			MaxPacketLen: 0xFFFF,
-			MaxQueueLen:  0xFF,
-			Copymode:     nfq.NfQnlCopyPacket,
+			MaxPacketLen: q.cfg.CopyRange,
+			MaxQueueLen:  q.cfg.QueueLen,
+			Copymode:     copymode,
+			Flags:        flags,
 			Logger:       yalogi.NewStandard(q.logger, yalogi.Debug),
 		})
 	return err
@@ -147,82 +492,370 @@ func (q *queue) doRegister(ctx context.Context) error {
 	return err
 }
 
-func (q *queue) doTick(ctx context.Context, tick time.Duration) {
-	q.logger.Debugf("starting tick in nfqueue %v", q.qid)
-	lastTick := time.Now()
-	ticker := time.NewTicker(tick)
-	defer ticker.Stop()
-LOOPTICK:
-	for {
-		select {
-		case <-ticker.C:
-			errs := q.hrunner.Tick(lastTick, q.lastPacket)
-			for _, err := range errs {
-				q.errorCh <- fmt.Errorf("on tick in qid(#%v): %v", q.qid, err)
-			}
-			lastTick = time.Now()
-		case <-ctx.Done():
-			break LOOPTICK
+// main dispatch function, satisfices nfq.HookFunc interface
+func (q *queue) dispatch(a nfq.Attribute) int {
+	// the lock isn't held while processing or waiting for a worker, closing
+	// the queue would be blocked
+	q.dmu.RLock()
+	if q.closed {
+		// packets of the batch received while closing get the policy, the
+		// lock keeps netlink open until the verdict is set. A non zero
+		// return would stop receiving and skip the rest of the batch.
+		if !q.nlClosed && a.PacketID != nil {
+			q.collector.PacketReceived(q.qid)
+			q.collector.Backlog(q.qid, 1)
+			q.setVerdict(*a.PacketID, q.monitorAll(*a.PacketID, q.policy))
 		}
+		q.dmu.RUnlock()
+		return 0
+	}
+	workers := q.workers
+	q.sending.Add(1)
+	defer q.sending.Done()
+	q.dmu.RUnlock()
+	if a.PacketID == nil {
+		q.g.errorCh <- fmt.Errorf("could't get packet id from queue %v", q.qid)
+		q.collector.Error(q.qid, StageReceive)
+		return 0
+	}
+	q.collector.PacketReceived(q.qid)
+	q.collector.Backlog(q.qid, 1)
+	if len(workers) == 0 {
+		q.process(a)
+		return 0
+	}
+	// packets of the same flow are processed by the same worker
+	var hash uint32
+	if a.Payload != nil {
+		hash = flowHash(*a.Payload)
 	}
-	close(q.tdoneCh)
-	return
+	select {
+	case workers[hash%uint32(len(workers))] <- a:
+	case <-q.done:
+		// receiving stops when the context is cancelled, the packets
+		// remaining in the batch get the policy
+		q.setVerdict(*a.PacketID, q.monitorAll(*a.PacketID, q.policy))
+	}
+	return 0
 }
 
-// main processing function, satisfices nfq.HookFunc interface
-func (q *queue) dispatch(a nfq.Attribute) int {
-	// remove this when netlink close bug fixed
-	if q.closed {
-		return toNfqVerdict(q.policy)
+func (q *queue) doWork(ch <-chan nfq.Attribute) {
+	defer q.wg.Done()
+	for a := range ch {
+		q.process(a)
 	}
+}
+
+// main processing function
+func (q *queue) process(a nfq.Attribute) {
 	// get data from queue
 	id := *a.PacketID
+	atomic.AddUint64(&q.stats.packets, 1)
+	atomic.StoreInt64(&q.stats.lastPacket, time.Now().UnixNano())
 	q.logger.Debugf("processing packet %v from queue %v", id, q.qid)
+	// packet hooks can't be executed without payload
+	if q.cfg.CopyMeta {
+		atomic.StoreInt64(&q.g.lastPacket, time.Now().UnixNano())
+		q.setVerdict(id, q.monitorAll(id, q.policy))
+		return
+	}
 	payload := a.Payload
 	if payload == nil {
-		q.errorCh <- fmt.Errorf("could't get payload for packet id %v from queue %v", id, q.qid)
-		q.netlink.SetVerdict(id, toNfqVerdict(q.onError))
-		return 0
+		q.g.errorCh <- fmt.Errorf("could't get payload for packet id %v from queue %v", id, q.qid)
+		q.collector.Error(q.qid, StageReceive)
+		q.setVerdict(id, q.monitorAll(id, q.onError))
+		return
 	}
+	// get the current pipeline, it can be replaced by a reload that waits
+	// for the packets in process before closing it
+	q.g.hmu.RLock()
+	hrunner, depth := q.g.hrunner, q.g.depth
+	hrunner.pending.Add(1)
+	q.g.hmu.RUnlock()
 	// decode network packet
-	layer := layers.LayerTypeIPv4
-	packet := gopacket.NewPacket(*payload, layer, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	truncated := a.CapLen != nil && int(*a.CapLen) > len(*payload)
+	packet := gopacket.NewPacket(*payload, newDecoder(ipLayerType(*payload), depth), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
 	if err := packet.ErrorLayer(); err != nil {
-		layer = layers.LayerTypeIPv6
-		packet = gopacket.NewPacket(*payload, layer, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
-		if err := packet.ErrorLayer(); err != nil {
-			q.errorCh <- fmt.Errorf("could't convert to packet %v qid(#%v)", id, q.qid)
-			q.netlink.SetVerdict(id, toNfqVerdict(q.onError))
-			return 0
+		if truncated {
+			q.g.errorCh <- fmt.Errorf("could't convert to packet %v qid(#%v): headers exceed copy range %v", id, q.qid, q.cfg.CopyRange)
+		} else {
+			q.g.errorCh <- fmt.Errorf("could't convert to packet %v qid(#%v)", id, q.qid)
 		}
+		q.collector.PacketDecoded(q.qid, false)
+		q.collector.Error(q.qid, StageDecode)
+		q.setVerdict(id, q.monitorAll(id, q.onError))
+		hrunner.pending.Done()
+		return
 	}
-	ts := time.Now()
-	q.lastPacket = ts
-	//fmt.Printf("[%d]\t%v\n", id, packet)
+	q.collector.PacketDecoded(q.qid, true)
+	md, err := newMetadata(q.qid, a, q.g.ifaces)
+	if err != nil {
+		q.g.errorCh <- NewError(packet, fmt.Errorf("decoding metadata %v qid(#%v): %v", id, q.qid, err))
+		q.collector.Error(q.qid, StageMetadata)
+	}
+	if q.cfg.Collector != nil {
+		md.collector = q.cfg.Collector
+	}
+	md.switches = q.cfg.Switches
+	if q.cfg.Tracer != nil {
+		md.trace = q.cfg.Tracer.start(packet, md)
+	}
+	if q.cfg.Flows != nil {
+		md.flow, md.flowReply = q.cfg.Flows.track(packet, md.Timestamp)
+	}
+	atomic.StoreInt64(&q.g.lastPacket, md.Timestamp.UnixNano())
 	// process packet hooks
+	st := &packetState{
+		id:        id,
+		packet:    packet,
+		md:        md,
+		hrunner:   hrunner,
+		truncated: truncated,
+	}
+	st.ctx, st.cancel = q.packetContext()
+	q.inflight.Add(1)
+	md.async = &asyncPacket{
+		guard:  q.guard,
+		resume: func(v Verdict) { q.resume(st, v) },
+	}
+	q.g.hmu.RLock()
+	defer q.g.hmu.RUnlock()
+	q.runHooks(st)
+}
+
+// packetContext returns the context for processing a packet
+func (q *queue) packetContext() (context.Context, context.CancelFunc) {
+	if q.cfg.Timeout > 0 {
+		return context.WithTimeout(context.Background(), q.cfg.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// packetState stores the processing state of a packet
+type packetState struct {
+	id        uint32
+	packet    gopacket.Packet
+	md        *Metadata
+	hrunner   *hooksRunner
+	mangled   bool
+	truncated bool
+	// position of the next hook to be executed
+	hook int
+	// deadline of the processing
+	ctx     context.Context
+	cancel  context.CancelFunc
+	watched bool
+	done    int32 //atomic access
+}
+
+// runHooks executes packet hooks from the current position and sets the
+// verdict, unless a hook deferred it
+func (q *queue) runHooks(st *packetState) {
 	verdict := q.policy
-	for _, layerType := range q.hrunner.Layers() {
-		layer := packet.Layer(layerType)
-		if layer != nil {
-			v, errs := q.hrunner.Packet(layerType, packet, ts)
-			for _, err := range errs {
-				q.errorCh <- NewError(packet, fmt.Errorf("on packet qid(#%v): %v", q.qid, err))
-			}
-			if v != Default {
-				verdict = v
-				break
-			}
+	v, p, next, errs := st.hrunner.PacketFrom(st.ctx, st.hook, st.packet, st.md)
+	if st.ctx.Err() == context.DeadlineExceeded {
+		// errors are caused by the deadline
+		st.md.async.cancel()
+		q.expire(st)
+		return
+	}
+	for _, err := range errs {
+		q.g.errorCh <- NewError(st.packet, fmt.Errorf("on packet qid(#%v): %v", q.qid, err))
+		q.collector.Error(q.qid, StageHook)
+	}
+	if p != nil {
+		st.packet, st.mangled = p, true
+	}
+	switch {
+	case v == Pending:
+		st.hook = next
+		if st.md.async.returned() {
+			q.watch(st)
+			return
 		}
+		q.g.errorCh <- NewError(st.packet, fmt.Errorf("on packet qid(#%v): pending verdict not deferred", q.qid))
+		q.collector.Error(q.qid, StageHook)
+		verdict = q.onError
+	case v != Default:
+		verdict = v
 	}
-	// set verdict in queue
-	q.netlink.SetVerdict(id, toNfqVerdict(verdict))
-	return 0
+	st.md.async.cancel()
+	q.finish(st, verdict)
+}
+
+// resume is called when a deferred verdict is resolved
+func (q *queue) resume(st *packetState, v Verdict) {
+	if atomic.LoadInt32(&st.done) == 1 {
+		return
+	}
+	if st.ctx.Err() == context.DeadlineExceeded {
+		q.expire(st)
+		return
+	}
+	if v == Pending {
+		q.g.errorCh <- NewError(st.packet, fmt.Errorf("on packet qid(#%v): pending verdict not deferred", q.qid))
+		q.collector.Error(q.qid, StageHook)
+		q.finish(st, q.onError)
+		return
+	}
+	v = st.md.monitorPlugin(st.md.Plugin, v)
+	if st.hrunner.strategy.decide(st.md, v) {
+		q.finish(st, v)
+		return
+	}
+	st.md.Plugin, st.md.Action = "", ""
+	q.runHooks(st)
+}
+
+// watch expires the packet when deadline is exceeded while the verdict
+// is deferred
+func (q *queue) watch(st *packetState) {
+	deadline, ok := st.ctx.Deadline()
+	if !ok || st.watched {
+		return
+	}
+	st.watched = true
+	time.AfterFunc(time.Until(deadline), func() {
+		q.guard(func() { q.expire(st) })
+	})
+}
+
+// expire sets the timeout verdict if the packet has not been set
+func (q *queue) expire(st *packetState) {
+	if !atomic.CompareAndSwapInt32(&st.done, 0, 1) {
+		return
+	}
+	defer q.inflight.Done()
+	defer st.hrunner.pending.Done()
+	st.cancel()
+	atomic.AddUint64(&q.stats.timeouts, 1)
+	q.collector.Error(q.qid, StageTimeout)
+	q.logger.Debugf("packet %v deadline exceeded qid(#%v)", st.id, q.qid)
+	verdict := st.md.monitorAll("", "", q.cfg.OnTimeout)
+	q.logMonitor(st)
+	if st.md.trace != nil {
+		q.cfg.Tracer.finish(st.md.trace, st.md, verdict, true)
+	}
+	q.setVerdict(st.id, verdict)
+	q.notifyVerdict(st, "", verdict)
+}
+
+// guard executes fn if netlink is not closed and serialized with ticks
+func (q *queue) guard(fn func()) {
+	q.dmu.RLock()
+	defer q.dmu.RUnlock()
+	if q.nlClosed {
+		return
+	}
+	q.g.hmu.RLock()
+	defer q.g.hmu.RUnlock()
+	fn()
+}
+
+// finish sets the verdict in queue
+func (q *queue) finish(st *packetState, verdict Verdict) {
+	if !atomic.CompareAndSwapInt32(&st.done, 0, 1) {
+		return
+	}
+	defer q.inflight.Done()
+	defer st.hrunner.pending.Done()
+	st.cancel()
+	decided := verdict
+	verdict = st.md.monitorAll(st.md.Plugin, st.md.Action, verdict)
+	// set verdict in queue with the modified packet
+	var data []byte
+	if st.mangled && verdict.Kind() != Drop {
+		data, verdict = q.serialize(st, verdict)
+		verdict = st.md.monitorAll("", "", verdict)
+	}
+	q.logMonitor(st)
+	if st.md.trace != nil {
+		q.cfg.Tracer.finish(st.md.trace, st.md, verdict, false)
+	}
+	q.setVerdictModPacket(st.id, verdict, data)
+	plugin := st.md.Plugin
+	if verdict != decided {
+		plugin = ""
+	}
+	q.notifyVerdict(st, plugin, verdict)
+}
+
+// monitorAll returns Accept if the global monitor mode is set, it's used for
+// the verdicts of packets without metadata
+func (q *queue) monitorAll(id uint32, v Verdict) Verdict {
+	if v.Kind() == Accept || !q.cfg.Switches.MonitorAll() {
+		return v
+	}
+	q.collector.Monitor(q.qid, "", "", v)
+	q.logger.Infof("monitor: packet %v qid(#%v) would be %v by policy", id, q.qid, v)
+	return Accept
+}
+
+// logMonitor logs the verdict not applied because of the monitor mode
+func (q *queue) logMonitor(st *packetState) {
+	if st.md.WouldBe != Default {
+		q.logger.Infof("monitor: packet %v qid(#%v) would be %v by %s", st.id, q.qid, st.md.WouldBe, st.md.wouldBeDesc())
+	}
+}
+
+// notifyVerdict executes the verdict hooks
+func (q *queue) notifyVerdict(st *packetState, plugin string, v Verdict) {
+	for _, err := range st.hrunner.Verdict(st.packet, st.md, plugin, v) {
+		q.g.errorCh <- NewError(st.packet, fmt.Errorf("on verdict qid(#%v): %v", q.qid, err))
+		q.collector.Error(q.qid, StageHook)
+	}
+}
+
+// serialize returns the payload of the mangled packet, if it fails the
+// onerror verdict is returned
+func (q *queue) serialize(st *packetState, verdict Verdict) ([]byte, Verdict) {
+	if st.truncated {
+		q.g.errorCh <- NewError(st.packet, fmt.Errorf("can't mangle truncated packet %v qid(#%v)", st.id, q.qid))
+		q.collector.Error(q.qid, StageMangle)
+		return nil, q.onError
+	}
+	data, err := SerializePacket(st.packet)
+	if err != nil {
+		q.g.errorCh <- NewError(st.packet, fmt.Errorf("serializing packet %v qid(#%v): %v", st.id, q.qid, err))
+		q.collector.Error(q.qid, StageMangle)
+		return nil, q.onError
+	}
+	return data, verdict
+}
+
+func (q *queue) setVerdict(id uint32, v Verdict) {
+	q.setVerdictModPacket(id, v, nil)
+}
+
+func (q *queue) setVerdictModPacket(id uint32, v Verdict, payload []byte) {
+	q.vmu.Lock()
+	err := q.netlink.SetVerdict(id, v, payload)
+	q.vmu.Unlock()
+	q.collector.Backlog(q.qid, -1)
+	if err != nil {
+		q.g.errorCh <- fmt.Errorf("setting verdict %v to packet %v qid(#%v): %v", v, id, q.qid, err)
+		q.collector.Error(q.qid, StageVerdict)
+		n := atomic.AddUint32(&q.verrors, 1)
+		if MaxVerdictErrors > 0 && n == uint32(MaxVerdictErrors) {
+			q.g.fail(fmt.Errorf("nfqueue qid(#%v) failed after %v verdict errors: %v", q.qid, n, err))
+		}
+		return
+	}
+	if atomic.LoadUint32(&q.verrors) > 0 {
+		atomic.StoreUint32(&q.verrors, 0)
+	}
+	q.collector.Verdict(q.qid, v)
 }
 
 func toNfqVerdict(v Verdict) int {
-	value := nfq.NfDrop
-	if v == Accept {
-		value = nfq.NfAccept
+	switch v.Kind() {
+	case Accept:
+		return nfq.NfAccept
+	case Repeat:
+		return nfq.NfRepeat
+	case Queue:
+		return nfq.NfQeueue
+	default:
+		return nfq.NfDrop
 	}
-	return value
 }
@@ -0,0 +1,72 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"context"
+	"testing"
+
+	nfq "github.com/florianl/go-nfqueue"
+
+	"github.com/luids-io/core/yalogi"
+)
+
+// verdictsNetlink stores the verdicts set
+type verdictsNetlink struct {
+	verdicts map[uint32]Verdict
+}
+
+func (n *verdictsNetlink) Register(ctx context.Context, fn nfq.HookFunc) error { return nil }
+
+func (n *verdictsNetlink) SetVerdict(id uint32, v Verdict, payload []byte) error {
+	n.verdicts[id] = v
+	return nil
+}
+
+func (n *verdictsNetlink) Close() error { return nil }
+
+func TestDispatchClosing(t *testing.T) {
+	var tests = []struct {
+		name     string
+		closed   bool
+		nlClosed bool
+		verdict  bool
+	}{
+		{"closed", true, false, true},
+		{"netlink closed", true, true, false},
+		// waiting for a busy worker when the queue is closed
+		{"done", false, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nl := &verdictsNetlink{verdicts: make(map[uint32]Verdict)}
+			q := &queue{
+				logger:    yalogi.LogNull,
+				qid:       1,
+				policy:    Drop,
+				onError:   Accept,
+				g:         newGroup([]int{1}, nil, depthFull, yalogi.LogNull),
+				collector: nullCollector{},
+				stats:     &queueStats{},
+				netlink:   nl,
+				closed:    test.closed,
+				nlClosed:  test.nlClosed,
+				done:      make(chan struct{}),
+				workers:   []chan nfq.Attribute{make(chan nfq.Attribute)},
+			}
+			close(q.done)
+			id := uint32(10)
+			payload := []byte{0x45}
+			if ret := q.dispatch(nfq.Attribute{PacketID: &id, Payload: &payload}); ret != 0 {
+				t.Errorf("dispatch() = %v, want 0", ret)
+			}
+			v, ok := nl.verdicts[id]
+			if ok != test.verdict {
+				t.Fatalf("verdict set = %v, want %v", ok, test.verdict)
+			}
+			if ok && v != Drop {
+				t.Errorf("verdict = %v, want policy %v", v, Drop)
+			}
+		})
+	}
+}
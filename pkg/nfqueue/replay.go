@@ -0,0 +1,470 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/luids-io/core/yalogi"
+)
+
+// ReplayRecord stores the result of a replayed packet
+type ReplayRecord struct {
+	// QID is the queue that processed the packet
+	QID int
+	// N is the number of the packet in the capture file, starting with 1
+	N int
+	// Timestamp is the capture time of the packet
+	Timestamp time.Time
+	// Packet is the network packet, mangled if hooks modified it
+	Packet gopacket.Packet
+	// Mangled is true if hooks modified the packet
+	Mangled bool
+	// Verdict is the verdict applied to the packet
+	Verdict Verdict
+	// Plugin and Action that returned the verdict
+	Plugin, Action string
+	// WouldBe is the verdict not applied because of the monitor mode
+	WouldBe Verdict
+	// TimedOut is true if the processing deadline was exceeded
+	TimedOut bool
+}
+
+// Replay is a PacketProcessor that reads the packets from a pcap or pcapng
+// file instead of a netfilter queue. Packets are processed by the hooks
+// using the capture timestamps, ticks are emulated from capture time and
+// the verdict of each packet is recorded. Packets are distributed between
+// the queues of a group using the flow hash. Netlink parameters of the
+// configuration are ignored, except CopyRange and CopyMeta that are
+// emulated.
+type Replay struct {
+	fname  string
+	cfg    Config
+	logger yalogi.Logger
+
+	mu       sync.Mutex
+	onRecord func(ReplayRecord)
+	records  []ReplayRecord
+	stats    map[int]*replayStats
+}
+
+type replayStats struct {
+	packets    uint64
+	timeouts   uint64
+	lastPacket int64 //unix nano
+}
+
+// NewReplay creates a new replay processor for the capture file fname
+func NewReplay(fname string, cfg Config, logger yalogi.Logger) *Replay {
+	if cfg.OnTimeout == Default {
+		cfg.OnTimeout = cfg.OnError
+	}
+	return &Replay{
+		fname:  fname,
+		cfg:    cfg,
+		logger: logger,
+		stats:  make(map[int]*replayStats),
+	}
+}
+
+// OnRecord sets a function called with the record of each packet. If it's
+// set, records are not stored.
+func (r *Replay) OnRecord(fn func(ReplayRecord)) {
+	r.mu.Lock()
+	r.onRecord = fn
+	r.mu.Unlock()
+}
+
+// Records returns the stored records
+func (r *Replay) Records() []ReplayRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make([]ReplayRecord, len(r.records), len(r.records))
+	copy(ret, r.records)
+	return ret
+}
+
+// Stats implements StatsProcessor
+func (r *Replay) Stats(qid int) (Stats, bool) {
+	r.mu.Lock()
+	st, ok := r.stats[qid]
+	r.mu.Unlock()
+	if !ok {
+		return Stats{}, false
+	}
+	stats := Stats{
+		Packets:  atomic.LoadUint64(&st.packets),
+		Timeouts: atomic.LoadUint64(&st.timeouts),
+	}
+	if last := atomic.LoadInt64(&st.lastPacket); last > 0 {
+		stats.LastPacket = time.Unix(0, last)
+	}
+	return stats, true
+}
+
+// Process implements PacketProcessor. Capture file is replayed in
+// background and the errors channel is closed when it finishes.
+func (r *Replay) Process(qids []int, hooks *Hooks) (func(), <-chan error, error) {
+	if len(qids) == 0 {
+		return nil, nil, errors.New("qids are required")
+	}
+	f, err := os.Open(r.fname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open capture: %v", err)
+	}
+	reader, err := newCaptureReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("could not read capture %s: %v", r.fname, err)
+	}
+	rp := &replayer{
+		Replay:  r,
+		qids:    qids,
+		depth:   decodeDepth(r.cfg.requiredLayers(hooks)),
+		hrunner: newHooksRunner(hooks),
+		reader:  reader,
+		errorCh: make(chan error, ErrorsBuffer),
+		stats:   make([]*replayStats, 0, len(qids)),
+	}
+	rp.policy, rp.onError = hooks.Verdicts()
+	if rp.policy == Default {
+		rp.policy = r.cfg.Policy
+	}
+	if rp.onError == Default {
+		rp.onError = r.cfg.OnError
+	}
+	rp.copyRange = r.cfg.CopyRange
+	if rp.copyRange == 0 {
+		rp.copyRange = copyRange(rp.depth)
+	}
+	r.mu.Lock()
+	for _, qid := range qids {
+		st := &replayStats{}
+		r.stats[qid] = st
+		rp.stats = append(rp.stats, st)
+	}
+	r.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer f.Close()
+		rp.run(ctx)
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	return stop, rp.errorCh, nil
+}
+
+func (r *Replay) record(rec ReplayRecord) {
+	r.mu.Lock()
+	fn := r.onRecord
+	if fn == nil {
+		r.records = append(r.records, rec)
+	}
+	r.mu.Unlock()
+	if fn != nil {
+		fn(rec)
+	}
+}
+
+// replayer stores the state of a replay
+type replayer struct {
+	*Replay
+	qids      []int
+	depth     int
+	copyRange uint32
+	policy    Verdict
+	onError   Verdict
+	hrunner   *hooksRunner
+	reader    captureReader
+	errorCh   chan error
+	stats     []*replayStats
+
+	n          int
+	lastTick   time.Time
+	lastPacket time.Time
+}
+
+func (rp *replayer) run(ctx context.Context) {
+	defer close(rp.errorCh)
+	rp.logger.Debugf("replaying capture %s", rp.fname)
+LOOPREAD:
+	for {
+		select {
+		case <-ctx.Done():
+			break LOOPREAD
+		default:
+		}
+		data, ci, lt, err := rp.reader.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rp.errorCh <- fmt.Errorf("reading capture %s: %v", rp.fname, err)
+			break
+		}
+		rp.n++
+		rp.doTick(ci.Timestamp)
+		rp.process(data, ci, lt)
+	}
+	rp.logger.Debugf("replayed %v packets from capture %s", rp.n, rp.fname)
+	errs := rp.hrunner.Close()
+	for _, err := range errs {
+		rp.errorCh <- fmt.Errorf("on close replay %s: %v", rp.fname, err)
+	}
+}
+
+// doTick emulates ticks from capture time
+func (rp *replayer) doTick(now time.Time) {
+	if rp.lastTick.IsZero() {
+		rp.lastTick = now
+	}
+	if rp.cfg.Tick <= 0 {
+		return
+	}
+	for now.Sub(rp.lastTick) >= rp.cfg.Tick {
+		errs := rp.hrunner.Tick(rp.lastTick, rp.lastPacket)
+		for _, err := range errs {
+			rp.errorCh <- fmt.Errorf("on tick in replay %s: %v", rp.fname, err)
+		}
+		rp.lastTick = rp.lastTick.Add(rp.cfg.Tick)
+		// flows are expired using capture time
+		if rp.cfg.Flows != nil {
+			rp.cfg.Flows.Expire(rp.lastTick)
+		}
+	}
+}
+
+func (rp *replayer) process(data []byte, ci gopacket.CaptureInfo, lt layers.LinkType) {
+	rp.lastPacket = ci.Timestamp
+	// get network layer data
+	data, err := networkData(data, lt)
+	if err != nil {
+		rp.errorCh <- fmt.Errorf("packet #%v in capture %s: %v", rp.n, rp.fname, err)
+		return
+	}
+	idx := 0
+	if len(rp.qids) > 1 {
+		idx = int(flowHash(data) % uint32(len(rp.qids)))
+	}
+	qid := rp.qids[idx]
+	atomic.AddUint64(&rp.stats[idx].packets, 1)
+	atomic.StoreInt64(&rp.stats[idx].lastPacket, ci.Timestamp.UnixNano())
+	rec := ReplayRecord{QID: qid, N: rp.n, Timestamp: ci.Timestamp}
+	if rp.cfg.CopyMeta {
+		rec.Verdict = rp.policy
+		rp.monitorAll(&rec)
+		rp.record(rec)
+		return
+	}
+	// emulates copy range
+	truncated := false
+	if uint32(len(data)) > rp.copyRange {
+		data, truncated = data[:rp.copyRange], true
+	}
+	// decode network packet
+	packet := gopacket.NewPacket(data, newDecoder(ipLayerType(data), rp.depth), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	rec.Packet = packet
+	if err := packet.ErrorLayer(); err != nil {
+		if truncated {
+			rp.errorCh <- fmt.Errorf("could't convert to packet #%v in capture %s: headers exceed copy range %v", rp.n, rp.fname, rp.copyRange)
+		} else {
+			rp.errorCh <- fmt.Errorf("could't convert to packet #%v in capture %s", rp.n, rp.fname)
+		}
+		rec.Verdict = rp.onError
+		rp.monitorAll(&rec)
+		rp.record(rec)
+		return
+	}
+	md := &Metadata{
+		QID:       qid,
+		PacketID:  uint32(rp.n),
+		Timestamp: ci.Timestamp,
+		switches:  rp.cfg.Switches,
+	}
+	if rp.cfg.Tracer != nil {
+		md.trace = rp.cfg.Tracer.start(packet, md)
+	}
+	if rp.cfg.Flows != nil {
+		md.flow, md.flowReply = rp.cfg.Flows.track(packet, md.Timestamp)
+	}
+	// process packet hooks
+	rec.Verdict, rec.Packet, rec.Mangled, rec.TimedOut = rp.runHooks(packet, md)
+	decided := rec.Verdict
+	if rec.TimedOut {
+		atomic.AddUint64(&rp.stats[idx].timeouts, 1)
+		rec.Verdict = md.monitorAll("", "", rp.cfg.OnTimeout)
+	} else {
+		rec.Verdict = md.monitorAll(md.Plugin, md.Action, rec.Verdict)
+		rec.Plugin, rec.Action = md.Plugin, md.Action
+	}
+	if rec.Mangled && truncated && rec.Verdict.Kind() != Drop {
+		rp.errorCh <- NewError(packet, fmt.Errorf("can't mangle truncated packet #%v in capture %s", rp.n, rp.fname))
+		rec.Verdict = md.monitorAll("", "", rp.onError)
+	}
+	rec.WouldBe = md.WouldBe
+	if md.trace != nil {
+		rp.cfg.Tracer.finish(md.trace, md, rec.Verdict, rec.TimedOut)
+	}
+	rp.record(rec)
+	// process verdict hooks
+	plugin := md.Plugin
+	if rec.TimedOut || rec.Verdict != decided {
+		plugin = ""
+	}
+	for _, err := range rp.hrunner.Verdict(rec.Packet, md, plugin, rec.Verdict) {
+		rp.errorCh <- NewError(rec.Packet, fmt.Errorf("on verdict packet #%v in capture %s: %v", rp.n, rp.fname, err))
+	}
+}
+
+// monitorAll applies the global monitor mode to the verdict of packets
+// without metadata
+func (rp *replayer) monitorAll(rec *ReplayRecord) {
+	if rec.Verdict.Kind() != Accept && rp.cfg.Switches.MonitorAll() {
+		rec.WouldBe, rec.Verdict = rec.Verdict, Accept
+	}
+}
+
+// runHooks executes packet hooks waiting for deferred verdicts
+func (rp *replayer) runHooks(packet gopacket.Packet, md *Metadata) (Verdict, gopacket.Packet, bool, bool) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if rp.cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, rp.cfg.Timeout)
+	}
+	defer cancel()
+	resumed := make(chan Verdict, 1)
+	md.async = &asyncPacket{resume: func(v Verdict) { resumed <- v }}
+
+	mangled := false
+	for hook := 0; ; {
+		v, p, next, errs := rp.hrunner.PacketFrom(ctx, hook, packet, md)
+		if ctx.Err() == context.DeadlineExceeded {
+			md.async.cancel()
+			return Default, packet, mangled, true
+		}
+		for _, err := range errs {
+			rp.errorCh <- NewError(packet, fmt.Errorf("on packet #%v in capture %s: %v", rp.n, rp.fname, err))
+		}
+		if p != nil {
+			packet, mangled = p, true
+		}
+		if v == Pending {
+			if !md.async.returned() {
+				rp.errorCh <- NewError(packet, fmt.Errorf("on packet #%v in capture %s: pending verdict not deferred", rp.n, rp.fname))
+				return rp.onError, packet, mangled, false
+			}
+			// wait for the deferred verdict
+			select {
+			case v = <-resumed:
+			case <-ctx.Done():
+				md.async.cancel()
+				return Default, packet, mangled, true
+			}
+			if v == Pending {
+				rp.errorCh <- NewError(packet, fmt.Errorf("on packet #%v in capture %s: pending verdict not deferred", rp.n, rp.fname))
+				return rp.onError, packet, mangled, false
+			}
+			v = md.monitorPlugin(md.Plugin, v)
+			if !rp.hrunner.strategy.decide(md, v) {
+				// continue with the next hooks
+				md.Plugin, md.Action = "", ""
+				hook = next
+				continue
+			}
+		}
+		md.async.cancel()
+		if v == Default {
+			return rp.policy, packet, mangled, false
+		}
+		return v, packet, mangled, false
+	}
+}
+
+// networkData returns the data from the network layer
+func networkData(data []byte, lt layers.LinkType) ([]byte, error) {
+	if lt == layers.LinkTypeRaw || lt == layers.LinkTypeIPv4 || lt == layers.LinkTypeIPv6 {
+		return data, nil
+	}
+	packet := gopacket.NewPacket(data, lt, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	network := packet.NetworkLayer()
+	if network == nil {
+		return nil, errors.New("network layer not found")
+	}
+	offset := 0
+	for _, layer := range packet.Layers() {
+		if layer == network {
+			return data[offset:], nil
+		}
+		offset += len(layer.LayerContents())
+	}
+	return nil, errors.New("network layer not found")
+}
+
+// captureReader reads packets from pcap or pcapng files
+type captureReader interface {
+	read() ([]byte, gopacket.CaptureInfo, layers.LinkType, error)
+}
+
+func newCaptureReader(r io.Reader) (captureReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte{0x0a, 0x0d, 0x0d, 0x0a}) {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		return ngReader{ng}, nil
+	}
+	pr, err := pcapgo.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return pcapReader{pr}, nil
+}
+
+type pcapReader struct {
+	*pcapgo.Reader
+}
+
+func (r pcapReader) read() ([]byte, gopacket.CaptureInfo, layers.LinkType, error) {
+	data, ci, err := r.ReadPacketData()
+	return data, ci, r.LinkType(), err
+}
+
+type ngReader struct {
+	*pcapgo.NgReader
+}
+
+func (r ngReader) read() ([]byte, gopacket.CaptureInfo, layers.LinkType, error) {
+	data, ci, err := r.ReadPacketData()
+	if err != nil {
+		return nil, ci, 0, err
+	}
+	lt := r.LinkType()
+	if iface, err := r.Interface(ci.InterfaceIndex); err == nil {
+		lt = iface.LinkType
+	}
+	return data, ci, lt, nil
+}
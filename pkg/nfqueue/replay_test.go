@@ -0,0 +1,139 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func testIPPacket(t *testing.T) []byte {
+	return rawPacket(t,
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+			SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")},
+		&layers.UDP{SrcPort: 1024, DstPort: 8080},
+		gopacket.Payload("data"))
+}
+
+// testEthPacket returns the ip packet in an ethernet frame, the header is
+// built because serialized frames are padded
+func testEthPacket(ip []byte) []byte {
+	eth := []byte{0, 1, 2, 3, 4, 6, 0, 1, 2, 3, 4, 5, 0x08, 0x00}
+	return append(eth, ip...)
+}
+
+func TestNewCaptureReader(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ip := testIPPacket(t)
+	data := testEthPacket(ip)
+	ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}
+
+	var tests = []struct {
+		name  string
+		write func(w io.Writer) error
+		lt    layers.LinkType
+	}{
+		{"pcap",
+			func(w io.Writer) error {
+				pw := pcapgo.NewWriter(w)
+				if err := pw.WriteFileHeader(0xffff, layers.LinkTypeEthernet); err != nil {
+					return err
+				}
+				return pw.WritePacket(ci, data)
+			},
+			layers.LinkTypeEthernet},
+		{"pcapng",
+			func(w io.Writer) error {
+				ng, err := pcapgo.NewNgWriter(w, layers.LinkTypeEthernet)
+				if err != nil {
+					return err
+				}
+				if err := ng.WritePacket(ci, data); err != nil {
+					return err
+				}
+				return ng.Flush()
+			},
+			layers.LinkTypeEthernet},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := test.write(&buf); err != nil {
+				t.Fatalf("writing capture: %v", err)
+			}
+			r, err := newCaptureReader(&buf)
+			if err != nil {
+				t.Fatalf("newCaptureReader() err = %v", err)
+			}
+			got, gotCi, lt, err := r.read()
+			if err != nil {
+				t.Fatalf("read() err = %v", err)
+			}
+			if !bytes.Equal(got, data) || !gotCi.Timestamp.Equal(ts) || lt != test.lt {
+				t.Errorf("read() = %x %v %v, want %x %v %v", got, gotCi.Timestamp, lt, data, ts, test.lt)
+			}
+			if _, _, _, err := r.read(); err != io.EOF {
+				t.Errorf("read() at end err = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestNewCaptureReaderErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", []byte("this isn't a capture file, only text")},
+		{"short pcapng", []byte{0x0a, 0x0d, 0x0d, 0x0a, 0x00}},
+	}
+	for _, test := range tests {
+		if _, err := newCaptureReader(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("newCaptureReader(%s): expected error", test.name)
+		}
+	}
+}
+
+func TestNetworkData(t *testing.T) {
+	ip := testIPPacket(t)
+	var tests = []struct {
+		name    string
+		data    []byte
+		lt      layers.LinkType
+		want    []byte
+		wantErr bool
+	}{
+		{"ethernet", testEthPacket(ip), layers.LinkTypeEthernet, ip, false},
+		{"raw", ip, layers.LinkTypeRaw, ip, false},
+		{"ipv4", ip, layers.LinkTypeIPv4, ip, false},
+		{"linux sll",
+			append([]byte{0, 0, 0, 1, 0, 6, 0, 1, 2, 3, 4, 5, 0, 0, 0x08, 0x00}, ip...),
+			layers.LinkTypeLinuxSLL, ip, false},
+		{"no network layer",
+			rawPacket(t, &layers.Ethernet{
+				SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+				DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+				EthernetType: layers.EthernetTypeLLC,
+			}, gopacket.Payload("data")),
+			layers.LinkTypeEthernet, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := networkData(test.data, test.lt)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("networkData() err = %v, wantErr %v", err, test.wantErr)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("networkData() = %x, want %x", got, test.want)
+			}
+		})
+	}
+}
@@ -5,9 +5,12 @@ package nfqueue
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/luids-io/core/yalogi"
 )
@@ -15,9 +18,13 @@ import (
 // PacketService manages multiple nfqueues
 type PacketService struct {
 	proc    PacketProcessor
-	queues  map[int]*queueSource
+	groups  map[string]*queueGroup
+	qids    map[int]string
 	plugins []Plugin
-	logger  yalogi.Logger
+	// refs counts the groups using the plugins
+	refs   *pluginRefs
+	opts   options
+	logger yalogi.Logger
 	//control
 	wg      sync.WaitGroup
 	mu      sync.Mutex
@@ -26,11 +33,16 @@ type PacketService struct {
 }
 
 type options struct {
-	logger yalogi.Logger
+	logger     yalogi.Logger
+	backoff    time.Duration
+	maxBackoff time.Duration
+	bypass     PacketProcessor
 }
 
 var defaultOptions = options{
-	logger: yalogi.LogNull,
+	logger:     yalogi.LogNull,
+	backoff:    time.Second,
+	maxBackoff: time.Minute,
 }
 
 // Option encapsules options for server
@@ -43,6 +55,25 @@ func SetLogger(l yalogi.Logger) Option {
 	}
 }
 
+// SetRestart option sets the backoff restarting failed queues, the delay
+// is doubled after each consecutive failure up to max. A zero backoff
+// disables restarts.
+func SetRestart(backoff, max time.Duration) Option {
+	return func(o *options) {
+		o.backoff = backoff
+		o.maxBackoff = max
+	}
+}
+
+// SetBypass option sets the processor used while failed queues are waiting
+// for a restart, it must be configured to apply a verdict to all packets
+// without hooks (ie: copying only metadata).
+func SetBypass(p PacketProcessor) Option {
+	return func(o *options) {
+		o.bypass = p
+	}
+}
+
 // NewService creates a new Service
 func NewService(p PacketProcessor, plugins []Plugin, opt ...Option) *PacketService {
 	opts := defaultOptions
@@ -50,10 +81,13 @@ func NewService(p PacketProcessor, plugins []Plugin, opt ...Option) *PacketServi
 		o(&opts)
 	}
 	s := &PacketService{
+		opts:    opts,
 		logger:  opts.logger,
 		proc:    p,
-		queues:  make(map[int]*queueSource),
+		groups:  make(map[string]*queueGroup),
+		qids:    make(map[int]string),
 		plugins: plugins,
+		refs:    newPluginRefs(),
 	}
 	return s
 }
@@ -68,11 +102,15 @@ func (s *PacketService) Start() error {
 	s.logger.Infof("starting netfilter queue processing service")
 	// create errors channel and process it
 	s.errCh = make(chan error, ErrorsBuffer)
-	go s.procErrs()
+	go s.procErrs(s.errCh)
 	s.started = true
-	// start processing all registered sources
-	for _, src := range s.queues {
-		s.doStart(src)
+	// start processing all registered groups
+	for _, g := range s.groups {
+		err := s.doStart(g)
+		if err != nil {
+			s.logger.Warnf("starting nfqueue group %s: %v", g.name, err)
+			s.supervise(g, 0)
+		}
 	}
 	return nil
 }
@@ -85,101 +123,491 @@ func (s *PacketService) Shutdown() {
 		return
 	}
 	s.logger.Infof("shutting down netfilter queue processing service")
-	for _, src := range s.queues {
-		src.stop()
+	for _, g := range s.groups {
+		s.doStop(g)
 	}
 	s.wg.Wait()
 	close(s.errCh)
 	s.started = false
 }
 
-type queueSource struct {
-	qid     int
-	started bool
+// queueGroup stores queues sharing the packet processing pipeline
+type queueGroup struct {
+	name    string
+	qids    []int
+	cfg     GroupConfig
+	running int32 //atomic access
 	stop    func()
 	errCh   <-chan error
+	// stopping is set if the service stops the group, atomic access
+	stopping int32
+	// status and supervision are protected by service mutex
+	started    time.Time
+	restarts   int
+	failures   int
+	plugins    []string
+	timer      *time.Timer
+	bypassStop func()
+	// emu protects last error
+	emu       sync.Mutex
+	lastErr   error
+	lastErrAt time.Time
+}
+
+func (g *queueGroup) isRunning() bool {
+	return atomic.LoadInt32(&g.running) == 1
+}
+
+func (g *queueGroup) setError(err error) {
+	g.emu.Lock()
+	g.lastErr, g.lastErrAt = err, time.Now()
+	g.emu.Unlock()
+}
+
+func (g *queueGroup) lastError() (string, time.Time) {
+	g.emu.Lock()
+	defer g.emu.Unlock()
+	if g.lastErr == nil {
+		return "", time.Time{}
+	}
+	return g.lastErr.Error(), g.lastErrAt
+}
+
+// GroupConfig defines the packet processing of a group of queues
+type GroupConfig struct {
+	// Plugins are the names of the plugins run in order, if empty all the
+	// plugins of the service are run. The priority of the plugins overrides
+	// this order, so it only applies to plugins with the same priority.
+	Plugins []string
+	// Policy and OnError verdicts override the configuration of the
+	// processor if they are not Default
+	Policy  Verdict
+	OnError Verdict
+	// Strategy combines the verdicts of the plugins
+	Strategy Strategy
+}
+
+// GroupStatus stores the status of a group of queues
+type GroupStatus struct {
+	Name    string
+	QIDs    []int
+	Running bool
+	// Stats are the sum of the counters of the queues
+	Stats Stats
+}
+
+// QueueStatus stores the status of a queue
+type QueueStatus struct {
+	QID int
+	// Group is the name of the group of the queue
+	Group   string
+	Running bool
+	// Started is the last time the queue was started
+	Started time.Time
+	Stats   Stats
+	// LastError is the last error reported by the group of the queue
+	LastError   string
+	LastErrorAt time.Time
+	// Restarts is the number of times the queue was restarted after a failure
+	Restarts int
+	// Bypass is true if the queue is failed and the bypass processor
+	// applies the verdict to its packets
+	Bypass bool
+	// Plugins is the chain of plugins processing the packets
+	Plugins []string
+}
+
+// desc returns the description of the status used by ping
+func (st QueueStatus) desc() string {
+	state := st.Stats.State
+	if st.Bypass {
+		state = QueueFailed
+	}
+	fields := []string{
+		fmt.Sprintf("restarts=%v", st.Restarts),
+		fmt.Sprintf("packets=%v", st.Stats.Packets),
+	}
+	if !st.Stats.LastPacket.IsZero() {
+		fields = append(fields, fmt.Sprintf("lastpacket=%s", st.Stats.LastPacket.Format(time.RFC3339)))
+	}
+	if st.LastError != "" {
+		fields = append(fields, fmt.Sprintf("lasterror=%q", st.LastError))
+	}
+	if st.Bypass {
+		fields = append(fields, "bypass")
+	}
+	return fmt.Sprintf("qid(#%v) %v (%s)", st.QID, state, strings.Join(fields, " "))
 }
 
-// Register packet source with name and start it if service is started
+// Register queue by id and start it if service is started
 func (s *PacketService) Register(qid int) error {
+	return s.RegisterGroup(strconv.Itoa(qid), []int{qid})
+}
+
+// RegisterGroup registers a group of queues that share the packet
+// processing pipeline and start it if service is started. It's used
+// for load balancing packets between multiple queues.
+func (s *PacketService) RegisterGroup(name string, qids []int) error {
+	return s.RegisterGroupWith(name, qids, GroupConfig{})
+}
+
+// RegisterGroupWith registers a group of queues like RegisterGroup but
+// running the chain of plugins and the verdicts defined in cfg. If the
+// service is started and the group can't be started, it isn't registered.
+func (s *PacketService) RegisterGroupWith(name string, qids []int, cfg GroupConfig) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.logger.Debugf("registering nfqueue %v", qid)
-	_, ok := s.queues[qid]
+	s.logger.Debugf("registering nfqueue group %s %v", name, qids)
+	if len(qids) == 0 {
+		return errors.New("qids are required")
+	}
+	_, ok := s.groups[name]
 	if ok {
-		return errors.New("queue id exists")
+		return errors.New("group name exists")
+	}
+	for _, qid := range qids {
+		if _, ok := s.qids[qid]; ok {
+			return fmt.Errorf("queue id %v exists", qid)
+		}
+	}
+	_, err := chainPlugins(cfg.Plugins, s.plugins)
+	if err != nil {
+		return err
+	}
+	g := &queueGroup{name: name, qids: make([]int, len(qids)), cfg: cfg}
+	copy(g.qids, qids)
+	g.cfg.Plugins = make([]string, len(cfg.Plugins))
+	copy(g.cfg.Plugins, cfg.Plugins)
+	s.groups[name] = g
+	for _, qid := range qids {
+		s.qids[qid] = name
 	}
-	src := &queueSource{qid: qid}
-	s.queues[qid] = src
 	if s.started {
-		s.doStart(src)
+		err := s.doStart(g)
+		if err != nil {
+			for _, qid := range qids {
+				delete(s.qids, qid)
+			}
+			delete(s.groups, name)
+		}
+		return err
 	}
 	return nil
 }
 
 // Unregister queue by id, stopping if it's started
 func (s *PacketService) Unregister(qid int) error {
+	s.mu.Lock()
+	name, ok := s.qids[qid]
+	if ok && len(s.groups[name].qids) > 1 {
+		s.mu.Unlock()
+		return fmt.Errorf("nfqueue is in group %s", name)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errors.New("nfqueue doesn't exists")
+	}
+	return s.UnregisterGroup(name)
+}
+
+// UnregisterGroup by name, stopping if it's started
+func (s *PacketService) UnregisterGroup(name string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.logger.Debugf("unregistering nfqueue %s", qid)
-	src, ok := s.queues[qid]
+	s.logger.Debugf("unregistering nfqueue group %s", name)
+	g, ok := s.groups[name]
 	if !ok {
-		return errors.New("nfqueue doesn't exists")
+		return errors.New("group doesn't exists")
+	}
+	if s.started {
+		s.doStop(g)
 	}
-	if s.started && src.started {
-		src.stop()
+	for _, qid := range g.qids {
+		delete(s.qids, qid)
 	}
-	delete(s.queues, qid)
+	delete(s.groups, name)
 	return nil
 }
 
-// Ping returns true if errors
+// Groups returns the status of the registered groups
+func (s *PacketService) Groups() []GroupStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]GroupStatus, 0, len(s.groups))
+	for _, g := range s.groups {
+		ret = append(ret, s.status(g))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].QIDs[0] < ret[j].QIDs[0] })
+	return ret
+}
+
+// Group returns the status of the group
+func (s *PacketService) Group(name string) (GroupStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[name]
+	if !ok {
+		return GroupStatus{}, false
+	}
+	return s.status(g), true
+}
+
+func (s *PacketService) status(g *queueGroup) GroupStatus {
+	st := GroupStatus{Name: g.name, QIDs: make([]int, len(g.qids)), Running: g.isRunning()}
+	copy(st.QIDs, g.qids)
+	if sp, ok := s.proc.(StatsProcessor); ok {
+		for _, qid := range g.qids {
+			qstats, ok := sp.Stats(qid)
+			if ok {
+				st.Stats = st.Stats.Add(qstats)
+			}
+		}
+	}
+	return st
+}
+
+// Reload replaces the plugins of the service. The hooks of the running
+// groups are swapped without stopping the queues, if it fails in a group,
+// the previous plugins are restored in all of them. The previous hooks are
+// closed only when all the groups are swapped and their packets in process
+// finish, the close hooks of a plugin shared by several groups are executed
+// once. The plugins required by the chains of the groups must exist.
+func (s *PacketService) Reload(plugins []Plugin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger.Infof("reloading nfqueue plugins")
+	running := make([]*queueGroup, 0, len(s.groups))
+	for _, g := range s.groups {
+		_, err := chainPlugins(g.cfg.Plugins, plugins)
+		if err != nil {
+			return fmt.Errorf("reloading nfqueue group %s: %v", g.name, err)
+		}
+		if g.isRunning() {
+			running = append(running, g)
+		}
+	}
+	rp, ok := s.proc.(ReloadProcessor)
+	if !ok && len(running) > 0 {
+		return errors.New("processor doesn't support reload")
+	}
+	refs := newPluginRefs()
+	reloaded := make([]*queueGroup, 0, len(running))
+	closers := make([]func(), 0, len(running))
+	for _, g := range running {
+		hooks, names := g.pipeline(plugins, refs)
+		closeOld, err := rp.Reload(g.qids, hooks)
+		if err != nil {
+			// restore previous plugins and close the new ones, the
+			// replaced hooks are closed too because the restored hooks
+			// hold the previous plugins
+			for _, rg := range reloaded {
+				hooks, names := rg.pipeline(s.plugins, s.refs)
+				closeNew, rerr := rp.Reload(rg.qids, hooks)
+				if rerr != nil {
+					s.logger.Errorf("restoring plugins in nfqueue group %s: %v", rg.name, rerr)
+					continue
+				}
+				closeNew()
+				rg.plugins = names
+			}
+			for _, closeOld := range closers {
+				closeOld()
+			}
+			return fmt.Errorf("reloading nfqueue group %s: %v", g.name, err)
+		}
+		g.plugins = names
+		reloaded = append(reloaded, g)
+		closers = append(closers, closeOld)
+	}
+	for _, closeOld := range closers {
+		closeOld()
+	}
+	s.plugins, s.refs = plugins, refs
+	return nil
+}
+
+// Queues returns the status of the registered queues
+func (s *PacketService) Queues() []QueueStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]QueueStatus, 0, len(s.qids))
+	for qid, name := range s.qids {
+		ret = append(ret, s.queueStatus(qid, s.groups[name]))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].QID < ret[j].QID })
+	return ret
+}
+
+// Queue returns the status of the queue
+func (s *PacketService) Queue(qid int) (QueueStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.qids[qid]
+	if !ok {
+		return QueueStatus{}, false
+	}
+	return s.queueStatus(qid, s.groups[name]), true
+}
+
+func (s *PacketService) queueStatus(qid int, g *queueGroup) QueueStatus {
+	st := QueueStatus{
+		QID:      qid,
+		Group:    g.name,
+		Running:  g.isRunning(),
+		Started:  g.started,
+		Restarts: g.restarts,
+		Bypass:   g.bypassStop != nil,
+		Plugins:  make([]string, len(g.plugins)),
+	}
+	copy(st.Plugins, g.plugins)
+	st.LastError, st.LastErrorAt = g.lastError()
+	if sp, ok := s.proc.(StatsProcessor); ok {
+		st.Stats, _ = sp.Stats(qid)
+	}
+	return st
+}
+
+// Ping returns an error describing the status of the stopped queues, it's
+// used by the health server
 func (s *PacketService) Ping() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if !s.started {
 		return errors.New("service not started")
 	}
-	errs := make([]string, 0, len(s.queues))
-	for _, src := range s.queues {
-		if !src.started {
-			errs = append(errs, strconv.Itoa(src.qid))
+	errs := make([]string, 0, len(s.qids))
+	for qid, name := range s.qids {
+		g := s.groups[name]
+		if g.isRunning() {
+			continue
 		}
+		errs = append(errs, s.queueStatus(qid, g).desc())
 	}
-	return fmt.Errorf("netfilter queues stopped: %s", strings.Join(errs, ","))
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return fmt.Errorf("netfilter queues stopped: %s", strings.Join(errs, ", "))
 }
 
-//start packet source
-func (s *PacketService) doStart(src *queueSource) error {
-	s.logger.Infof("starting nfqueue #%v", src.qid)
-	hooks := NewHooks()
-	for _, p := range s.plugins {
-		p.Register(hooks)
-	}
+//start group of queues
+func (s *PacketService) doStart(g *queueGroup) error {
+	s.logger.Infof("starting nfqueue group %s %v", g.name, g.qids)
+	hooks, plugins := g.pipeline(s.plugins, s.refs)
 	var err error
-	src.stop, src.errCh, err = s.proc.Process(src.qid, hooks)
+	g.stop, g.errCh, err = s.proc.Process(g.qids, hooks)
 	if err != nil {
+		g.setError(err)
 		return err
 	}
-	src.started = true
+	g.started, g.plugins = time.Now(), plugins
+	atomic.StoreInt32(&g.stopping, 0)
+	atomic.StoreInt32(&g.running, 1)
 	s.wg.Add(1)
 	//processing error channel goroutine
-	go func(c <-chan error) {
+	go func(c <-chan error, stop func(), started time.Time) {
 		for n := range c {
+			g.setError(n)
 			s.errCh <- n
 		}
-		s.logger.Infof("stopping nfqueue source %v", src.qid)
-		src.started = false
+		atomic.StoreInt32(&g.running, 0)
+		failed := atomic.LoadInt32(&g.stopping) == 0
 		s.wg.Done()
-	}(src.errCh)
+		if !failed {
+			s.logger.Infof("stopping nfqueue group %s", g.name)
+			return
+		}
+		s.logger.Errorf("nfqueue group %s failed", g.name)
+		stop()
+		s.mu.Lock()
+		s.supervise(g, time.Since(started))
+		s.mu.Unlock()
+	}(g.errCh, g.stop, g.started)
 	return nil
 }
 
+// pipeline returns the hooks and the names of the plugins of the group,
+// the chain of plugins must be checked before
+func (g *queueGroup) pipeline(plugins []Plugin, refs *pluginRefs) (*Hooks, []string) {
+	hooks, _ := newGroupHooks(g.cfg, plugins, refs)
+	chain, _ := chainPlugins(g.cfg.Plugins, plugins)
+	names := make([]string, 0, len(chain))
+	for _, p := range chain {
+		names = append(names, p.Name())
+	}
+	return hooks, names
+}
+
+// NewGroupHooks returns the hooks run by the service in a group of queues
+// defined by cfg, it can be used to run the same pipeline in other
+// processors. The plugins of the chain must exist.
+func NewGroupHooks(cfg GroupConfig, plugins []Plugin) (*Hooks, error) {
+	return newGroupHooks(cfg, plugins, nil)
+}
+
+// newGroupHooks returns the hooks of the group, the close hooks of the
+// plugins are executed when refs is released by all the runners
+func newGroupHooks(cfg GroupConfig, plugins []Plugin, refs *pluginRefs) (*Hooks, error) {
+	chain, err := chainPlugins(cfg.Plugins, plugins)
+	if err != nil {
+		return nil, err
+	}
+	hooks := NewHooks()
+	hooks.refs = refs
+	hooks.SetVerdicts(cfg.Policy, cfg.OnError)
+	hooks.SetStrategy(cfg.Strategy)
+	for _, p := range chain {
+		hooks.Add(p)
+	}
+	return hooks, nil
+}
+
+// chainPlugins returns the plugins in the order of names, all plugins if
+// names is empty
+func chainPlugins(names []string, plugins []Plugin) ([]Plugin, error) {
+	if len(names) == 0 {
+		return plugins, nil
+	}
+	chain := make([]Plugin, 0, len(names))
+	for _, name := range names {
+		var found Plugin
+		for _, p := range plugins {
+			if p.Name() == name {
+				found = p
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("plugin '%s' not found", name)
+		}
+		for _, p := range chain {
+			if p.Name() == name {
+				return nil, fmt.Errorf("plugin '%s' is repeated", name)
+			}
+		}
+		chain = append(chain, found)
+	}
+	return chain, nil
+}
+
+//stop group of queues, restart and bypass
+func (s *PacketService) doStop(g *queueGroup) {
+	atomic.StoreInt32(&g.stopping, 1)
+	if g.timer != nil {
+		g.timer.Stop()
+		g.timer = nil
+	}
+	s.stopBypass(g)
+	if g.isRunning() {
+		g.stop()
+	}
+}
+
 //routine for processing error services
-func (s *PacketService) procErrs() {
-	for err := range s.errCh {
+func (s *PacketService) procErrs(errCh <-chan error) {
+	for err := range errCh {
 		s.logger.Warnf("%v", err)
 	}
 }
@@ -0,0 +1,503 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/luids-io/core/yalogi"
+	"github.com/luids-io/netfilter/pkg/nfqueue"
+	"github.com/luids-io/netfilter/pkg/nfqueue/nfqueuetest"
+)
+
+const testQID = 1
+
+var testWait = 2 * time.Second
+
+// testPlugin registers the hooks of the register function
+type testPlugin struct {
+	name     string
+	register func(*nfqueue.Hooks)
+}
+
+func (p testPlugin) Name() string                 { return p.name }
+func (p testPlugin) Class() string                { return "test" }
+func (p testPlugin) Register(h *nfqueue.Hooks)    { p.register(h) }
+func (p testPlugin) Layers() []gopacket.LayerType { return []gopacket.LayerType{layers.LayerTypeIPv4} }
+func (p testPlugin) CleanUp()                     {}
+
+// verdictPlugin returns the verdict to all packets
+func verdictPlugin(name string, v nfqueue.Verdict) nfqueue.Plugin {
+	return testPlugin{name: name, register: func(h *nfqueue.Hooks) {
+		h.OnPacket(layers.LayerTypeIPv4, func(context.Context, gopacket.Packet, *nfqueue.Metadata) (nfqueue.Verdict, error) {
+			return v, nil
+		})
+	}}
+}
+
+// deferPlugin defers the verdict of all packets and resolves it after delay
+func deferPlugin(name string, v nfqueue.Verdict, delay time.Duration) nfqueue.Plugin {
+	return testPlugin{name: name, register: func(h *nfqueue.Hooks) {
+		h.OnPacket(layers.LayerTypeIPv4, func(_ context.Context, _ gopacket.Packet, md *nfqueue.Metadata) (nfqueue.Verdict, error) {
+			resolve, ok := md.Defer(0, nfqueue.Default)
+			if !ok {
+				return v, nil
+			}
+			go func() {
+				time.Sleep(delay)
+				resolve(v)
+			}()
+			return nfqueue.Pending, nil
+		})
+	}}
+}
+
+// tickPlugin notifies ticks in the channel
+func tickPlugin(name string, ticks chan<- time.Time) nfqueue.Plugin {
+	return testPlugin{name: name, register: func(h *nfqueue.Hooks) {
+		h.OnTick(func(lastTick, lastPacket time.Time) error {
+			select {
+			case ticks <- lastTick:
+			default:
+			}
+			return nil
+		})
+	}}
+}
+
+// closePlugin counts the executions of its close hook
+func closePlugin(name string, closes *int32) nfqueue.Plugin {
+	return testPlugin{name: name, register: func(h *nfqueue.Hooks) {
+		h.OnClose(func() error {
+			atomic.AddInt32(closes, 1)
+			return nil
+		})
+	}}
+}
+
+func testPacket(t *testing.T) []byte {
+	t.Helper()
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("10.0.0.1"),
+		DstIP:    net.ParseIP("10.0.0.2"),
+	}
+	udp := &layers.UDP{SrcPort: 1024, DstPort: 8080}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload([]byte("test")))
+	if err != nil {
+		t.Fatalf("serializing packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// startService starts a service processing the test queue in memory
+func startService(t *testing.T, cfg nfqueue.Config, plugins []nfqueue.Plugin, opt ...nfqueue.Option) (*nfqueue.PacketService, *nfqueuetest.Netlink) {
+	t.Helper()
+	nl := nfqueuetest.New()
+	cfg.Netlink = nl.Open
+	svc := nfqueue.NewService(nfqueue.NewProcessor(cfg, yalogi.LogNull), plugins, opt...)
+	err := svc.Register(testQID)
+	if err != nil {
+		t.Fatalf("registering queue: %v", err)
+	}
+	err = svc.Start()
+	if err != nil {
+		t.Fatalf("starting service: %v", err)
+	}
+	return svc, nl
+}
+
+func testQueue(t *testing.T, nl *nfqueuetest.Netlink) *nfqueuetest.Queue {
+	t.Helper()
+	q, ok := nl.Queue(testQID)
+	if !ok {
+		t.Fatalf("queue %v not opened", testQID)
+	}
+	return q
+}
+
+func waitVerdict(t *testing.T, q *nfqueuetest.Queue, id uint32) nfqueue.Verdict {
+	t.Helper()
+	select {
+	case v := <-q.Verdicts():
+		if v.ID != id {
+			t.Fatalf("verdict id = %v, want %v", v.ID, id)
+		}
+		return v.Verdict
+	case <-time.After(testWait):
+		t.Fatalf("timeout waiting verdict of packet %v", id)
+	}
+	return nfqueue.Default
+}
+
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting %s", desc)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServiceVerdicts(t *testing.T) {
+	var tests = []struct {
+		name    string
+		cfg     nfqueue.Config
+		plugins []nfqueue.Plugin
+		want    nfqueue.Verdict
+	}{
+		{"policy",
+			nfqueue.Config{Policy: nfqueue.Accept},
+			nil,
+			nfqueue.Accept},
+		{"plugin",
+			nfqueue.Config{Policy: nfqueue.Accept},
+			[]nfqueue.Plugin{verdictPlugin("p1", nfqueue.Drop)},
+			nfqueue.Drop},
+		{"plugin default",
+			nfqueue.Config{Policy: nfqueue.Drop},
+			[]nfqueue.Plugin{verdictPlugin("p1", nfqueue.Default)},
+			nfqueue.Drop},
+		{"first match",
+			nfqueue.Config{Policy: nfqueue.Drop},
+			[]nfqueue.Plugin{verdictPlugin("p1", nfqueue.Accept), verdictPlugin("p2", nfqueue.Drop)},
+			nfqueue.Accept},
+		{"deferred",
+			nfqueue.Config{Policy: nfqueue.Accept},
+			[]nfqueue.Plugin{deferPlugin("p1", nfqueue.Drop, 10*time.Millisecond)},
+			nfqueue.Drop},
+		{"workers",
+			nfqueue.Config{Policy: nfqueue.Accept, Workers: 2},
+			[]nfqueue.Plugin{verdictPlugin("p1", nfqueue.Drop)},
+			nfqueue.Drop},
+	}
+	data := testPacket(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc, nl := startService(t, test.cfg, test.plugins)
+			defer svc.Shutdown()
+			q := testQueue(t, nl)
+			id, err := q.Inject(data)
+			if err != nil {
+				t.Fatalf("injecting packet: %v", err)
+			}
+			if got := waitVerdict(t, q, id); got != test.want {
+				t.Errorf("verdict = %v, want %v", got, test.want)
+			}
+			st, _ := svc.Queue(testQID)
+			if st.Stats.Packets != 1 {
+				t.Errorf("packets = %v, want 1", st.Stats.Packets)
+			}
+		})
+	}
+}
+
+func TestServiceTick(t *testing.T) {
+	var tests = []struct {
+		name string
+		tick time.Duration
+		want bool
+	}{
+		{"tick", 10 * time.Millisecond, true},
+		{"disabled", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ticks := make(chan time.Time, 1)
+			cfg := nfqueue.Config{Policy: nfqueue.Accept, Tick: test.tick}
+			svc, _ := startService(t, cfg, []nfqueue.Plugin{tickPlugin("p1", ticks)})
+			defer svc.Shutdown()
+			var got bool
+			select {
+			case <-ticks:
+				got = true
+			case <-time.After(100 * time.Millisecond):
+			}
+			if got != test.want {
+				t.Errorf("ticked = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServiceClose(t *testing.T) {
+	var tests = []struct {
+		name       string
+		workers    int
+		unregister bool
+	}{
+		{"shutdown", 0, false},
+		{"shutdown workers", 2, false},
+		{"unregister", 0, true},
+	}
+	data := testPacket(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := nfqueue.Config{Policy: nfqueue.Accept, Workers: test.workers}
+			plugins := []nfqueue.Plugin{deferPlugin("p1", nfqueue.Drop, 50*time.Millisecond)}
+			svc, nl := startService(t, cfg, plugins)
+			defer svc.Shutdown()
+			q := testQueue(t, nl)
+			id, err := q.Inject(data)
+			if err != nil {
+				t.Fatalf("injecting packet: %v", err)
+			}
+			// pending packet is drained before closing the queue
+			if test.unregister {
+				err = svc.Unregister(testQID)
+				if err != nil {
+					t.Fatalf("unregistering queue: %v", err)
+				}
+			} else {
+				svc.Shutdown()
+			}
+			select {
+			case <-q.Closed():
+			default:
+				t.Fatal("queue is not closed")
+			}
+			select {
+			case v := <-q.Verdicts():
+				if v.ID != id || v.Verdict != nfqueue.Drop {
+					t.Errorf("verdict = %v %v, want %v %v", v.ID, v.Verdict, id, nfqueue.Drop)
+				}
+			default:
+				t.Error("pending packet without verdict")
+			}
+			if _, err := q.Inject(data); err == nil {
+				t.Error("injecting in closed queue: expected error")
+			}
+		})
+	}
+}
+
+func TestServiceVerdictErrors(t *testing.T) {
+	defer func(n int) { nfqueue.MaxVerdictErrors = n }(nfqueue.MaxVerdictErrors)
+	nfqueue.MaxVerdictErrors = 3
+
+	var tests = []struct {
+		name    string
+		errors  int
+		restart bool
+	}{
+		{"below max", 1, false},
+		{"failed", 3, true},
+	}
+	data := testPacket(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := nfqueue.Config{Policy: nfqueue.Accept}
+			restart := nfqueue.SetRestart(10*time.Millisecond, 10*time.Millisecond)
+			svc, nl := startService(t, cfg, nil, restart)
+			defer svc.Shutdown()
+			q := testQueue(t, nl)
+			q.FailVerdicts(errors.New("broken netlink"))
+			for i := 0; i < test.errors; i++ {
+				_, err := q.Inject(data)
+				if err != nil {
+					t.Fatalf("injecting packet: %v", err)
+				}
+			}
+			// errors reach the service
+			waitFor(t, "verdict error", func() bool {
+				st, _ := svc.Queue(testQID)
+				return strings.Contains(st.LastError, "broken netlink")
+			})
+			if test.restart {
+				waitFor(t, "restart", func() bool {
+					st, _ := svc.Queue(testQID)
+					return st.Running && st.Restarts == 1
+				})
+				select {
+				case <-q.Closed():
+				default:
+					t.Fatal("failed queue is not closed")
+				}
+				q = testQueue(t, nl)
+			} else {
+				q.FailVerdicts(nil)
+			}
+			id, err := q.Inject(data)
+			if err != nil {
+				t.Fatalf("injecting packet: %v", err)
+			}
+			if got := waitVerdict(t, q, id); got != nfqueue.Accept {
+				t.Errorf("verdict = %v, want %v", got, nfqueue.Accept)
+			}
+			st, _ := svc.Queue(testQID)
+			if st.Stats.Packets != uint64(test.errors+1) {
+				t.Errorf("packets = %v, want %v", st.Stats.Packets, test.errors+1)
+			}
+			if !test.restart && st.Restarts != 0 {
+				t.Errorf("restarts = %v, want 0", st.Restarts)
+			}
+		})
+	}
+}
+
+func TestServiceReloadClose(t *testing.T) {
+	var oldCloses, newCloses int32
+	cfg := nfqueue.Config{Policy: nfqueue.Accept}
+	svc, _ := startService(t, cfg, []nfqueue.Plugin{closePlugin("p1", &oldCloses)})
+	defer svc.Shutdown()
+	// plugin shared by two groups
+	err := svc.Register(testQID + 1)
+	if err != nil {
+		t.Fatalf("registering queue: %v", err)
+	}
+	err = svc.Reload([]nfqueue.Plugin{closePlugin("p1", &newCloses)})
+	if err != nil {
+		t.Fatalf("reloading plugins: %v", err)
+	}
+	if n := atomic.LoadInt32(&oldCloses); n != 1 {
+		t.Errorf("replaced plugin closed %v times, want 1", n)
+	}
+	// closed when the last group using it is closed
+	err = svc.Unregister(testQID)
+	if err != nil {
+		t.Fatalf("unregistering queue: %v", err)
+	}
+	if n := atomic.LoadInt32(&newCloses); n != 0 {
+		t.Errorf("plugin in use closed %v times, want 0", n)
+	}
+	err = svc.Unregister(testQID + 1)
+	if err != nil {
+		t.Fatalf("unregistering queue: %v", err)
+	}
+	if n := atomic.LoadInt32(&newCloses); n != 1 {
+		t.Errorf("plugin closed %v times, want 1", n)
+	}
+}
+
+func TestServiceReloadDrain(t *testing.T) {
+	var closes int32
+	cfg := nfqueue.Config{Policy: nfqueue.Accept}
+	plugins := []nfqueue.Plugin{
+		deferPlugin("p1", nfqueue.Drop, 50*time.Millisecond),
+		closePlugin("p2", &closes),
+	}
+	svc, nl := startService(t, cfg, plugins)
+	defer svc.Shutdown()
+	q := testQueue(t, nl)
+	id, err := q.Inject(testPacket(t))
+	if err != nil {
+		t.Fatalf("injecting packet: %v", err)
+	}
+	// replaced hooks are closed after the pending packet
+	err = svc.Reload([]nfqueue.Plugin{verdictPlugin("p1", nfqueue.Accept), verdictPlugin("p2", nfqueue.Accept)})
+	if err != nil {
+		t.Fatalf("reloading plugins: %v", err)
+	}
+	if n := atomic.LoadInt32(&closes); n != 1 {
+		t.Errorf("replaced plugin closed %v times, want 1", n)
+	}
+	select {
+	case v := <-q.Verdicts():
+		if v.ID != id || v.Verdict != nfqueue.Drop {
+			t.Errorf("verdict = %v %v, want %v %v", v.ID, v.Verdict, id, nfqueue.Drop)
+		}
+	default:
+		t.Error("replaced hooks closed before the verdict of the pending packet")
+	}
+}
+
+func TestServiceMonitorAll(t *testing.T) {
+	var tests = []struct {
+		name    string
+		cfg     nfqueue.Config
+		plugins []nfqueue.Plugin
+		data    []byte
+	}{
+		{"policy",
+			nfqueue.Config{Policy: nfqueue.Drop},
+			nil,
+			testPacket(t)},
+		{"plugin",
+			nfqueue.Config{Policy: nfqueue.Accept},
+			[]nfqueue.Plugin{verdictPlugin("p1", nfqueue.Drop)},
+			testPacket(t)},
+		{"copy meta",
+			nfqueue.Config{Policy: nfqueue.Drop, CopyMeta: true},
+			nil,
+			testPacket(t)},
+		{"decode error",
+			nfqueue.Config{Policy: nfqueue.Accept, OnError: nfqueue.Drop},
+			nil,
+			[]byte{0x45, 0x00}},
+		{"timeout",
+			nfqueue.Config{Policy: nfqueue.Accept, OnTimeout: nfqueue.Drop, Timeout: 10 * time.Millisecond},
+			[]nfqueue.Plugin{deferPlugin("p1", nfqueue.Accept, time.Second)},
+			testPacket(t)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			switches := nfqueue.NewSwitches()
+			switches.SetMonitorAll(true)
+			test.cfg.Switches = switches
+			svc, nl := startService(t, test.cfg, test.plugins)
+			defer svc.Shutdown()
+			q := testQueue(t, nl)
+			id, err := q.Inject(test.data)
+			if err != nil {
+				t.Fatalf("injecting packet: %v", err)
+			}
+			if got := waitVerdict(t, q, id); got != nfqueue.Accept {
+				t.Errorf("verdict = %v, want %v", got, nfqueue.Accept)
+			}
+		})
+	}
+}
+
+func TestNewGroupHooksChain(t *testing.T) {
+	plugins := []nfqueue.Plugin{
+		verdictPlugin("p1", nfqueue.Default),
+		verdictPlugin("p2", nfqueue.Default),
+		verdictPlugin("p3", nfqueue.Default),
+	}
+	var tests = []struct {
+		name    string
+		chain   []string
+		want    []string
+		wantErr bool
+	}{
+		{"all", nil, []string{"p1", "p2", "p3"}, false},
+		{"chain", []string{"p3", "p1"}, []string{"p3", "p1"}, false},
+		{"not found", []string{"p1", "p4"}, nil, true},
+		{"repeated", []string{"p2", "p2"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hooks, err := nfqueue.NewGroupHooks(nfqueue.GroupConfig{Plugins: test.chain}, plugins)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewGroupHooks() err = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := make([]string, 0)
+			for _, cb := range hooks.PacketHooks() {
+				got = append(got, cb.Plugin)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("NewGroupHooks() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Strategy defines how the verdicts returned by the packet hooks of a
+// pipeline are combined
+type Strategy int
+
+// Strategies
+const (
+	// FirstMatch applies the first verdict returned by a hook
+	FirstMatch Strategy = iota
+	// MostRestrictive runs all the hooks and applies the most restrictive
+	// verdict: drop, queue, repeat and accept
+	MostRestrictive
+	// AcceptNonTerminal continues the processing when a hook accepts the
+	// packet, so later hooks can still drop it. The first accept is applied
+	// if no other verdict is returned.
+	AcceptNonTerminal
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case FirstMatch:
+		return "first-match"
+	case MostRestrictive:
+		return "most-restrictive"
+	case AcceptNonTerminal:
+		return "accept-nonterminal"
+	}
+	return fmt.Sprintf("unknown(%v)", int(s))
+}
+
+// ToStrategy returns a strategy from a string. Valid values are
+// "first-match", "most-restrictive" and "accept-nonterminal", empty is
+// first-match.
+func ToStrategy(s string) (Strategy, error) {
+	switch strings.ToLower(s) {
+	case "", "first-match":
+		return FirstMatch, nil
+	case "most-restrictive":
+		return MostRestrictive, nil
+	case "accept-nonterminal":
+		return AcceptNonTerminal, nil
+	}
+	return Strategy(-1), fmt.Errorf("invalid strategy %s", s)
+}
+
+// decide returns true if the verdict returned by a hook ends the processing
+// of the packet. Otherwise the verdict is held in metadata and applied if
+// the remaining hooks don't return a verdict that replaces it.
+func (s Strategy) decide(md *Metadata, v Verdict) bool {
+	if v == Default {
+		return false
+	}
+	if v == Pending {
+		return true
+	}
+	switch s {
+	case MostRestrictive:
+		if restrictiveness(v) > restrictiveness(md.held) {
+			md.hold(v)
+		}
+		return false
+	case AcceptNonTerminal:
+		if v.Kind() != Accept {
+			return true
+		}
+		if md.held == Default {
+			md.hold(v)
+		}
+		return false
+	}
+	return true
+}
+
+func restrictiveness(v Verdict) int {
+	switch v.Kind() {
+	case Accept:
+		return 1
+	case Repeat:
+		return 2
+	case Queue:
+		return 3
+	case Drop:
+		return 4
+	}
+	return 0
+}
+
+// hold stores the verdict and who returned it
+func (md *Metadata) hold(v Verdict) {
+	md.held, md.heldPlugin, md.heldAction = v, md.Plugin, md.Action
+}
+
+// release returns the verdict held and restores who returned it
+func (md *Metadata) release() Verdict {
+	if md.held != Default {
+		md.Plugin, md.Action = md.heldPlugin, md.heldAction
+	}
+	return md.held
+}
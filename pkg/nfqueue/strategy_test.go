@@ -0,0 +1,120 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"testing"
+)
+
+func TestToStrategy(t *testing.T) {
+	var tests = []struct {
+		in      string
+		want    Strategy
+		wantErr bool
+	}{
+		{"", FirstMatch, false},
+		{"first-match", FirstMatch, false},
+		{"Most-Restrictive", MostRestrictive, false},
+		{"accept-nonterminal", AcceptNonTerminal, false},
+		{"random", Strategy(-1), true},
+	}
+	for _, test := range tests {
+		got, err := ToStrategy(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ToStrategy(%q) err = %v, wantErr %v", test.in, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ToStrategy(%q) = %v, want %v", test.in, got, test.want)
+		}
+		if !test.wantErr && test.in != "" {
+			if s, _ := ToStrategy(got.String()); s != got {
+				t.Errorf("ToStrategy(%v.String()) = %v", got, s)
+			}
+		}
+	}
+}
+
+// hookVerdict is the verdict returned by the hook of a plugin
+type hookVerdict struct {
+	plugin  string
+	verdict Verdict
+}
+
+// decideHooks emulates the execution of the hooks, it returns the verdict
+// decided, who decided it and the number of hooks executed
+func decideHooks(s Strategy, hooks []hookVerdict) (Verdict, string, int) {
+	md := &Metadata{}
+	for i, h := range hooks {
+		md.Plugin = h.plugin
+		if s.decide(md, h.verdict) {
+			return h.verdict, md.Plugin, i + 1
+		}
+		md.Plugin, md.Action = "", ""
+	}
+	v := md.release()
+	return v, md.Plugin, len(hooks)
+}
+
+func TestStrategyDecide(t *testing.T) {
+	var tests = []struct {
+		name     string
+		strategy Strategy
+		hooks    []hookVerdict
+		want     Verdict
+		by       string
+		executed int
+	}{
+		// first match
+		{"first match none", FirstMatch,
+			[]hookVerdict{{"p1", Default}, {"p2", Default}},
+			Default, "", 2},
+		{"first match accept", FirstMatch,
+			[]hookVerdict{{"p1", Default}, {"p2", Accept}, {"p3", Drop}},
+			Accept, "p2", 2},
+		{"first match pending", FirstMatch,
+			[]hookVerdict{{"p1", Pending}, {"p2", Drop}},
+			Pending, "p1", 1},
+		// most restrictive
+		{"most restrictive none", MostRestrictive,
+			[]hookVerdict{{"p1", Default}, {"p2", Default}},
+			Default, "", 2},
+		{"most restrictive drop", MostRestrictive,
+			[]hookVerdict{{"p1", Accept}, {"p2", Drop}, {"p3", Repeat}},
+			Drop, "p2", 3},
+		{"most restrictive order", MostRestrictive,
+			[]hookVerdict{{"p1", Accept.WithMark(1)}, {"p2", Repeat}, {"p3", QueueTo(2)}, {"p4", Accept}},
+			QueueTo(2), "p3", 4},
+		{"most restrictive first of same", MostRestrictive,
+			[]hookVerdict{{"p1", Accept.WithMark(1)}, {"p2", Accept.WithMark(2)}},
+			Accept.WithMark(1), "p1", 2},
+		{"most restrictive pending", MostRestrictive,
+			[]hookVerdict{{"p1", Accept}, {"p2", Pending}, {"p3", Drop}},
+			Pending, "p2", 2},
+		// accept non terminal
+		{"accept nonterminal none", AcceptNonTerminal,
+			[]hookVerdict{{"p1", Default}},
+			Default, "", 1},
+		{"accept nonterminal first accept", AcceptNonTerminal,
+			[]hookVerdict{{"p1", Accept.WithMark(1)}, {"p2", Default}, {"p3", Accept.WithMark(2)}},
+			Accept.WithMark(1), "p1", 3},
+		{"accept nonterminal drop", AcceptNonTerminal,
+			[]hookVerdict{{"p1", Accept}, {"p2", Drop}, {"p3", Repeat}},
+			Drop, "p2", 2},
+		{"accept nonterminal queue", AcceptNonTerminal,
+			[]hookVerdict{{"p1", QueueTo(3)}, {"p2", Drop}},
+			QueueTo(3), "p1", 1},
+		{"accept nonterminal pending", AcceptNonTerminal,
+			[]hookVerdict{{"p1", Accept}, {"p2", Pending}},
+			Pending, "p2", 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, by, executed := decideHooks(test.strategy, test.hooks)
+			if got != test.want || by != test.by || executed != test.executed {
+				t.Errorf("decide() = %v by %q after %v hooks, want %v by %q after %v",
+					got, by, executed, test.want, test.by, test.executed)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"time"
+)
+
+// supervise schedules the restart of a failed group, running is the time
+// that the group was running before failing. It must be called with the
+// service mutex locked.
+func (s *PacketService) supervise(g *queueGroup, running time.Duration) {
+	if !s.started || s.groups[g.name] != g || g.isRunning() || g.timer != nil {
+		return
+	}
+	if s.opts.backoff <= 0 {
+		return
+	}
+	// reset backoff if the group was running a while
+	if running > s.backoff(g.failures) {
+		g.failures = 0
+	}
+	g.failures++
+	delay := s.backoff(g.failures)
+	s.startBypass(g)
+	s.logger.Warnf("restarting nfqueue group %s in %v (failures: %v)", g.name, delay, g.failures)
+	g.timer = time.AfterFunc(delay, func() { s.restart(g) })
+}
+
+// backoff returns the delay for the restart after n consecutive failures
+func (s *PacketService) backoff(n int) time.Duration {
+	delay := s.opts.backoff
+	for i := 1; i < n; i++ {
+		delay = delay * 2
+		if s.opts.maxBackoff > 0 && delay >= s.opts.maxBackoff {
+			return s.opts.maxBackoff
+		}
+	}
+	return delay
+}
+
+func (s *PacketService) restart(g *queueGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g.timer = nil
+	if !s.started || s.groups[g.name] != g || g.isRunning() {
+		return
+	}
+	s.stopBypass(g)
+	err := s.doStart(g)
+	if err != nil {
+		s.logger.Warnf("restarting nfqueue group %s: %v", g.name, err)
+		s.supervise(g, 0)
+		return
+	}
+	g.restarts++
+	s.logger.Infof("nfqueue group %s restarted (restarts: %v)", g.name, g.restarts)
+}
+
+// startBypass starts the bypass processor in the queues of the group
+func (s *PacketService) startBypass(g *queueGroup) {
+	if s.opts.bypass == nil || g.bypassStop != nil {
+		return
+	}
+	stop, errCh, err := s.opts.bypass.Process(g.qids, NewHooks())
+	if err != nil {
+		s.logger.Warnf("starting bypass in nfqueue group %s: %v", g.name, err)
+		return
+	}
+	s.logger.Infof("bypassing nfqueue group %s", g.name)
+	g.bypassStop = stop
+	s.wg.Add(1)
+	go func() {
+		for err := range errCh {
+			s.errCh <- err
+		}
+		s.wg.Done()
+	}()
+}
+
+func (s *PacketService) stopBypass(g *queueGroup) {
+	if g.bypassStop != nil {
+		g.bypassStop()
+		g.bypassStop = nil
+	}
+}
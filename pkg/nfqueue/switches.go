@@ -0,0 +1,210 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Switches stores the plugins and actions disabled or in monitor mode at
+// runtime. The hooks of disabled plugins and actions are skipped. The
+// verdicts of plugins and actions in monitor mode are recorded but not
+// applied, so the processing continues with the next hooks. In global
+// monitor mode all packets are accepted. Actions are
+// named using the plugin name as prefix: "plugin.action". It's safe for
+// concurrent use and a nil value has all enabled and monitor mode off.
+type Switches struct {
+	mu    sync.Mutex
+	state atomic.Value //*switchState, copied on write
+}
+
+type switchState struct {
+	disabled   map[string]bool
+	monitor    map[string]bool
+	monitorAll bool
+}
+
+// NewSwitches returns a new switches with all enabled
+func NewSwitches() *Switches {
+	s := &Switches{}
+	s.state.Store(&switchState{
+		disabled: make(map[string]bool),
+		monitor:  make(map[string]bool),
+	})
+	return s
+}
+
+// Enable plugin or action by name
+func (s *Switches) Enable(name string) {
+	s.update(func(st *switchState) { delete(st.disabled, name) })
+}
+
+// Disable plugin or action by name
+func (s *Switches) Disable(name string) {
+	s.update(func(st *switchState) { st.disabled[name] = true })
+}
+
+// SetMonitor sets the monitor mode of the plugin or action by name
+func (s *Switches) SetMonitor(name string, on bool) {
+	s.update(func(st *switchState) {
+		if on {
+			st.monitor[name] = true
+			return
+		}
+		delete(st.monitor, name)
+	})
+}
+
+// SetMonitorAll sets the global monitor mode
+func (s *Switches) SetMonitorAll(on bool) {
+	s.update(func(st *switchState) { st.monitorAll = on })
+}
+
+func (s *Switches) update(fn func(*switchState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.load()
+	updated := &switchState{
+		disabled:   make(map[string]bool, len(current.disabled)+1),
+		monitor:    make(map[string]bool, len(current.monitor)+1),
+		monitorAll: current.monitorAll,
+	}
+	for k := range current.disabled {
+		updated.disabled[k] = true
+	}
+	for k := range current.monitor {
+		updated.monitor[k] = true
+	}
+	fn(updated)
+	s.state.Store(updated)
+}
+
+func (s *Switches) load() *switchState {
+	return s.state.Load().(*switchState)
+}
+
+// Enabled returns true if the plugin or action is enabled
+func (s *Switches) Enabled(name string) bool {
+	if s == nil {
+		return true
+	}
+	return !s.load().disabled[name]
+}
+
+// Monitor returns true if the plugin or action is in monitor mode
+func (s *Switches) Monitor(name string) bool {
+	if s == nil {
+		return false
+	}
+	return s.load().monitor[name]
+}
+
+// MonitorAll returns true if the global monitor mode is set
+func (s *Switches) MonitorAll() bool {
+	if s == nil {
+		return false
+	}
+	return s.load().monitorAll
+}
+
+// Disabled returns the names of disabled plugins and actions sorted
+func (s *Switches) Disabled() []string {
+	if s == nil {
+		return []string{}
+	}
+	return sortedNames(s.load().disabled)
+}
+
+// Monitored returns the names of plugins and actions in monitor mode sorted
+func (s *Switches) Monitored() []string {
+	if s == nil {
+		return []string{}
+	}
+	return sortedNames(s.load().monitor)
+}
+
+func sortedNames(m map[string]bool) []string {
+	ret := make([]string, 0, len(m))
+	for name := range m {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ActionName returns the name used for the action of the plugin
+func ActionName(plugin, action string) string {
+	return plugin + "." + action
+}
+
+// ActionEnabled is used by plugins that run actions to check if the action
+// was disabled at runtime, action is the name returned by the action
+// instance (see ActionName)
+func (md *Metadata) ActionEnabled(action string) bool {
+	return md.switches.Enabled(action)
+}
+
+// ActionMonitored returns true if the verdict of the action will not be
+// applied because of the monitor mode, so actions can include it in the
+// events they raise
+func (md *Metadata) ActionMonitored(action string) bool {
+	sw := md.switches
+	return sw.MonitorAll() || sw.Monitor(md.Plugin) || sw.Monitor(action)
+}
+
+// MonitorAction is used by plugins that run actions, if the action is in
+// monitor mode the verdict is recorded and Default is returned, so the
+// processing of the packet continues
+func (md *Metadata) MonitorAction(action string, v Verdict) Verdict {
+	if v == Default || v == Pending || !md.switches.Monitor(action) {
+		return v
+	}
+	md.monitor(md.Plugin, action, v)
+	return Default
+}
+
+// monitorPlugin returns Default and records the verdict if the plugin is
+// in monitor mode
+func (md *Metadata) monitorPlugin(plugin string, v Verdict) Verdict {
+	if v == Default || v == Pending || !md.switches.Monitor(plugin) {
+		return v
+	}
+	md.monitor(plugin, md.Action, v)
+	return Default
+}
+
+// monitorAll returns Accept and records the verdict if the global monitor
+// mode is set, plugin and action are empty if the verdict is not returned
+// by a plugin (policy, errors or timeouts)
+func (md *Metadata) monitorAll(plugin, action string, v Verdict) Verdict {
+	if v.Kind() == Accept || !md.switches.MonitorAll() {
+		return v
+	}
+	md.monitor(plugin, action, v)
+	return Accept
+}
+
+// wouldBeDesc returns the description of who returned the verdict not
+// applied
+func (md *Metadata) wouldBeDesc() string {
+	switch {
+	case md.WouldBeAction != "":
+		return md.WouldBeAction
+	case md.WouldBePlugin != "":
+		return md.WouldBePlugin
+	}
+	return "policy"
+}
+
+// monitor records the verdict not applied because of the monitor mode,
+// only the first one is stored in metadata
+func (md *Metadata) monitor(plugin, action string, v Verdict) {
+	if md.WouldBe == Default {
+		md.WouldBe, md.WouldBePlugin, md.WouldBeAction = v, plugin, action
+	}
+	if md.collector != nil {
+		md.collector.Monitor(md.QID, plugin, action, v)
+	}
+}
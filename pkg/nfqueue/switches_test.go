@@ -0,0 +1,117 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSwitches(t *testing.T) {
+	s := NewSwitches()
+	s.Disable("p1")
+	s.Disable("p1.a1")
+	s.Enable("p1")
+	s.SetMonitor("p2", true)
+	s.SetMonitor("p3", true)
+	s.SetMonitor("p3", false)
+	s.SetMonitorAll(true)
+
+	var tests = []struct {
+		name    string
+		enabled bool
+		monitor bool
+	}{
+		{"p1", true, false},
+		{"p1.a1", false, false},
+		{"p2", true, true},
+		{"p3", true, false},
+		{"unknown", true, false},
+	}
+	for _, test := range tests {
+		if got := s.Enabled(test.name); got != test.enabled {
+			t.Errorf("Enabled(%s) = %v, want %v", test.name, got, test.enabled)
+		}
+		if got := s.Monitor(test.name); got != test.monitor {
+			t.Errorf("Monitor(%s) = %v, want %v", test.name, got, test.monitor)
+		}
+	}
+	if !s.MonitorAll() {
+		t.Error("MonitorAll() = false, want true")
+	}
+	if got := s.Disabled(); !reflect.DeepEqual(got, []string{"p1.a1"}) {
+		t.Errorf("Disabled() = %v", got)
+	}
+	if got := s.Monitored(); !reflect.DeepEqual(got, []string{"p2"}) {
+		t.Errorf("Monitored() = %v", got)
+	}
+	// nil value
+	var sn *Switches
+	if !sn.Enabled("p1") || sn.Monitor("p1") || sn.MonitorAll() || len(sn.Disabled()) != 0 || len(sn.Monitored()) != 0 {
+		t.Error("nil switches must have all enabled and monitor mode off")
+	}
+}
+
+func TestMetadataMonitor(t *testing.T) {
+	s := NewSwitches()
+	s.SetMonitor("p1", true)
+	s.SetMonitor("p2.a1", true)
+
+	var tests = []struct {
+		name       string
+		monitorAll bool
+		fn         func(md *Metadata) Verdict
+		want       Verdict
+		wouldBe    Verdict
+		by         string
+	}{
+		{"plugin", false,
+			func(md *Metadata) Verdict { return md.monitorPlugin("p1", Drop) },
+			Default, Drop, "p1"},
+		{"plugin default", false,
+			func(md *Metadata) Verdict { return md.monitorPlugin("p1", Default) },
+			Default, Default, "policy"},
+		{"plugin pending", false,
+			func(md *Metadata) Verdict { return md.monitorPlugin("p1", Pending) },
+			Pending, Default, "policy"},
+		{"plugin not monitored", false,
+			func(md *Metadata) Verdict { return md.monitorPlugin("p2", Drop) },
+			Drop, Default, "policy"},
+		{"action", false,
+			func(md *Metadata) Verdict { return md.MonitorAction("p2.a1", Drop) },
+			Default, Drop, "p2.a1"},
+		{"action not monitored", false,
+			func(md *Metadata) Verdict { return md.MonitorAction("p2.a2", Drop) },
+			Drop, Default, "policy"},
+		{"all off", false,
+			func(md *Metadata) Verdict { return md.monitorAll("p2", "", Drop) },
+			Drop, Default, "policy"},
+		{"all", true,
+			func(md *Metadata) Verdict { return md.monitorAll("p2", "", Drop) },
+			Accept, Drop, "p2"},
+		{"all accept", true,
+			func(md *Metadata) Verdict { return md.monitorAll("p2", "", Accept.WithMark(1)) },
+			Accept.WithMark(1), Default, "policy"},
+		{"all policy", true,
+			func(md *Metadata) Verdict { return md.monitorAll("", "", Repeat) },
+			Accept, Repeat, "policy"},
+		{"first recorded", true,
+			func(md *Metadata) Verdict {
+				md.monitorPlugin("p1", Drop)
+				return md.monitorAll("", "", Repeat)
+			},
+			Accept, Drop, "p1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s.SetMonitorAll(test.monitorAll)
+			md := &Metadata{Plugin: "p2", switches: s}
+			if got := test.fn(md); got != test.want {
+				t.Errorf("verdict = %v, want %v", got, test.want)
+			}
+			if md.WouldBe != test.wouldBe || md.wouldBeDesc() != test.by {
+				t.Errorf("would be = %v by %s, want %v by %s", md.WouldBe, md.wouldBeDesc(), test.wouldBe, test.by)
+			}
+		})
+	}
+}
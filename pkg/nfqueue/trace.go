@@ -0,0 +1,263 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/luids-io/core/yalogi"
+)
+
+// TraceFilter selects the packets traced, a packet matches if its source
+// or destination address is in Nets and its source or destination port is
+// in Ports. Empty values match all packets.
+type TraceFilter struct {
+	Nets  []*net.IPNet
+	Ports []uint16
+}
+
+// TraceStep stores the execution of a packet hook. Action is empty in the
+// steps of plugins.
+type TraceStep struct {
+	Plugin  string        `json:"plugin"`
+	Action  string        `json:"action,omitempty"`
+	Verdict string        `json:"verdict"`
+	Error   string        `json:"error,omitempty"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// Trace stores the processing of a packet
+type Trace struct {
+	QID       int         `json:"qid"`
+	PacketID  uint32      `json:"id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Proto     string      `json:"proto,omitempty"`
+	SrcIP     string      `json:"srcip,omitempty"`
+	DstIP     string      `json:"dstip,omitempty"`
+	SrcPort   uint16      `json:"srcport,omitempty"`
+	DstPort   uint16      `json:"dstport,omitempty"`
+	Steps     []TraceStep `json:"steps"`
+	Verdict   string      `json:"verdict"`
+	WouldBe   string      `json:"wouldbe,omitempty"`
+	TimedOut  bool        `json:"timeout,omitempty"`
+
+	mu sync.Mutex
+}
+
+// TraceFn is called with the traces of the packets when their verdict is
+// set, it must be safe for concurrent use
+type TraceFn func(*Trace)
+
+// Tracer records the hooks executed in the processing of the packets that
+// match a filter. It's disabled by default and it can be enabled or
+// disabled at runtime. It's safe for concurrent use.
+type Tracer struct {
+	emit TraceFn
+
+	mu      sync.RWMutex
+	enabled bool
+	filter  TraceFilter
+}
+
+// NewTracer returns a new disabled tracer that emits the traces to fn
+func NewTracer(fn TraceFn) *Tracer {
+	return &Tracer{emit: fn}
+}
+
+// Enable tracing the packets that match the filter
+func (t *Tracer) Enable(filter TraceFilter) {
+	t.mu.Lock()
+	t.enabled, t.filter = true, filter
+	t.mu.Unlock()
+}
+
+// Disable tracing
+func (t *Tracer) Disable() {
+	t.mu.Lock()
+	t.enabled, t.filter = false, TraceFilter{}
+	t.mu.Unlock()
+}
+
+// Status returns if tracing is enabled and the filter
+func (t *Tracer) Status() (bool, TraceFilter) {
+	if t == nil {
+		return false, TraceFilter{}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.enabled, t.filter
+}
+
+// start returns a new trace if the packet must be traced, nil otherwise
+func (t *Tracer) start(packet gopacket.Packet, md *Metadata) *Trace {
+	enabled, filter := t.Status()
+	if !enabled {
+		return nil
+	}
+	tr := &Trace{QID: md.QID, PacketID: md.PacketID, Timestamp: md.Timestamp, Steps: make([]TraceStep, 0)}
+	var src, dst net.IP
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, dst = ip.SrcIP, ip.DstIP
+		tr.Proto = strings.ToLower(ip.Protocol.String())
+	case *layers.IPv6:
+		src, dst = ip.SrcIP, ip.DstIP
+		tr.Proto = strings.ToLower(ip.NextHeader.String())
+	default:
+		return nil
+	}
+	tr.SrcIP, tr.DstIP = src.String(), dst.String()
+	switch tl := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		tr.Proto = "tcp"
+		tr.SrcPort, tr.DstPort = uint16(tl.SrcPort), uint16(tl.DstPort)
+	case *layers.UDP:
+		tr.Proto = "udp"
+		tr.SrcPort, tr.DstPort = uint16(tl.SrcPort), uint16(tl.DstPort)
+	default:
+		// the transport layer isn't decoded with the network decode depth,
+		// so the ports are read from the raw packet
+		if t, ok := rawTuple(packet.Data()); ok {
+			tr.Proto = strings.ToLower(layers.IPProtocol(t.proto).String())
+			tr.SrcPort, tr.DstPort = t.ports()
+		}
+	}
+	if !filter.matchIP(src, dst) || !filter.matchPort(tr.SrcPort, tr.DstPort) {
+		return nil
+	}
+	return tr
+}
+
+// ToTraceFilter returns the filter of the nets in CIDR notation and ports
+func ToTraceFilter(nets []string, ports []int) (TraceFilter, error) {
+	filter := TraceFilter{
+		Nets:  make([]*net.IPNet, 0, len(nets)),
+		Ports: make([]uint16, 0, len(ports)),
+	}
+	for _, s := range nets {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return TraceFilter{}, fmt.Errorf("invalid net '%s'", s)
+		}
+		filter.Nets = append(filter.Nets, ipnet)
+	}
+	for _, port := range ports {
+		if port <= 0 || port > 0xFFFF {
+			return TraceFilter{}, fmt.Errorf("invalid port %v", port)
+		}
+		filter.Ports = append(filter.Ports, uint16(port))
+	}
+	return filter, nil
+}
+
+func (f TraceFilter) matchIP(src, dst net.IP) bool {
+	if len(f.Nets) == 0 {
+		return true
+	}
+	for _, n := range f.Nets {
+		if n.Contains(src) || n.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f TraceFilter) matchPort(src, dst uint16) bool {
+	if len(f.Ports) == 0 {
+		return true
+	}
+	for _, p := range f.Ports {
+		if p == src || p == dst {
+			return true
+		}
+	}
+	return false
+}
+
+// finish sets the verdict of the trace and emits it
+func (t *Tracer) finish(tr *Trace, md *Metadata, v Verdict, timedOut bool) {
+	tr.mu.Lock()
+	tr.Verdict, tr.TimedOut = v.String(), timedOut
+	if md.WouldBe != Default {
+		tr.WouldBe = md.WouldBe.String()
+	}
+	tr.mu.Unlock()
+	t.emit(tr)
+}
+
+func (tr *Trace) add(plugin, action string, v Verdict, err error, elapsed time.Duration) {
+	step := TraceStep{Plugin: plugin, Action: action, Verdict: v.String(), Elapsed: elapsed}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	tr.mu.Lock()
+	tr.Steps = append(tr.Steps, step)
+	tr.mu.Unlock()
+}
+
+// String returns a description of the trace in one line
+func (tr *Trace) String() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	src, dst := tr.SrcIP, tr.DstIP
+	if tr.SrcPort > 0 || tr.DstPort > 0 {
+		src = fmt.Sprintf("%s:%v", tr.SrcIP, tr.SrcPort)
+		dst = fmt.Sprintf("%s:%v", tr.DstIP, tr.DstPort)
+	}
+	steps := make([]string, 0, len(tr.Steps))
+	for _, s := range tr.Steps {
+		name := s.Plugin
+		if s.Action != "" {
+			name = s.Action
+		}
+		desc := fmt.Sprintf("%s=%s(%v)", name, s.Verdict, s.Elapsed)
+		if s.Error != "" {
+			desc = fmt.Sprintf("%s[%s]", desc, s.Error)
+		}
+		steps = append(steps, desc)
+	}
+	s := fmt.Sprintf("packet %v qid(#%v) %s %s -> %s: %s => %s", tr.PacketID, tr.QID, tr.Proto, src, dst,
+		strings.Join(steps, ", "), tr.Verdict)
+	if tr.TimedOut {
+		s = s + " (timeout)"
+	}
+	if tr.WouldBe != "" {
+		s = fmt.Sprintf("%s [monitor: %s]", s, tr.WouldBe)
+	}
+	return s
+}
+
+// LogTraces returns a function that emits the traces to the logger
+func LogTraces(logger yalogi.Logger) TraceFn {
+	return func(tr *Trace) {
+		logger.Infof("trace: %v", tr)
+	}
+}
+
+// JSONTraces returns a function that writes the traces in JSON lines
+func JSONTraces(w io.Writer) TraceFn {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(tr *Trace) {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(tr)
+	}
+}
+
+// Traced returns true if the processing of the packet is traced, so
+// plugins can avoid measuring times when it's not required
+func (md *Metadata) Traced() bool {
+	return md.trace != nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestToTraceFilter(t *testing.T) {
+	var tests = []struct {
+		name    string
+		nets    []string
+		ports   []int
+		want    int
+		wantErr bool
+	}{
+		{"empty", nil, nil, 0, false},
+		{"nets and ports", []string{"10.0.0.0/8", "2001:db8::/32"}, []int{53, 65535}, 4, false},
+		{"bad net", []string{"10.0.0.1"}, nil, 0, true},
+		{"zero port", nil, []int{0}, 0, true},
+		{"big port", nil, []int{65536}, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ToTraceFilter(test.nets, test.ports)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ToTraceFilter() err = %v, wantErr %v", err, test.wantErr)
+			}
+			if len(got.Nets)+len(got.Ports) != test.want {
+				t.Errorf("ToTraceFilter() = %v", got)
+			}
+		})
+	}
+}
+
+func TestTraceFilterMatch(t *testing.T) {
+	filter, err := ToTraceFilter([]string{"10.0.0.0/8", "2001:db8::/32"}, []int{53, 8080})
+	if err != nil {
+		t.Fatalf("ToTraceFilter() err = %v", err)
+	}
+	var tests = []struct {
+		filter     TraceFilter
+		src, dst   string
+		sport, dpt uint16
+		want       bool
+	}{
+		{filter, "10.0.0.1", "192.168.1.1", 1024, 53, true},
+		{filter, "192.168.1.1", "10.0.0.1", 8080, 1024, true},
+		{filter, "2001:db8::1", "2001:db9::1", 1024, 53, true},
+		{filter, "192.168.1.1", "192.168.1.2", 1024, 53, false},
+		{filter, "10.0.0.1", "192.168.1.1", 1024, 80, false},
+		{filter, "10.0.0.1", "192.168.1.1", 0, 0, false},
+		{TraceFilter{}, "192.168.1.1", "192.168.1.2", 0, 0, true},
+	}
+	for _, test := range tests {
+		src, dst := net.ParseIP(test.src), net.ParseIP(test.dst)
+		got := test.filter.matchIP(src, dst) && test.filter.matchPort(test.sport, test.dpt)
+		if got != test.want {
+			t.Errorf("match(%s:%v -> %s:%v) = %v, want %v", test.src, test.sport, test.dst, test.dpt, got, test.want)
+		}
+	}
+}
+
+func TestTracerStart(t *testing.T) {
+	ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("10.0.0.2")}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Destination,
+		SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	udp := &layers.UDP{SrcPort: 1024, DstPort: 8080}
+	data4 := rawPacket(t, ip4, udp, gopacket.Payload("data"))
+	data6 := rawPacket(t, ip6, destOptions(layers.IPProtocolUDP, 20), udp, gopacket.Payload("data"))
+
+	var tests = []struct {
+		name  string
+		data  []byte
+		depth int
+		ports []int
+		want  bool
+	}{
+		{"ipv4 full", data4, depthFull, []int{8080}, true},
+		{"ipv4 network", data4, depthNetwork, []int{8080}, true},
+		{"ipv4 network other port", data4, depthNetwork, []int{53}, false},
+		{"ipv6 extensions full", data6, depthFull, []int{1024}, true},
+		{"ipv6 extensions network", data6, depthNetwork, []int{1024}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := ToTraceFilter(nil, test.ports)
+			if err != nil {
+				t.Fatalf("ToTraceFilter() err = %v", err)
+			}
+			tracer := NewTracer(func(*Trace) {})
+			tracer.Enable(filter)
+			packet := gopacket.NewPacket(test.data, newDecoder(ipLayerType(test.data), test.depth), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			tr := tracer.start(packet, &Metadata{QID: 1, PacketID: 1, Timestamp: time.Now()})
+			if (tr != nil) != test.want {
+				t.Fatalf("start() = %v, want trace %v", tr, test.want)
+			}
+			if tr == nil {
+				return
+			}
+			if tr.Proto != "udp" || tr.SrcPort != 1024 || tr.DstPort != 8080 {
+				t.Errorf("start() = %s %v:%v, want udp 1024:8080", tr.Proto, tr.SrcPort, tr.DstPort)
+			}
+		})
+	}
+}
@@ -4,44 +4,177 @@ package nfqueue
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
-// Verdict represents the actions that a firewall can do
-type Verdict int
+// Verdict represents the actions that a firewall can do. Some verdicts
+// carry an argument (queue number, packet mark or connection mark) encoded
+// in the upper bits of the value, so verdicts can be compared directly.
+type Verdict int64
 
 // Action types
 const (
 	Default Verdict = iota
 	Accept
 	Drop
+	Repeat
+	Queue
+	// Pending is returned by hooks that deferred the verdict
+	Pending
 )
 
+const (
+	verdictKindMask   = 0xff
+	verdictMarkFlag   = 1 << 8
+	verdictCtMarkFlag = 1 << 9
+	verdictArgShift   = 32
+)
+
+// QueueTo returns a verdict that sends the packet to the queue number qnum.
+func QueueTo(qnum uint16) Verdict {
+	return Queue | Verdict(qnum)<<verdictArgShift
+}
+
+// WithMark returns the verdict setting the packet mark. Only accept and
+// repeat verdicts can carry a mark, any other verdict is returned unchanged.
+func (v Verdict) WithMark(mark uint32) Verdict {
+	if !v.markable() {
+		return v
+	}
+	return v.Kind() | verdictMarkFlag | Verdict(mark)<<verdictArgShift
+}
+
+// WithConnMark returns the verdict setting the connection mark. Only accept
+// and repeat verdicts can carry a mark, any other verdict is returned unchanged.
+func (v Verdict) WithConnMark(mark uint32) Verdict {
+	if !v.markable() {
+		return v
+	}
+	return v.Kind() | verdictCtMarkFlag | Verdict(mark)<<verdictArgShift
+}
+
+// Kind returns the verdict without arguments.
+func (v Verdict) Kind() Verdict {
+	return v & verdictKindMask
+}
+
+// QueueNum returns the queue number of a queue verdict.
+func (v Verdict) QueueNum() (uint16, bool) {
+	if v.Kind() != Queue {
+		return 0, false
+	}
+	return uint16(v.arg()), true
+}
+
+// Mark returns the packet mark if the verdict sets it.
+func (v Verdict) Mark() (uint32, bool) {
+	if v&verdictMarkFlag == 0 {
+		return 0, false
+	}
+	return v.arg(), true
+}
+
+// ConnMark returns the connection mark if the verdict sets it.
+func (v Verdict) ConnMark() (uint32, bool) {
+	if v&verdictCtMarkFlag == 0 {
+		return 0, false
+	}
+	return v.arg(), true
+}
+
+func (v Verdict) arg() uint32 {
+	return uint32(v >> verdictArgShift)
+}
+
+func (v Verdict) markable() bool {
+	k := v.Kind()
+	return k == Accept || k == Repeat
+}
+
 func (v Verdict) String() string {
-	switch v {
+	var s string
+	switch v.Kind() {
 	case Default:
-		return "default"
+		s = "default"
 	case Accept:
-		return "accept"
+		s = "accept"
 	case Drop:
-		return "drop"
+		s = "drop"
+	case Repeat:
+		s = "repeat"
+	case Queue:
+		return fmt.Sprintf("queue:%v", v.arg())
+	case Pending:
+		return "pending"
 	default:
-		return fmt.Sprintf("unknown(%v)", int(v))
+		return fmt.Sprintf("unknown(%v)", int64(v))
 	}
+	if mark, ok := v.Mark(); ok {
+		return fmt.Sprintf("%s:mark=0x%x", s, mark)
+	}
+	if mark, ok := v.ConnMark(); ok {
+		return fmt.Sprintf("%s:connmark=0x%x", s, mark)
+	}
+	return s
 }
 
-// ToVerdict returns action from a string
+// ToVerdict returns action from a string. Valid values are "default",
+// "accept", "drop", "repeat", "queue:<num>" and accept or repeat with a
+// mark argument: "accept:mark=<mark>", "accept:connmark=<mark>".
 func ToVerdict(s string) (Verdict, error) {
-	switch strings.ToLower(s) {
+	s = strings.ToLower(s)
+	name, arg := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		name, arg = s[:i], s[i+1:]
+	}
+	switch name {
 	case "":
 		return Default, nil
 	case "default":
+		if arg != "" {
+			break
+		}
 		return Default, nil
-	case "accept":
-		return Accept, nil
 	case "drop":
+		if arg != "" {
+			break
+		}
 		return Drop, nil
+	case "accept", "repeat":
+		v := Accept
+		if name == "repeat" {
+			v = Repeat
+		}
+		if arg == "" {
+			return v, nil
+		}
+		return toMarkVerdict(v, arg)
+	case "queue":
+		qnum, err := strconv.ParseUint(arg, 0, 16)
+		if err != nil {
+			return Verdict(-1), fmt.Errorf("invalid verdict %s: bad queue number", s)
+		}
+		return QueueTo(uint16(qnum)), nil
+	}
+	return Verdict(-1), fmt.Errorf("invalid verdict %s", s)
+}
+
+func toMarkVerdict(v Verdict, arg string) (Verdict, error) {
+	i := strings.Index(arg, "=")
+	if i < 0 {
+		return Verdict(-1), fmt.Errorf("invalid verdict argument %s", arg)
+	}
+	mark, err := strconv.ParseUint(arg[i+1:], 0, 32)
+	if err != nil {
+		return Verdict(-1), fmt.Errorf("invalid verdict argument %s: bad mark", arg)
+	}
+	switch arg[:i] {
+	case "mark":
+		return v.WithMark(uint32(mark)), nil
+	case "connmark":
+		return v.WithConnMark(uint32(mark)), nil
 	default:
-		return Verdict(-1), fmt.Errorf("invalid verdict %s", s)
+		return Verdict(-1), fmt.Errorf("invalid verdict argument %s", arg)
 	}
 }
@@ -0,0 +1,122 @@
+// Copyright 2020 Luis Guillén Civera <luisguillenc@gmail.com>. View LICENSE.
+
+package nfqueue
+
+import "testing"
+
+func TestToVerdict(t *testing.T) {
+	var tests = []struct {
+		in      string
+		want    Verdict
+		wantErr bool
+	}{
+		{"", Default, false},
+		{"default", Default, false},
+		{"accept", Accept, false},
+		{"ACCEPT", Accept, false},
+		{"drop", Drop, false},
+		{"repeat", Repeat, false},
+		{"queue:0", QueueTo(0), false},
+		{"queue:10", QueueTo(10), false},
+		{"queue:0xffff", QueueTo(0xffff), false},
+		{"accept:mark=1", Accept.WithMark(1), false},
+		{"accept:mark=0x10", Accept.WithMark(0x10), false},
+		{"accept:mark=0xffffffff", Accept.WithMark(0xffffffff), false},
+		{"repeat:connmark=0x80000000", Repeat.WithConnMark(0x80000000), false},
+		{"pending", Verdict(-1), true},
+		{"default:1", Verdict(-1), true},
+		{"drop:mark=1", Verdict(-1), true},
+		{"queue", Verdict(-1), true},
+		{"queue:65536", Verdict(-1), true},
+		{"queue:-1", Verdict(-1), true},
+		{"accept:mark", Verdict(-1), true},
+		{"accept:mark=0x100000000", Verdict(-1), true},
+		{"accept:tos=1", Verdict(-1), true},
+		{"reject", Verdict(-1), true},
+	}
+	for _, test := range tests {
+		got, err := ToVerdict(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ToVerdict(%q) err = %v, wantErr %v", test.in, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ToVerdict(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestVerdictArgs(t *testing.T) {
+	var tests = []struct {
+		name     string
+		v        Verdict
+		kind     Verdict
+		qnum     int // -1 if not a queue verdict
+		mark     int64
+		connmark int64
+		str      string
+	}{
+		{"accept", Accept, Accept, -1, -1, -1, "accept"},
+		{"queue", QueueTo(7), Queue, 7, -1, -1, "queue:7"},
+		{"queue max", QueueTo(0xffff), Queue, 0xffff, -1, -1, "queue:65535"},
+		{"mark", Accept.WithMark(0x10), Accept, -1, 0x10, -1, "accept:mark=0x10"},
+		{"mark zero", Accept.WithMark(0), Accept, -1, 0, -1, "accept:mark=0x0"},
+		{"mark high bit", Accept.WithMark(0x80000000), Accept, -1, 0x80000000, -1, "accept:mark=0x80000000"},
+		{"mark max", Repeat.WithMark(0xffffffff), Repeat, -1, 0xffffffff, -1, "repeat:mark=0xffffffff"},
+		{"connmark", Accept.WithConnMark(0x20), Accept, -1, -1, 0x20, "accept:connmark=0x20"},
+		{"connmark high bit", Accept.WithConnMark(0xdeadbeef), Accept, -1, -1, 0xdeadbeef, "accept:connmark=0xdeadbeef"},
+		{"remark", Accept.WithMark(1).WithMark(2), Accept, -1, 2, -1, "accept:mark=0x2"},
+		{"drop not markable", Drop.WithMark(1), Drop, -1, -1, -1, "drop"},
+		{"queue not markable", QueueTo(3).WithConnMark(1), Queue, 3, -1, -1, "queue:3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.v.Kind(); got != test.kind {
+				t.Errorf("Kind() = %v, want %v", got, test.kind)
+			}
+			qnum, ok := test.v.QueueNum()
+			if ok != (test.qnum >= 0) || (ok && int(qnum) != test.qnum) {
+				t.Errorf("QueueNum() = %v %v, want %v", qnum, ok, test.qnum)
+			}
+			mark, ok := test.v.Mark()
+			if ok != (test.mark >= 0) || (ok && int64(mark) != test.mark) {
+				t.Errorf("Mark() = %v %v, want %v", mark, ok, test.mark)
+			}
+			connmark, ok := test.v.ConnMark()
+			if ok != (test.connmark >= 0) || (ok && int64(connmark) != test.connmark) {
+				t.Errorf("ConnMark() = %v %v, want %v", connmark, ok, test.connmark)
+			}
+			if got := test.v.String(); got != test.str {
+				t.Errorf("String() = %q, want %q", got, test.str)
+			}
+			// string representation is parsed to the same verdict
+			parsed, err := ToVerdict(test.v.String())
+			if err != nil || parsed != test.v {
+				t.Errorf("ToVerdict(%q) = %v %v, want %v", test.v.String(), parsed, err, test.v)
+			}
+		})
+	}
+}
+
+func TestVerdictArg(t *testing.T) {
+	var tests = []struct {
+		v    Verdict
+		want uint32
+	}{
+		{Accept, 0},
+		{QueueTo(1), 1},
+		{Accept.WithMark(0x7fffffff), 0x7fffffff},
+		{Accept.WithMark(0x80000000), 0x80000000},
+		{Accept.WithConnMark(0xffffffff), 0xffffffff},
+	}
+	for _, test := range tests {
+		if got := test.v.arg(); got != test.want {
+			t.Errorf("%v.arg() = %#x, want %#x", test.v, got, test.want)
+		}
+	}
+	// marks with the high bit set make the verdict negative, it must not
+	// be confused with the invalid verdict returned on errors
+	if v := Accept.WithMark(0x80000000); v >= 0 || v == Verdict(-1) || v.Kind() != Accept {
+		t.Errorf("Accept.WithMark(0x80000000) = %d", int64(v))
+	}
+}